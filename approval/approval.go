@@ -0,0 +1,318 @@
+// Package approval holds destructive command requests until they are
+// approved by a second person.
+package approval
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/micromdm/mdm"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/envelope"
+)
+
+// PendingBucket is the *bolt.DB bucket where requests awaiting a
+// decision are stored.
+const PendingBucket = "mdm.Command.PENDING"
+
+// DefaultRequestTypes are the destructive request types which should
+// require approval.
+var DefaultRequestTypes = []string{
+	"EraseDevice",
+	"DeviceLock",
+	"ClearPasscode",
+	"ClearRestrictionsPassword",
+	"DeleteUser",
+}
+
+// Service decides on command requests which are pending approval.
+type Service interface {
+	// Requests returns the requests with the status, or all requests if
+	// status is empty.
+	Requests(ctx context.Context, status Status) ([]Request, error)
+
+	// Approve creates the MDM Payload of a pending request.
+	Approve(ctx context.Context, id string) (*mdm.Payload, error)
+
+	// Reject discards a pending request.
+	Reject(ctx context.Context, id, reason string) error
+}
+
+// Status of a request.
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusApproved Status = "approved"
+	StatusRejected Status = "rejected"
+)
+
+// Request is a command request which requires approval.
+type Request struct {
+	ID            string              `json:"id"`
+	Status        Status              `json:"status"`
+	Command       *mdm.CommandRequest `json:"command"`
+	Origin        command.Origin      `json:"origin"`
+	Scheduling    command.Scheduling  `json:"scheduling"`
+	CorrelationID string              `json:"correlation_id,omitempty"`
+	CreatedAt     time.Time           `json:"created_at"`
+	DecidedBy     string              `json:"decided_by,omitempty"`
+	DecidedAt     *time.Time          `json:"decided_at,omitempty"`
+	Reason        string              `json:"reason,omitempty"`
+	CommandUUID   string              `json:"command_uuid,omitempty"`
+}
+
+// Policy selects the request types which require approval.
+type Policy struct {
+	RequestTypes []string
+}
+
+func (p Policy) requires(requestType string) bool {
+	for _, t := range p.RequestTypes {
+		if t == requestType {
+			return true
+		}
+	}
+	return false
+}
+
+// Gate holds command requests which require approval in a BoltDB bucket.
+// Other requests are passed through to the next service. Approved requests
+// are created by the next service, with the requester's Origin and the
+// approver.
+//
+// The secret fields of a request, masked by command.DefaultRedactor, are
+// cleared once it is approved or rejected.
+//
+// Gate implements both command.Service and Service.
+type Gate struct {
+	db       *bolt.DB
+	policy   Policy
+	next     command.Service
+	approved command.Service // creates approved requests
+	sealer   sealer
+}
+
+// The sealer interface is satisfied by an *envelope.Keyring.
+type sealer interface {
+	Seal([]byte) ([]byte, error)
+	Open([]byte) ([]byte, error)
+}
+
+// Option configures a Gate.
+type Option func(*Gate)
+
+// WithKeyring encrypts the stored requests with the keyring, which is
+// usually the keyring of the archive.
+func WithKeyring(k *envelope.Keyring) Option {
+	return func(g *Gate) {
+		g.sealer = k
+	}
+}
+
+// NewGate creates a Gate. The next service is usually the service which
+// archives and publishes events.
+func NewGate(db *bolt.DB, policy Policy, next command.Service, opts ...Option) (*Gate, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(PendingBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	g := &Gate{db: db, policy: policy, next: next, approved: next}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g, nil
+}
+
+// CreateApproved sets the service which creates the commands of approved
+// requests, which defaults to the next service. It is usually the service
+// chain which wraps the gate, so that approved commands are validated,
+// logged, instrumented and traced like other commands. The gate passes
+// approved requests through to the next service.
+//
+// CreateApproved must be called before the gate is used.
+func (g *Gate) CreateApproved(svc command.Service) {
+	g.approved = svc
+}
+
+type approvedKey struct{}
+
+// NewCommand holds requests which require approval and returns a
+// PendingError with the ID of the pending request. Requests which require
+// approval are rejected with ErrUnauthenticated if the caller is not
+// authenticated, because no approver could be told apart from them.
+func (g *Gate) NewCommand(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+	if approved, _ := ctx.Value(approvedKey{}).(bool); approved || req == nil || !g.policy.requires(req.RequestType) {
+		return g.next.NewCommand(ctx, req)
+	}
+	origin, _ := command.OriginFromContext(ctx)
+	if origin.Caller == "" {
+		return nil, ErrUnauthenticated
+	}
+	scheduling, _ := command.SchedulingFromContext(ctx)
+	correlationID, _ := command.CorrelationIDFromContext(ctx)
+	pending := Request{
+		ID:            uuid.NewV4().String(),
+		Status:        StatusPending,
+		Command:       req,
+		Origin:        origin,
+		Scheduling:    scheduling,
+		CorrelationID: correlationID,
+		CreatedAt:     time.Now().UTC(),
+	}
+	err := g.db.Update(func(tx *bolt.Tx) error {
+		return g.put(tx, &pending)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nil, PendingError{ID: pending.ID}
+}
+
+// Requests returns the requests with the status, oldest first.
+func (g *Gate) Requests(ctx context.Context, status Status) ([]Request, error) {
+	var requests []Request
+	err := g.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PendingBucket)).ForEach(func(k, v []byte) error {
+			var req Request
+			if err := g.unmarshal(v, &req); err != nil {
+				return err
+			}
+			if status == "" || req.Status == status {
+				requests = append(requests, req)
+			}
+			return nil
+		})
+	})
+	sort.Sort(byCreatedAt(requests))
+	return requests, err
+}
+
+// Approve marks a pending request approved by the caller in ctx and
+// creates the MDM Payload with the service set by CreateApproved. The
+// request is pending again if the payload can not be created, otherwise
+// its secret fields are cleared.
+func (g *Gate) Approve(ctx context.Context, id string) (*mdm.Payload, error) {
+	pending, err := g.decide(ctx, id, StatusApproved, "")
+	if err != nil {
+		return nil, err
+	}
+	origin := pending.Origin
+	origin.Approver = pending.DecidedBy
+	ctx = command.NewOriginContext(ctx, origin)
+	ctx = command.NewSchedulingContext(ctx, pending.Scheduling)
+	// the command keeps the correlation ID of the request which created
+	// it, not of the approval request.
+	if pending.CorrelationID != "" {
+		ctx = command.NewCorrelationContext(ctx, pending.CorrelationID)
+	}
+	ctx = context.WithValue(ctx, approvedKey{}, true)
+	payload, err := g.approved.NewCommand(ctx, pending.Command)
+	if err != nil {
+		g.db.Update(func(tx *bolt.Tx) error {
+			pending.Status = StatusPending
+			pending.DecidedBy = ""
+			pending.DecidedAt = nil
+			return g.put(tx, pending)
+		})
+		return nil, err
+	}
+	pending.CommandUUID = payload.CommandUUID
+	pending.Command = command.DefaultRedactor.Request(pending.Command)
+	err = g.db.Update(func(tx *bolt.Tx) error {
+		return g.put(tx, pending)
+	})
+	return payload, err
+}
+
+// Reject marks a pending request rejected by the caller in ctx, and clears
+// its secret fields.
+func (g *Gate) Reject(ctx context.Context, id, reason string) error {
+	_, err := g.decide(ctx, id, StatusRejected, reason)
+	return err
+}
+
+// decide moves a pending request to status. The decision must be made by
+// an authenticated caller other than the requester.
+func (g *Gate) decide(ctx context.Context, id string, status Status, reason string) (*Request, error) {
+	origin, _ := command.OriginFromContext(ctx)
+	if origin.Caller == "" {
+		return nil, ErrUnauthenticated
+	}
+	var req Request
+	err := g.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(PendingBucket)).Get([]byte(id))
+		if v == nil {
+			return ErrNotFound
+		}
+		if err := g.unmarshal(v, &req); err != nil {
+			return err
+		}
+		if req.Status != StatusPending {
+			return ErrDecided
+		}
+		if req.Origin.Caller == origin.Caller {
+			return ErrSameIdentity
+		}
+		now := time.Now().UTC()
+		req.Status = status
+		req.DecidedBy = origin.Caller
+		req.DecidedAt = &now
+		req.Reason = reason
+		// an approved request keeps its secrets until the command is
+		// created, in case it has to be pending again.
+		stored := req
+		if status == StatusRejected {
+			stored.Command = command.DefaultRedactor.Request(req.Command)
+		}
+		return g.put(tx, &stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// put stores the request, sealed if the gate has a keyring.
+func (g *Gate) put(tx *bolt.Tx, req *Request) error {
+	v, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if g.sealer != nil {
+		if v, err = g.sealer.Seal(v); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(PendingBucket)).Put([]byte(req.ID), v)
+}
+
+// unmarshal decodes a stored request. Requests which were stored before
+// the gate had a keyring are not sealed, and are read unchanged.
+func (g *Gate) unmarshal(v []byte, req *Request) error {
+	if g.sealer != nil {
+		var err error
+		if v, err = g.sealer.Open(v); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(v, req)
+}
+
+type byCreatedAt []Request
+
+func (r byCreatedAt) Len() int           { return len(r) }
+func (r byCreatedAt) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byCreatedAt) Less(i, j int) bool { return r[i].CreatedAt.Before(r[j].CreatedAt) }
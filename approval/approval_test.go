@@ -0,0 +1,267 @@
+package approval
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/envelope"
+	"github.com/micromdm/command/service/mock"
+)
+
+func TestGate(t *testing.T) {
+	var created *mdm.CommandRequest
+	var createdOrigin command.Origin
+	var createdCorrelation string
+	next := &mock.CommandService{
+		NewCommandFunc: func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+			created = req
+			createdOrigin, _ = command.OriginFromContext(ctx)
+			createdCorrelation, _ = command.CorrelationIDFromContext(ctx)
+			return mock.MockPayload, nil
+		},
+	}
+	gate := setupGate(t, next)
+	alice := callerContext("alice")
+	bob := callerContext("bob")
+
+	// requests which do not require approval are created immediately.
+	if _, err := gate.NewCommand(alice, &mdm.CommandRequest{RequestType: "DeviceInformation", UDID: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	if !next.NewCommandInvoked {
+		t.Fatal("request was held for approval")
+	}
+	next.NewCommandInvoked = false
+
+	id := mustHold(t, gate, command.NewCorrelationContext(alice, "workflow-1"))
+	if next.NewCommandInvoked {
+		t.Fatal("request was created before approval")
+	}
+
+	if _, err := gate.NewCommand(context.Background(), &mdm.CommandRequest{RequestType: "EraseDevice", UDID: "foo"}); err != ErrUnauthenticated {
+		t.Fatalf("want ErrUnauthenticated for a request without caller, have %v", err)
+	}
+	if _, err := gate.Approve(alice, id); err != ErrSameIdentity {
+		t.Fatalf("want ErrSameIdentity, have %v", err)
+	}
+	if _, err := gate.Approve(context.Background(), id); err != ErrUnauthenticated {
+		t.Fatalf("want ErrUnauthenticated, have %v", err)
+	}
+	if _, err := gate.Approve(bob, "missing"); err != ErrNotFound {
+		t.Fatalf("want ErrNotFound, have %v", err)
+	}
+
+	payload, err := gate.Approve(command.NewCorrelationContext(bob, "approval-1"), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "workflow-1", createdCorrelation; want != have {
+		t.Errorf("want correlation ID %q, have %q", want, have)
+	}
+	if want, have := mock.MockPayload.CommandUUID, payload.CommandUUID; want != have {
+		t.Errorf("want command uuid %q, have %q", want, have)
+	}
+	if want, have := "EraseDevice", created.RequestType; want != have {
+		t.Errorf("want request type %q, have %q", want, have)
+	}
+	if createdOrigin.Caller != "alice" || createdOrigin.Approver != "bob" {
+		t.Errorf("want caller alice approved by bob, have %#v", createdOrigin)
+	}
+	if _, err := gate.Approve(bob, id); err != ErrDecided {
+		t.Fatalf("want ErrDecided, have %v", err)
+	}
+
+	rejected := mustHold(t, gate, alice)
+	if err := gate.Reject(bob, rejected, "not today"); err != nil {
+		t.Fatal(err)
+	}
+	requests, err := gate.Requests(context.Background(), StatusRejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || requests[0].ID != rejected || requests[0].Reason != "not today" {
+		t.Errorf("unexpected rejected requests %#v", requests)
+	}
+}
+
+func TestGateHTTP(t *testing.T) {
+	gate := setupGate(t, &mock.CommandService{NewCommandFunc: mock.ReturnMockPayload})
+	id := mustHold(t, gate, callerContext("alice"))
+
+	limits := command.BodyLimits{Routes: map[string]int64{RouteReject: 64}}
+	h := MakeHTTPHandlers(context.Background(), MakeEndpoints(gate), limits,
+		httptransport.ServerBefore(command.OriginRequestFunc(command.BasicAuth(map[string]string{
+			"alice": "secret",
+			"bob":   "secret",
+		}))),
+	)
+	r := mux.NewRouter()
+	r.Handle("/v1/approvals", h.ListRequestsHandler).Methods("GET")
+	r.Handle("/v1/approvals/{id}/approve", h.ApproveHandler).Methods("POST")
+	r.Handle("/v1/approvals/{id}/reject", h.RejectHandler).Methods("POST")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		method, path string
+		user         string
+		reason       string
+		expectStatus int
+	}{
+		{"list", "GET", "/v1/approvals?status=pending", "bob", "test", http.StatusOK},
+		{"same_identity", "POST", "/v1/approvals/" + id + "/approve", "alice", "test", http.StatusForbidden},
+		{"not_found", "POST", "/v1/approvals/missing/approve", "bob", "test", http.StatusNotFound},
+		{"unauthenticated", "POST", "/v1/approvals/" + id + "/approve", "", "test", http.StatusUnauthorized},
+		{"body_too_large", "POST", "/v1/approvals/" + id + "/reject", "bob", strings.Repeat("x", 100), http.StatusRequestEntityTooLarge},
+		{"approve", "POST", "/v1/approvals/" + id + "/approve", "bob", "test", http.StatusCreated},
+		{"decided", "POST", "/v1/approvals/" + id + "/reject", "bob", "test", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, bytes.NewBufferString(`{"reason":"`+tt.reason+`"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, "secret")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if want, have := tt.expectStatus, resp.StatusCode; want != have {
+				t.Fatalf("want %d, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestGate_createApproved(t *testing.T) {
+	next := &mock.CommandService{NewCommandFunc: mock.ReturnMockPayload}
+	gate := setupGate(t, next)
+	// the gate is wrapped by a middleware, which must see the approved
+	// command.
+	var wrapped int
+	outer := mock.CommandService{
+		NewCommandFunc: func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+			wrapped++
+			return gate.NewCommand(ctx, req)
+		},
+	}
+	gate.CreateApproved(&outer)
+
+	id := mustHold(t, &outer, callerContext("alice"))
+	if _, err := gate.Approve(callerContext("bob"), id); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, wrapped; want != have {
+		t.Errorf("want the request and the approved command created through the wrapping service, have %d calls", have)
+	}
+	if !next.NewCommandInvoked {
+		t.Error("want the approved command passed through the gate")
+	}
+}
+
+func TestGate_secrets(t *testing.T) {
+	keyring, err := envelope.NewKeyring("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created *mdm.CommandRequest
+	gate := setupGate(t, &mock.CommandService{
+		NewCommandFunc: func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+			created = req
+			return mock.MockPayload, nil
+		},
+	}, WithKeyring(keyring))
+	alice := callerContext("alice")
+	bob := callerContext("bob")
+	hold := func() string {
+		_, err := gate.NewCommand(alice, &mdm.CommandRequest{RequestType: "EraseDevice", UDID: "foo", PIN: "123456"})
+		pending, ok := err.(PendingError)
+		if !ok {
+			t.Fatalf("want PendingError, have %v", err)
+		}
+		return pending.ApprovalID()
+	}
+	approved, rejected := hold(), hold()
+
+	err = gate.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(PendingBucket)).ForEach(func(k, v []byte) error {
+			if !envelope.IsSealed(v) {
+				t.Errorf("request %s is not encrypted", k)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gate.Approve(bob, approved); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "123456", created.PIN; want != have {
+		t.Errorf("want the command created with PIN %q, have %q", want, have)
+	}
+	if err := gate.Reject(bob, rejected, ""); err != nil {
+		t.Fatal(err)
+	}
+	requests, err := gate.Requests(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(requests); want != have {
+		t.Fatalf("want %d requests, have %d", want, have)
+	}
+	for _, req := range requests {
+		if want, have := command.Redacted, req.Command.PIN; want != have {
+			t.Errorf("%s request: want PIN %q, have %q", req.Status, want, have)
+		}
+	}
+}
+
+func mustHold(t *testing.T, gate command.Service, ctx context.Context) string {
+	_, err := gate.NewCommand(ctx, &mdm.CommandRequest{RequestType: "EraseDevice", UDID: "foo"})
+	pending, ok := err.(PendingError)
+	if !ok {
+		t.Fatalf("want PendingError, have %v", err)
+	}
+	return pending.ApprovalID()
+}
+
+func callerContext(caller string) context.Context {
+	return command.NewOriginContext(context.Background(), command.Origin{Caller: caller})
+}
+
+func setupGate(t *testing.T, next command.Service, opts ...Option) *Gate {
+	f, _ := ioutil.TempFile("", "bolt-")
+	f.Close()
+	os.Remove(f.Name())
+
+	db, err := bolt.Open(f.Name(), 0777, nil)
+	if err != nil {
+		t.Fatalf("couldn't open bolt, err %s\n", err)
+	}
+	gate, err := NewGate(db, Policy{RequestTypes: DefaultRequestTypes}, next, opts...)
+	if err != nil {
+		t.Fatalf("couldn't create gate, err %s\n", err)
+	}
+	return gate
+}
@@ -0,0 +1,110 @@
+package approval
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+type Endpoints struct {
+	ListRequestsEndpoint endpoint.Endpoint
+	ApproveEndpoint      endpoint.Endpoint
+	RejectEndpoint       endpoint.Endpoint
+}
+
+// MakeEndpoints creates the endpoints of an approval Service.
+func MakeEndpoints(svc Service) Endpoints {
+	return Endpoints{
+		ListRequestsEndpoint: MakeListRequestsEndpoint(svc),
+		ApproveEndpoint:      MakeApproveEndpoint(svc),
+		RejectEndpoint:       MakeRejectEndpoint(svc),
+	}
+}
+
+// MakeListRequestsEndpoint creates an endpoint which lists approval requests.
+func MakeListRequestsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listRequestsRequest)
+		requests, err := svc.Requests(ctx, req.Status)
+		if requests == nil {
+			requests = []Request{}
+		}
+		return listRequestsResponse{Requests: requests, Err: err}, nil
+	}
+}
+
+// RedactRequests returns a middleware for the list requests endpoint which
+// masks the secret fields of the listed commands. Approvers then see the
+// request type and device, but not passcodes or profile contents.
+func RedactRequests(r *command.Redactor) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			resp, ok := response.(listRequestsResponse)
+			if err != nil || !ok {
+				return response, err
+			}
+			redacted := make([]Request, len(resp.Requests))
+			for i, req := range resp.Requests {
+				req.Command = r.Request(req.Command)
+				redacted[i] = req
+			}
+			resp.Requests = redacted
+			return resp, nil
+		}
+	}
+}
+
+// MakeApproveEndpoint creates an endpoint which approves a pending request.
+func MakeApproveEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(decisionRequest)
+		payload, err := svc.Approve(ctx, req.ID)
+		return approveResponse{Payload: payload, Err: err}, nil
+	}
+}
+
+// MakeRejectEndpoint creates an endpoint which rejects a pending request.
+func MakeRejectEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(decisionRequest)
+		err := svc.Reject(ctx, req.ID, req.Reason)
+		return rejectResponse{Err: err}, nil
+	}
+}
+
+type listRequestsRequest struct {
+	Status Status
+}
+
+type listRequestsResponse struct {
+	Requests []Request `json:"requests"`
+	Err      error     `json:"error,omitempty"`
+}
+
+func (r listRequestsResponse) error() error { return r.Err }
+func (r listRequestsResponse) status() int  { return http.StatusOK }
+
+type decisionRequest struct {
+	ID     string `json:"-"`
+	Reason string `json:"reason"`
+}
+
+type approveResponse struct {
+	Payload *mdm.Payload `json:"payload,omitempty"`
+	Err     error        `json:"error,omitempty"`
+}
+
+func (r approveResponse) error() error { return r.Err }
+func (r approveResponse) status() int  { return http.StatusCreated }
+
+type rejectResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r rejectResponse) error() error { return r.Err }
+func (r rejectResponse) status() int  { return http.StatusOK }
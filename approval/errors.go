@@ -0,0 +1,40 @@
+package approval
+
+import "errors"
+
+var (
+	// ErrNotFound is returned when there is no request with the ID.
+	ErrNotFound = errors.New("approval request not found")
+
+	// ErrDecided is returned when a request was already approved or rejected.
+	ErrDecided = errors.New("approval request was already decided")
+
+	// ErrSameIdentity is returned when the requester tries to approve or
+	// reject their own request.
+	ErrSameIdentity = errors.New("approval request must be decided by a different identity than the requester")
+
+	// ErrUnauthenticated is returned when the caller making or deciding on
+	// a request which requires approval is not authenticated.
+	ErrUnauthenticated error = unauthenticatedError{}
+)
+
+type unauthenticatedError struct{}
+
+func (unauthenticatedError) Error() string { return "approval requires an authenticated caller" }
+
+// Unauthenticated marks the error as caused by a missing identity, so that
+// the command HTTP transport responds with 401 Unauthorized.
+func (unauthenticatedError) Unauthenticated() bool { return true }
+
+// PendingError is returned by Gate.NewCommand when a request is held for
+// approval. The HTTP transport responds with 202 Accepted and the ID.
+type PendingError struct {
+	ID string
+}
+
+func (e PendingError) Error() string {
+	return "command request " + e.ID + " is pending approval"
+}
+
+// ApprovalID returns the ID of the pending request.
+func (e PendingError) ApprovalID() string { return e.ID }
@@ -0,0 +1,131 @@
+package approval
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// Route names of the approve and reject handlers in command.BodyLimits.
+const (
+	RouteApprove = "Approve"
+	RouteReject  = "Reject"
+)
+
+type HTTPHandlers struct {
+	ListRequestsHandler http.Handler
+	ApproveHandler      http.Handler
+	RejectHandler       http.Handler
+}
+
+// MakeHTTPHandlers returns the HTTP handlers for the approval service.
+// The approve and reject handlers expect the ID of the request in the
+// "id" route variable. The size of their request bodies is restricted by
+// the RouteApprove and RouteReject limits.
+func MakeHTTPHandlers(ctx context.Context, endpoints Endpoints, limits command.BodyLimits, opts ...httptransport.ServerOption) HTTPHandlers {
+	opts = append(append([]httptransport.ServerOption{}, opts...),
+		httptransport.ServerErrorEncoder(EncodeError))
+	h := HTTPHandlers{
+		ListRequestsHandler: httptransport.NewServer(
+			ctx,
+			endpoints.ListRequestsEndpoint,
+			decodeListRequestsRequest,
+			encodeResponse,
+			opts...,
+		),
+		ApproveHandler: httptransport.NewServer(
+			ctx,
+			endpoints.ApproveEndpoint,
+			decodeDecisionRequest(limits, RouteApprove),
+			encodeResponse,
+			opts...,
+		),
+		RejectHandler: httptransport.NewServer(
+			ctx,
+			endpoints.RejectEndpoint,
+			decodeDecisionRequest(limits, RouteReject),
+			encodeResponse,
+			opts...,
+		),
+	}
+	return h
+}
+
+type errorer interface {
+	error() error
+}
+
+type statuser interface {
+	status() int
+}
+
+// EncodeError encodes approval errors with their HTTP status code, and
+// other errors with command.EncodeError.
+func EncodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	cause := err
+	if e, ok := err.(httptransport.Error); ok {
+		cause = e.Err
+	}
+	var code int
+	switch cause {
+	case ErrNotFound:
+		code = http.StatusNotFound
+	case ErrDecided:
+		code = http.StatusConflict
+	case ErrSameIdentity:
+		code = http.StatusForbidden
+	case ErrUnauthenticated:
+		code = http.StatusUnauthorized
+	default:
+		command.EncodeError(ctx, err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{
+		"error": cause.Error(),
+	})
+}
+
+func decodeListRequestsRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return listRequestsRequest{Status: Status(r.URL.Query().Get("status"))}, nil
+}
+
+// decodeDecisionRequest returns a decoder of the request ID from the URL
+// and the optional reason from a JSON body, which rejects bodies larger
+// than the limit of the route.
+func decodeDecisionRequest(limits command.BodyLimits, route string) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		var req decisionRequest
+		err := json.NewDecoder(limits.Reader(route, r.Body)).Decode(&req)
+		if err != nil && err != io.EOF {
+			return req, err
+		}
+		req.ID = mux.Vars(r)["id"]
+		return req, nil
+	}
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		EncodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s, ok := response.(statuser); ok {
+		w.WriteHeader(s.status())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(response)
+}
@@ -0,0 +1,95 @@
+// Package audit reports who requested each archived command, and from where.
+package audit
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// DefaultLimit is the number of events returned when a Filter has no Limit.
+const DefaultLimit = 100
+
+// Service lists archived command events.
+type Service interface {
+	// Events returns the archived events which match the filter,
+	// newest first.
+	Events(context.Context, Filter) ([]command.Event, error)
+}
+
+// Filter selects archived events. Empty fields match every event.
+type Filter struct {
+	Caller       string
+	UDID         string
+	RequestID    string
+	RequestTypes []string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+}
+
+// Match reports whether the event matches all fields of the filter.
+func (f Filter) Match(e *command.Event) bool {
+	if f.Caller != "" && f.Caller != e.Origin.Caller {
+		return false
+	}
+	if f.UDID != "" && f.UDID != e.UDID {
+		return false
+	}
+	if f.RequestID != "" && f.RequestID != e.Origin.RequestID {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	if len(f.RequestTypes) == 0 {
+		return true
+	}
+	for _, t := range f.RequestTypes {
+		if e.Payload.Command != nil && e.Payload.Command.RequestType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Record is the audit view of an archived event. It does not include the
+// content of the command.
+type Record struct {
+	EventID           string    `json:"event_id"`
+	Time              time.Time `json:"time"`
+	CommandUUID       string    `json:"command_uuid"`
+	RequestType       string    `json:"request_type"`
+	UDID              string    `json:"udid,omitempty"`
+	Caller            string    `json:"caller,omitempty"`
+	SourceIP          string    `json:"source_ip,omitempty"`
+	UserAgent         string    `json:"user_agent,omitempty"`
+	RequestID         string    `json:"request_id,omitempty"`
+	Approver          string    `json:"approver,omitempty"`
+	ProfileIdentifier string    `json:"profile_identifier,omitempty"`
+}
+
+// NewRecord creates the audit Record of an event.
+func NewRecord(e *command.Event) Record {
+	r := Record{
+		EventID:           e.ID,
+		Time:              e.Time,
+		CommandUUID:       e.Payload.CommandUUID,
+		UDID:              e.UDID,
+		Caller:            e.Origin.Caller,
+		SourceIP:          e.Origin.SourceIP,
+		UserAgent:         e.Origin.UserAgent,
+		RequestID:         e.Origin.RequestID,
+		Approver:          e.Origin.Approver,
+		ProfileIdentifier: e.ProfileIdentifier,
+	}
+	if e.Payload.Command != nil {
+		r.RequestType = e.Payload.Command.RequestType
+	}
+	return r
+}
@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"golang.org/x/net/context"
+)
+
+type Endpoints struct {
+	ListEventsEndpoint endpoint.Endpoint
+}
+
+// MakeListEventsEndpoint creates an endpoint which lists audit records.
+func MakeListEventsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listEventsRequest)
+		events, err := svc.Events(ctx, req.Filter)
+		if err != nil {
+			return listEventsResponse{Err: err}, nil
+		}
+		records := make([]Record, 0, len(events))
+		for i := range events {
+			records = append(records, NewRecord(&events[i]))
+		}
+		return listEventsResponse{Records: records}, nil
+	}
+}
+
+type listEventsRequest struct {
+	Filter
+}
+
+type listEventsResponse struct {
+	Records []Record `json:"records"`
+	Err     error    `json:"error,omitempty"`
+}
+
+func (r listEventsResponse) error() error { return r.Err }
+func (r listEventsResponse) status() int  { return http.StatusOK }
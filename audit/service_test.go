@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+func TestListEventsHTTP(t *testing.T) {
+	now := time.Now().UTC()
+	events := []command.Event{
+		{
+			ID:      "2",
+			Time:    now,
+			UDID:    "device-2",
+			Payload: mdm.Payload{CommandUUID: "c2", Command: &mdm.Command{RequestType: "EraseDevice"}},
+			Origin:  command.Origin{Caller: "alice", SourceIP: "192.0.2.1", RequestID: "r2"},
+		},
+		{
+			ID:      "1",
+			Time:    now.Add(-time.Hour),
+			UDID:    "device-1",
+			Payload: mdm.Payload{CommandUUID: "c1", Command: &mdm.Command{RequestType: "DeviceInformation"}},
+			Origin:  command.Origin{Caller: "bob", SourceIP: "192.0.2.2", RequestID: "r1"},
+		},
+	}
+	svc := eventsFunc(func(ctx context.Context, f Filter) ([]command.Event, error) {
+		var matched []command.Event
+		for i := range events {
+			if f.Match(&events[i]) && len(matched) < f.Limit {
+				matched = append(matched, events[i])
+			}
+		}
+		return matched, nil
+	})
+	h := MakeHTTPHandlers(
+		context.Background(),
+		Endpoints{ListEventsEndpoint: MakeListEventsEndpoint(svc)},
+		httptransport.ServerErrorEncoder(command.EncodeError),
+	)
+	server := httptest.NewServer(h.ListEventsHandler)
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		query        string
+		expectStatus int
+		expectIDs    []string
+	}{
+		{
+			name:         "all",
+			expectStatus: http.StatusOK,
+			expectIDs:    []string{"2", "1"},
+		},
+		{
+			name:         "caller",
+			query:        "?caller=bob",
+			expectStatus: http.StatusOK,
+			expectIDs:    []string{"1"},
+		},
+		{
+			name:         "request_type",
+			query:        "?request_type=EraseDevice&request_type=DeviceLock",
+			expectStatus: http.StatusOK,
+			expectIDs:    []string{"2"},
+		},
+		{
+			name:         "since",
+			query:        "?since=" + now.Add(-time.Minute).Format(time.RFC3339),
+			expectStatus: http.StatusOK,
+			expectIDs:    []string{"2"},
+		},
+		{
+			name:         "limit",
+			query:        "?limit=1",
+			expectStatus: http.StatusOK,
+			expectIDs:    []string{"2"},
+		},
+		{
+			name:         "bad_since",
+			query:        "?since=yesterday",
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "bad_limit",
+			query:        "?limit=-1",
+			expectStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if want, have := tt.expectStatus, resp.StatusCode; want != have {
+				t.Fatalf("want %d, have %d", want, have)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			var body struct {
+				Records []Record `json:"records"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := len(tt.expectIDs), len(body.Records); want != have {
+				t.Fatalf("want %d records, have %d", want, have)
+			}
+			for i, r := range body.Records {
+				if want, have := tt.expectIDs[i], r.EventID; want != have {
+					t.Errorf("want event %q, have %q", want, have)
+				}
+			}
+		})
+	}
+}
+
+type eventsFunc func(context.Context, Filter) ([]command.Event, error)
+
+func (f eventsFunc) Events(ctx context.Context, filter Filter) ([]command.Event, error) {
+	return f(ctx, filter)
+}
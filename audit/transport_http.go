@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+type HTTPHandlers struct {
+	ListEventsHandler http.Handler
+}
+
+// MakeHTTPHandlers returns the HTTP handlers for the audit service.
+func MakeHTTPHandlers(ctx context.Context, endpoints Endpoints, opts ...httptransport.ServerOption) HTTPHandlers {
+	h := HTTPHandlers{
+		ListEventsHandler: httptransport.NewServer(
+			ctx,
+			endpoints.ListEventsEndpoint,
+			decodeListEventsRequest,
+			encodeResponse,
+			opts...,
+		),
+	}
+	return h
+}
+
+type errorer interface {
+	error() error
+}
+
+type statuser interface {
+	status() int
+}
+
+// badRequestError is returned for malformed query parameters.
+type badRequestError string
+
+func (e badRequestError) Error() string        { return string(e) }
+func (e badRequestError) InvalidRequest() bool { return true }
+
+// decodeListEventsRequest decodes the filter from the query parameters
+// caller, udid, request_id, request_type (which may be repeated),
+// since and until (RFC 3339 timestamps) and limit.
+func decodeListEventsRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := listEventsRequest{Filter{
+		Caller:       q.Get("caller"),
+		UDID:         q.Get("udid"),
+		RequestID:    q.Get("request_id"),
+		RequestTypes: q["request_type"],
+		Limit:        DefaultLimit,
+	}}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if req.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return req, badRequestError(fmt.Sprintf("invalid since parameter: %s", err))
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if req.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return req, badRequestError(fmt.Sprintf("invalid until parameter: %s", err))
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if req.Limit, err = strconv.Atoi(v); err != nil || req.Limit <= 0 {
+			return req, badRequestError(fmt.Sprintf("invalid limit parameter %q", v))
+		}
+	}
+	return req, nil
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		command.EncodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s, ok := response.(statuser); ok {
+		w.WriteHeader(s.status())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(response)
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/approval"
+	"github.com/micromdm/command/queue"
+	"github.com/micromdm/command/service/simple"
+	"github.com/micromdm/command/shutdown"
+	"github.com/micromdm/command/tlsreload"
+)
+
+// envPrefix is the prefix of the environment variables which override the
+// configuration file. The variable of a flag is named after the flag, ex:
+// COMMANDSVC_HTTP_ADDR overrides -http.addr.
+const envPrefix = "COMMANDSVC_"
+
+// NSQ backends.
+const (
+	backendEmbedded = "embedded"
+	backendExternal = "external"
+)
+
+// Client certificate authentication modes.
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// secretFlags are the settings which are redacted from the effective
+// configuration.
+var secretFlags = map[string]bool{
+	"webhook.secret": true,
+}
+
+var metricsNamespace = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// config is the configuration of commandsvc.
+//
+// The configuration is read from a YAML or TOML file, then overridden by
+// the environment, then by the flags which are set on the command line.
+type config struct {
+	Storage struct {
+		Path string `yaml:"path" toml:"path"`
+	} `yaml:"storage" toml:"storage"`
+
+	HTTP struct {
+		Addr            string `yaml:"addr" toml:"addr"`
+		MaxBodySize     int64  `yaml:"max_body_size" toml:"max_body_size"`
+		MaxProfileSize  int64  `yaml:"max_profile_size" toml:"max_profile_size"`
+		RedactResponses bool   `yaml:"redact_responses" toml:"redact_responses"`
+
+		// RouteBodySizes overrides MaxBodySize for the named routes,
+		// NewCommand, Approve and Reject.
+		RouteBodySizes map[string]int64 `yaml:"route_body_sizes" toml:"route_body_sizes"`
+	} `yaml:"http" toml:"http"`
+
+	TLS struct {
+		Cert string `yaml:"cert" toml:"cert"`
+		Key  string `yaml:"key" toml:"key"`
+
+		// ClientAuth is none, optional or require. Client certificates
+		// are verified with the authorities in ClientCA, and the identity
+		// of a caller is looked up by subject in ClientIdentities, or is
+		// the common name of the subject.
+		ClientAuth       string `yaml:"client_auth" toml:"client_auth"`
+		ClientCA         string `yaml:"client_ca" toml:"client_ca"`
+		ClientIdentities string `yaml:"client_identities" toml:"client_identities"`
+
+		// ReloadInterval is the interval between checks of the
+		// certificate files for changes.
+		ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+	} `yaml:"tls" toml:"tls"`
+
+	NSQ struct {
+		// Backend is external to publish to NSQDAddrs and the nsqd
+		// instances known to LookupdAddrs, or embedded to publish to an
+		// nsqd started in-process on TCPAddr.
+		Backend      string   `yaml:"backend" toml:"backend"`
+		TCPAddr      string   `yaml:"tcp_addr" toml:"tcp_addr"`
+		NSQDAddrs    []string `yaml:"nsqd_addrs" toml:"nsqd_addrs"`
+		LookupdAddrs []string `yaml:"lookupd_addrs" toml:"lookupd_addrs"`
+
+		// Routes publish events to more topics than mdm.Command, and
+		// Groups are the named sets of UDIDs routes can match. They have
+		// no flags, and can only be set in the configuration file.
+		Routes []routeConfig       `yaml:"routes" toml:"routes"`
+		Groups map[string][]string `yaml:"groups" toml:"groups"`
+	} `yaml:"nsq" toml:"nsq"`
+
+	Auth struct {
+		BasicUsers string `yaml:"basic_users" toml:"basic_users"`
+	} `yaml:"auth" toml:"auth"`
+
+	Approval struct {
+		RequestTypes []string `yaml:"request_types" toml:"request_types"`
+	} `yaml:"approval" toml:"approval"`
+
+	Profile struct {
+		SignCert      string `yaml:"sign_cert" toml:"sign_cert"`
+		SignKey       string `yaml:"sign_key" toml:"sign_key"`
+		RequireSigned bool   `yaml:"require_signed" toml:"require_signed"`
+	} `yaml:"profile" toml:"profile"`
+
+	Webhook struct {
+		URLs   []string `yaml:"urls" toml:"urls"`
+		Secret string   `yaml:"secret" toml:"secret"`
+		Source string   `yaml:"source" toml:"source"`
+
+		// Retention is the age after which deliveries are deleted.
+		// Deliveries are kept forever if Retention is 0.
+		Retention time.Duration `yaml:"retention" toml:"retention"`
+	} `yaml:"webhook" toml:"webhook"`
+
+	Archive struct {
+		Keys  string `yaml:"keys" toml:"keys"`
+		KeyID string `yaml:"key_id" toml:"key_id"`
+
+		// Retention is the age after which archived events are deleted.
+		// Events are kept forever if Retention is 0.
+		Retention time.Duration `yaml:"retention" toml:"retention"`
+	} `yaml:"archive" toml:"archive"`
+
+	// Batch groups concurrent commands into one archive transaction and
+	// one NSQ publish per topic. Batching is disabled if Size is 0.
+	Batch struct {
+		Size  int           `yaml:"size" toml:"size"`
+		Delay time.Duration `yaml:"delay" toml:"delay"`
+	} `yaml:"batch" toml:"batch"`
+
+	Queue struct {
+		// DependencyTimeout is the time a queued command waits for a
+		// dependency which was never enqueued, before it fails.
+		DependencyTimeout time.Duration `yaml:"dependency_timeout" toml:"dependency_timeout"`
+	} `yaml:"queue" toml:"queue"`
+
+	Metrics struct {
+		Namespace string `yaml:"namespace" toml:"namespace"`
+	} `yaml:"metrics" toml:"metrics"`
+
+	Trace struct {
+		Exporter     string  `yaml:"exporter" toml:"exporter"`
+		OTLPEndpoint string  `yaml:"otlp_endpoint" toml:"otlp_endpoint"`
+		OTLPInsecure bool    `yaml:"otlp_insecure" toml:"otlp_insecure"`
+		SampleRatio  float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+	} `yaml:"trace" toml:"trace"`
+
+	Shutdown struct {
+		Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	} `yaml:"shutdown" toml:"shutdown"`
+
+	path string // of the configuration file
+}
+
+// routeConfig is a simple.Route.
+type routeConfig struct {
+	Topic        string   `yaml:"topic" toml:"topic"`
+	RequestTypes []string `yaml:"request_types,omitempty" toml:"request_types"`
+	UDIDPrefix   string   `yaml:"udid_prefix,omitempty" toml:"udid_prefix"`
+	Group        string   `yaml:"group,omitempty" toml:"group"`
+}
+
+func defaultConfig() *config {
+	c := new(config)
+	c.Storage.Path = "mdm_commands.bolt"
+	c.HTTP.Addr = "0.0.0.0:8080"
+	c.HTTP.MaxBodySize = command.DefaultMaxBodySize
+	c.HTTP.MaxProfileSize = 5 << 20
+	c.TLS.ClientAuth = clientAuthNone
+	c.TLS.ReloadInterval = tlsreload.DefaultInterval
+	c.NSQ.Backend = backendExternal
+	c.NSQ.TCPAddr = "0.0.0.0:4150"
+	c.Webhook.Source = "inprocess"
+	c.Webhook.Retention = 7 * 24 * time.Hour
+	c.Batch.Delay = simple.DefaultBatchDelay
+	c.Queue.DependencyTimeout = queue.DefaultDependencyTimeout
+	c.Metrics.Namespace = "commandsvc"
+	c.Trace.Exporter = "none"
+	c.Trace.SampleRatio = 1
+	c.Shutdown.Timeout = shutdown.DefaultTimeout
+	return c
+}
+
+// register defines a flag for every setting of c. The defaults of the
+// flags are the current values of c.
+func (c *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Storage.Path, "storage.path", c.Storage.Path, "Path to the BoltDB database")
+	fs.StringVar(&c.HTTP.Addr, "http.addr", c.HTTP.Addr, "HTTP listen address")
+	fs.Int64Var(&c.HTTP.MaxBodySize, "http.max-body-size", c.HTTP.MaxBodySize, "Maximum size in bytes of a command request body")
+	fs.Int64Var(&c.HTTP.MaxProfileSize, "http.max-profile-size", c.HTTP.MaxProfileSize, "Maximum size in bytes of an InstallProfile request body")
+	fs.Var((*sizeMap)(&c.HTTP.RouteBodySizes), "http.route-body-sizes", "Comma separated route=bytes overrides of http.max-body-size, ex: Approve=1000,Reject=1000")
+	fs.BoolVar(&c.HTTP.RedactResponses, "http.redact-responses", c.HTTP.RedactResponses, "Mask passcodes, unlock tokens and profile contents in GET responses")
+	fs.StringVar(&c.TLS.Cert, "tls.cert", c.TLS.Cert, "Path to the PEM certificate of the HTTPS server, HTTP is served if empty")
+	fs.StringVar(&c.TLS.Key, "tls.key", c.TLS.Key, "Path to the PEM private key of the HTTPS server")
+	fs.StringVar(&c.TLS.ClientAuth, "tls.client-auth", c.TLS.ClientAuth, "Client certificate authentication: none, optional or require")
+	fs.StringVar(&c.TLS.ClientCA, "tls.client-ca", c.TLS.ClientCA, "Path to the PEM certificates of the authorities which issue client certificates")
+	fs.StringVar(&c.TLS.ClientIdentities, "tls.client-identities", c.TLS.ClientIdentities, "Path to a file of identity:subject lines, the subject common name is the identity if empty")
+	fs.DurationVar(&c.TLS.ReloadInterval, "tls.reload-interval", c.TLS.ReloadInterval, "Interval between checks of the certificate files for changes")
+	fs.StringVar(&c.NSQ.Backend, "nsq.backend", c.NSQ.Backend, "Where events are published, external nsqd instances or embedded to start nsqd in-process")
+	fs.StringVar(&c.NSQ.TCPAddr, "nsqd.tcp.addr", c.NSQ.TCPAddr, "NSQD tcp.listen address of the embedded nsqd")
+	fs.Var((*stringList)(&c.NSQ.NSQDAddrs), "nsq.nsqd-addrs", "Comma separated TCP addresses of the external nsqd instances")
+	fs.Var((*stringList)(&c.NSQ.LookupdAddrs), "nsq.lookupd-addrs", "Comma separated HTTP addresses of the nsqlookupd instances which discover external nsqd instances")
+	fs.StringVar(&c.Auth.BasicUsers, "auth.basic-users", c.Auth.BasicUsers, "Path to a file of user:password lines for HTTP Basic authentication")
+	fs.Var((*stringList)(&c.Approval.RequestTypes), "approval.request-types", "Comma separated request types which require two-person approval, ex: "+strings.Join(approval.DefaultRequestTypes, ","))
+	fs.StringVar(&c.Profile.SignCert, "profile.sign.cert", c.Profile.SignCert, "Path to a PEM certificate used to sign unsigned profiles")
+	fs.StringVar(&c.Profile.SignKey, "profile.sign.key", c.Profile.SignKey, "Path to the PEM private key of the profile signing certificate")
+	fs.BoolVar(&c.Profile.RequireSigned, "profile.require-signed", c.Profile.RequireSigned, "Reject InstallProfile requests with unsigned profiles")
+	fs.Var((*stringList)(&c.Webhook.URLs), "webhook.urls", "Comma separated URLs which are notified about new commands")
+	fs.StringVar(&c.Webhook.Secret, "webhook.secret", c.Webhook.Secret, "Secret used to sign webhook requests with HMAC-SHA256")
+	fs.StringVar(&c.Webhook.Source, "webhook.source", c.Webhook.Source, "Where webhooks receive events from, inprocess or nsq")
+	fs.DurationVar(&c.Webhook.Retention, "webhook.retention", c.Webhook.Retention, "Age after which webhook deliveries are deleted, 0 keeps them forever")
+	fs.StringVar(&c.Archive.Keys, "archive.keys", c.Archive.Keys, "Path to a file of id:base64-key lines used to encrypt archived events")
+	fs.StringVar(&c.Archive.KeyID, "archive.key-id", c.Archive.KeyID, "ID of the key new archived events are encrypted with")
+	fs.DurationVar(&c.Archive.Retention, "archive.retention", c.Archive.Retention, "Age after which archived events are deleted, 0 keeps them forever")
+	fs.IntVar(&c.Batch.Size, "batch.size", c.Batch.Size, "Maximum number of concurrent commands archived and published together, 0 disables batching")
+	fs.DurationVar(&c.Batch.Delay, "batch.delay", c.Batch.Delay, "Longest time a command waits for its batch to fill")
+	fs.DurationVar(&c.Queue.DependencyTimeout, "queue.dependency-timeout", c.Queue.DependencyTimeout, "Time a queued command waits for a dependency which was never enqueued before it fails, 0 waits forever")
+	fs.StringVar(&c.Metrics.Namespace, "metrics.namespace", c.Metrics.Namespace, "Namespace of the Prometheus metrics")
+	fs.StringVar(&c.Trace.Exporter, "trace.exporter", c.Trace.Exporter, "OpenTelemetry trace exporter: none, stdout or otlp")
+	fs.StringVar(&c.Trace.OTLPEndpoint, "trace.otlp.endpoint", c.Trace.OTLPEndpoint, "host:port of the OTLP/HTTP trace collector, defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	fs.BoolVar(&c.Trace.OTLPInsecure, "trace.otlp.insecure", c.Trace.OTLPInsecure, "Send spans to the OTLP/HTTP trace collector over plain HTTP instead of HTTPS")
+	fs.Float64Var(&c.Trace.SampleRatio, "trace.sample-ratio", c.Trace.SampleRatio, "Fraction of new traces which are sampled")
+	fs.DurationVar(&c.Shutdown.Timeout, "shutdown.timeout", c.Shutdown.Timeout, "Time to drain requests and stop all components on SIGINT or SIGTERM")
+}
+
+// loadConfig parses the flags in args and returns the validated
+// configuration. The -config flag, or the COMMANDSVC_CONFIG environment
+// variable, is the path of the configuration file.
+func loadConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	c, err := parseConfig(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	return c, c.validate()
+}
+
+// parseConfig is loadConfig without the validation of the settings, for
+// the subcommands which only use some of them.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	c := defaultConfig()
+	path := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "Path to a YAML or TOML configuration file")
+	c.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// the file and the environment are read after the flags, because the
+	// file is named by a flag. Set the flags of the command line again
+	// afterwards, so that they take precedence.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+
+	c.path = *path
+	if c.path != "" {
+		if err := c.readFile(c.path); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if e := f.Value.Set(v); e != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", v, envName(f.Name), e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range set {
+		if err := fs.Set(name, v); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// envName returns the name of the environment variable of a flag.
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flag))
+}
+
+// readFile reads the settings in a YAML or TOML file into c, depending on
+// the extension of the file. Settings which are not in the file keep their
+// value, and unknown settings are an error.
+func (c *config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return fmt.Errorf("read %s: %s", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("read %s: %s", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("read %s: unknown settings %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("read %s: unknown config file extension %q, want .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// configError lists the invalid settings of a configuration.
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+// validate checks every setting, and that the files it names can be read.
+func (c *config) validate() error {
+	var errs configError
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	together := func(a, b, nameA, nameB string) {
+		if (a == "") != (b == "") {
+			invalid("%s and %s must be set together", nameA, nameB)
+		}
+	}
+	readable := func(path, name string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			invalid("%s: %s", name, err)
+		}
+	}
+
+	if c.Storage.Path == "" {
+		invalid("storage.path is required")
+	}
+	if c.HTTP.Addr == "" {
+		invalid("http.addr is required")
+	}
+	if c.HTTP.MaxBodySize <= 0 {
+		invalid("http.max-body-size must be positive")
+	}
+	if c.HTTP.MaxProfileSize <= 0 {
+		invalid("http.max-profile-size must be positive")
+	}
+	for route, size := range c.HTTP.RouteBodySizes {
+		switch route {
+		case command.RouteNewCommand, approval.RouteApprove, approval.RouteReject:
+		default:
+			invalid("http.route-body-sizes: unknown route %q", route)
+		}
+		if size <= 0 {
+			invalid("http.route-body-sizes: %s must be positive", route)
+		}
+	}
+
+	together(c.TLS.Cert, c.TLS.Key, "tls.cert", "tls.key")
+	if c.TLS.Cert != "" && c.TLS.Key != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key); err != nil {
+			invalid("tls.cert: %s", err)
+		}
+	}
+	switch c.TLS.ClientAuth {
+	case clientAuthNone:
+	case clientAuthOptional, clientAuthRequire:
+		if c.TLS.Cert == "" {
+			invalid("tls.client-auth requires tls.cert")
+		}
+		if c.TLS.ClientCA == "" {
+			invalid("tls.client-auth requires tls.client-ca")
+		}
+	default:
+		invalid("unknown tls.client-auth %q, want none, optional or require", c.TLS.ClientAuth)
+	}
+	readable(c.TLS.ClientCA, "tls.client-ca")
+	readable(c.TLS.ClientIdentities, "tls.client-identities")
+	if c.TLS.ReloadInterval <= 0 {
+		invalid("tls.reload-interval must be positive")
+	}
+
+	switch c.NSQ.Backend {
+	case backendEmbedded:
+		if c.NSQ.TCPAddr == "" {
+			invalid("nsqd.tcp.addr is required with the embedded nsq.backend")
+		}
+		if len(c.NSQ.NSQDAddrs) > 0 || len(c.NSQ.LookupdAddrs) > 0 {
+			invalid("nsq.nsqd-addrs and nsq.lookupd-addrs require the external nsq.backend")
+		}
+	case backendExternal:
+		if len(c.NSQ.NSQDAddrs) == 0 && len(c.NSQ.LookupdAddrs) == 0 {
+			invalid("nsq.nsqd-addrs or nsq.lookupd-addrs is required with the external nsq.backend, or set nsq.backend to embedded")
+		}
+	default:
+		invalid("unknown nsq.backend %q, want embedded or external", c.NSQ.Backend)
+	}
+
+	if err := c.routing().Validate(); err != nil {
+		invalid("nsq.routes: %s", err)
+	}
+
+	readable(c.Auth.BasicUsers, "auth.basic-users")
+	for _, requestType := range c.Approval.RequestTypes {
+		if requestType == "" {
+			invalid("approval.request-types must not contain empty request types")
+		}
+	}
+	// approvers are told apart from requesters by their identity.
+	if len(c.Approval.RequestTypes) > 0 && c.Auth.BasicUsers == "" && c.clientAuth() == tls.NoClientCert {
+		invalid("approval.request-types requires auth.basic-users or tls.client-auth")
+	}
+
+	together(c.Profile.SignCert, c.Profile.SignKey, "profile.sign.cert", "profile.sign.key")
+	readable(c.Profile.SignCert, "profile.sign.cert")
+	readable(c.Profile.SignKey, "profile.sign.key")
+
+	for _, raw := range c.Webhook.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("webhook.urls: %q is not an http or https URL", raw)
+		}
+	}
+	if len(c.Webhook.URLs) > 0 && c.Webhook.Secret == "" {
+		invalid("webhook.urls requires webhook.secret")
+	}
+	if c.Webhook.Retention < 0 {
+		invalid("webhook.retention must not be negative")
+	}
+	if c.Webhook.Source != "inprocess" && c.Webhook.Source != "nsq" {
+		invalid("unknown webhook.source %q, want inprocess or nsq", c.Webhook.Source)
+	}
+
+	together(c.Archive.Keys, c.Archive.KeyID, "archive.keys", "archive.key-id")
+	readable(c.Archive.Keys, "archive.keys")
+	if c.Archive.Retention < 0 {
+		invalid("archive.retention must not be negative")
+	}
+
+	if c.Batch.Size < 0 {
+		invalid("batch.size must not be negative")
+	}
+	if c.Batch.Size > 0 && c.Batch.Delay <= 0 {
+		invalid("batch.delay must be positive")
+	}
+	if c.Queue.DependencyTimeout < 0 {
+		invalid("queue.dependency-timeout must not be negative")
+	}
+
+	if !metricsNamespace.MatchString(c.Metrics.Namespace) {
+		invalid("metrics.namespace %q is not a valid Prometheus name", c.Metrics.Namespace)
+	}
+
+	switch c.Trace.Exporter {
+	case "", "none", "stdout", "otlp":
+	default:
+		invalid("unknown trace.exporter %q, want none, stdout or otlp", c.Trace.Exporter)
+	}
+	if c.Trace.SampleRatio < 0 || c.Trace.SampleRatio > 1 {
+		invalid("trace.sample-ratio must be between 0 and 1")
+	}
+
+	if c.Shutdown.Timeout <= 0 {
+		invalid("shutdown.timeout must be positive")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// redacted returns a copy of c without secrets.
+func (c *config) redacted() *config {
+	r := *c
+	if r.Webhook.Secret != "" {
+		r.Webhook.Secret = command.Redacted
+	}
+	return &r
+}
+
+// keyvals returns the effective configuration as log keyvals, named after
+// the flags, without secrets.
+func (c *config) keyvals() []interface{} {
+	keyvals := []interface{}{"config", c.path}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.register(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = command.Redacted
+		}
+		keyvals = append(keyvals, f.Name, v)
+	})
+	var routes []string
+	for _, route := range c.NSQ.Routes {
+		routes = append(routes, fmt.Sprintf("%+v", route))
+	}
+	var groups []string
+	for name, udids := range c.NSQ.Groups {
+		groups = append(groups, fmt.Sprintf("%s(%d)", name, len(udids)))
+	}
+	sort.Strings(groups)
+	return append(keyvals, "nsq.routes", strings.Join(routes, ","), "nsq.groups", strings.Join(groups, ","))
+}
+
+// dump returns the effective configuration in YAML, without secrets. The
+// dump can be used as a configuration file.
+func (c *config) dump() ([]byte, error) {
+	return yaml.Marshal(c.redacted())
+}
+
+// routing returns the topic routing of the NSQ routes and groups.
+func (c *config) routing() simple.Routing {
+	routing := simple.Routing{Groups: c.NSQ.Groups}
+	for _, route := range c.NSQ.Routes {
+		routing.Routes = append(routing.Routes, simple.Route{
+			Topic:        route.Topic,
+			RequestTypes: route.RequestTypes,
+			UDIDPrefix:   route.UDIDPrefix,
+			Group:        route.Group,
+		})
+	}
+	return routing
+}
+
+// clientAuth returns the tls.ClientAuthType of the tls.client-auth mode.
+func (c *config) clientAuth() tls.ClientAuthType {
+	switch c.TLS.ClientAuth {
+	case clientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// nsqdAddrs returns the TCP addresses of the nsqd instances events are
+// published to and consumed from, in addition to the instances known to
+// nsq.lookupd-addrs.
+func (c *config) nsqdAddrs() []string {
+	if c.NSQ.Backend == backendExternal {
+		return c.NSQ.NSQDAddrs
+	}
+	return []string{c.NSQ.TCPAddr}
+}
+
+// override sets the database and the archive keys of the migrate and rekey
+// subcommands, which take precedence over the configuration if they are
+// not empty.
+func (c *config) override(dbPath, keys, keyID string) {
+	if dbPath != "" {
+		c.Storage.Path = dbPath
+	}
+	if keys != "" {
+		c.Archive.Keys = keys
+	}
+	if keyID != "" {
+		c.Archive.KeyID = keyID
+	}
+}
+
+// sizeMap is a flag.Value of comma separated name=bytes pairs.
+type sizeMap map[string]int64
+
+func (m *sizeMap) String() string {
+	if m == nil {
+		return ""
+	}
+	var pairs []string
+	for name, size := range *m {
+		pairs = append(pairs, name+"="+strconv.FormatInt(size, 10))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *sizeMap) Set(s string) error {
+	sizes := make(map[string]int64)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return fmt.Errorf("%q is not name=bytes", pair)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(pair[i+1:]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not name=bytes", pair)
+		}
+		sizes[strings.TrimSpace(pair[:i])] = size
+	}
+	*m = sizes
+	return nil
+}
+
+// stringList is a flag.Value of comma separated strings.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/command/service/simple"
+)
+
+func TestLoadConfig_defaults(t *testing.T) {
+	if _, err := loadConfig(newFlagSet(), nil); err == nil {
+		t.Fatal("want error without nsqd addresses")
+	}
+
+	cfg, err := loadConfig(newFlagSet(), []string{"-nsq.nsqd-addrs", "nsqd-1:4150,nsqd-2:4150"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.NSQ.NSQDAddrs = []string{"nsqd-1:4150", "nsqd-2:4150"}
+	if have := cfg; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+	if want, have := []string{"nsqd-1:4150", "nsqd-2:4150"}, cfg.nsqdAddrs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want nsqd addrs %v, have %v", want, have)
+	}
+
+	cfg, err = loadConfig(newFlagSet(), []string{"-nsq.backend", "embedded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"0.0.0.0:4150"}, cfg.nsqdAddrs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want nsqd addrs %v, have %v", want, have)
+	}
+}
+
+func TestLoadConfig_precedence(t *testing.T) {
+	files := map[string]string{
+		"commandsvc.yaml": `
+storage:
+  path: file.bolt
+http:
+  addr: 127.0.0.1:1000
+  max_body_size: 2000
+  route_body_sizes: {Approve: 1000}
+webhook:
+  urls: [https://example.com/a, https://example.com/b]
+  secret: hunter2
+archive:
+  retention: 720h
+`,
+		"commandsvc.toml": `
+[storage]
+path = "file.bolt"
+
+[http]
+addr = "127.0.0.1:1000"
+max_body_size = 2000
+route_body_sizes = { Approve = 1000 }
+
+[webhook]
+urls = ["https://example.com/a", "https://example.com/b"]
+secret = "hunter2"
+
+[archive]
+retention = "720h"
+`,
+	}
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := writeFile(t, name, contents)
+			t.Setenv("COMMANDSVC_NSQ_BACKEND", "embedded")
+			t.Setenv("COMMANDSVC_HTTP_ADDR", "127.0.0.1:2000")
+			t.Setenv("COMMANDSVC_METRICS_NAMESPACE", "env")
+
+			cfg, err := loadConfig(newFlagSet(), []string{"-config", path, "-metrics.namespace", "flag"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := "file.bolt", cfg.Storage.Path; want != have {
+				t.Errorf("want storage.path from the file %q, have %q", want, have)
+			}
+			if want, have := int64(2000), cfg.HTTP.MaxBodySize; want != have {
+				t.Errorf("want http.max-body-size from the file %d, have %d", want, have)
+			}
+			if want, have := map[string]int64{"Approve": 1000}, cfg.HTTP.RouteBodySizes; !reflect.DeepEqual(want, have) {
+				t.Errorf("want http.route-body-sizes from the file %v, have %v", want, have)
+			}
+			if want, have := 720*time.Hour, cfg.Archive.Retention; want != have {
+				t.Errorf("want archive.retention from the file %s, have %s", want, have)
+			}
+			if want, have := []string{"https://example.com/a", "https://example.com/b"}, cfg.Webhook.URLs; !reflect.DeepEqual(want, have) {
+				t.Errorf("want webhook.urls from the file %v, have %v", want, have)
+			}
+			if want, have := "127.0.0.1:2000", cfg.HTTP.Addr; want != have {
+				t.Errorf("want http.addr from the environment %q, have %q", want, have)
+			}
+			if want, have := "flag", cfg.Metrics.Namespace; want != have {
+				t.Errorf("want metrics.namespace from the flag %q, have %q", want, have)
+			}
+			if want, have := defaultConfig().Webhook.Source, cfg.Webhook.Source; want != have {
+				t.Errorf("want default webhook.source %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestParseConfig_subcommand(t *testing.T) {
+	path := writeFile(t, "commandsvc.yaml", `
+storage:
+  path: file.bolt
+archive:
+  keys: file.keys
+`)
+	t.Setenv("COMMANDSVC_ARCHIVE_KEY_ID", "env")
+
+	subcommand := func() (fs *flag.FlagSet, db, keyID *string) {
+		fs = newFlagSet()
+		return fs, fs.String("db", "", ""), fs.String("key-id", "", "")
+	}
+
+	// the settings of the server are used without the nsqd addresses the
+	// server requires.
+	fs, db, keyID := subcommand()
+	cfg, err := parseConfig(fs, []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.override(*db, "", *keyID)
+	if want, have := "file.bolt", cfg.Storage.Path; want != have {
+		t.Errorf("want storage.path from the file %q, have %q", want, have)
+	}
+	if want, have := "file.keys", cfg.Archive.Keys; want != have {
+		t.Errorf("want archive.keys from the file %q, have %q", want, have)
+	}
+	if want, have := "env", cfg.Archive.KeyID; want != have {
+		t.Errorf("want archive.key-id from the environment %q, have %q", want, have)
+	}
+
+	// the flags of the subcommand take precedence.
+	fs, db, keyID = subcommand()
+	cfg, err = parseConfig(fs, []string{"-config", path, "-db", "flag.bolt", "-key-id", "flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.override(*db, "", *keyID)
+	if want, have := "flag.bolt", cfg.Storage.Path; want != have {
+		t.Errorf("want the -db flag %q, have %q", want, have)
+	}
+	if want, have := "flag", cfg.Archive.KeyID; want != have {
+		t.Errorf("want the -key-id flag %q, have %q", want, have)
+	}
+}
+
+func TestLoadConfig_routes(t *testing.T) {
+	files := map[string]string{
+		"commandsvc.yaml": `
+nsq:
+  backend: embedded
+  routes:
+  - topic: mdm.Command.apps
+    request_types: [InstallApplication]
+  - topic: mdm.Command.kiosk
+    group: kiosks
+  groups:
+    kiosks: [kiosk-1, kiosk-2]
+`,
+		"commandsvc.toml": `
+[nsq]
+backend = "embedded"
+
+[[nsq.routes]]
+topic = "mdm.Command.apps"
+request_types = ["InstallApplication"]
+
+[[nsq.routes]]
+topic = "mdm.Command.kiosk"
+group = "kiosks"
+
+[nsq.groups]
+kiosks = ["kiosk-1", "kiosk-2"]
+`,
+	}
+	want := simple.Routing{
+		Routes: []simple.Route{
+			{Topic: "mdm.Command.apps", RequestTypes: []string{"InstallApplication"}},
+			{Topic: "mdm.Command.kiosk", Group: "kiosks"},
+		},
+		Groups: map[string][]string{"kiosks": {"kiosk-1", "kiosk-2"}},
+	}
+	for name, contents := range files {
+		cfg, err := loadConfig(newFlagSet(), []string{"-config", writeFile(t, name, contents)})
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if have := cfg.routing(); !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want routing %+v, have %+v", name, want, have)
+		}
+	}
+
+	path := writeFile(t, "commandsvc.yaml", "nsq:\n  backend: embedded\n  routes:\n  - topic: mdm.Command.lab\n    group: lab\n")
+	if _, err := loadConfig(newFlagSet(), []string{"-config", path}); err == nil || !strings.Contains(err.Error(), "nsq.routes") {
+		t.Errorf("want error about nsq.routes, have %v", err)
+	}
+}
+
+func TestLoadConfig_unknownSettings(t *testing.T) {
+	files := map[string]string{
+		"commandsvc.yaml": "http:\n  adress: 127.0.0.1:1000\n",
+		"commandsvc.toml": "[http]\nadress = \"127.0.0.1:1000\"\n",
+		"commandsvc.json": "{}",
+	}
+	for name, contents := range files {
+		path := writeFile(t, name, contents)
+		if _, err := loadConfig(newFlagSet(), []string{"-config", path}); err == nil {
+			t.Errorf("%s: want error", name)
+		}
+	}
+}
+
+func TestLoadConfig_validate(t *testing.T) {
+	t.Setenv("COMMANDSVC_WEBHOOK_URLS", "ftp://example.com")
+	_, err := loadConfig(newFlagSet(), []string{
+		"-http.max-body-size", "0",
+		"-http.route-body-sizes", "Approve=1000,Unknown=1000",
+		"-tls.cert", "cert.pem",
+		"-tls.client-auth", "require",
+		"-nsq.backend", "external",
+		"-archive.key-id", "2016-11",
+		"-trace.sample-ratio", "2",
+		"-batch.size", "-1",
+	})
+	errs, ok := err.(configError)
+	if !ok {
+		t.Fatalf("want configError, have %v", err)
+	}
+	for _, want := range []string{
+		"http.max-body-size",
+		`unknown route "Unknown"`,
+		"tls.cert and tls.key",
+		"tls.client-auth requires tls.client-ca",
+		"nsq.nsqd-addrs or nsq.lookupd-addrs",
+		"archive.keys and archive.key-id",
+		"trace.sample-ratio",
+		"batch.size",
+		"webhook.urls",
+		"webhook.urls requires webhook.secret",
+	} {
+		if !strings.Contains(errs.Error(), want) {
+			t.Errorf("want error about %s, have %s", want, errs)
+		}
+	}
+
+	_, err = loadConfig(newFlagSet(), []string{
+		"-nsq.backend", "embedded",
+		"-approval.request-types", "EraseDevice",
+	})
+	if err == nil || !strings.Contains(err.Error(), "approval.request-types requires") {
+		t.Errorf("want error about approval without authentication, have %v", err)
+	}
+}
+
+func TestConfig_redacted(t *testing.T) {
+	t.Setenv("COMMANDSVC_NSQ_LOOKUPD_ADDRS", "nsqlookupd:4161")
+	cfg, err := loadConfig(newFlagSet(), []string{"-webhook.secret", "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := cfg.dump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyvals := cfg.keyvals()
+	for _, v := range keyvals {
+		if v == "hunter2" {
+			t.Errorf("secret in keyvals %v", keyvals)
+		}
+	}
+	if strings.Contains(string(dump), "hunter2") {
+		t.Errorf("secret in dump %s", dump)
+	}
+	if want, have := "hunter2", cfg.Webhook.Secret; want != have {
+		t.Errorf("want secret %q kept in the configuration, have %q", want, have)
+	}
+
+	// the dump is a valid configuration file.
+	path := writeFile(t, "dump.yaml", string(dump))
+	if _, err := loadConfig(newFlagSet(), []string{"-config", path}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("commandsvc", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+func writeFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
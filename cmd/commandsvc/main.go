@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/go-kit/kit/endpoint"
@@ -17,18 +20,47 @@ import (
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"github.com/micromdm/command"
+	"github.com/micromdm/command/approval"
+	"github.com/micromdm/command/audit"
+	"github.com/micromdm/command/consumer"
+	"github.com/micromdm/command/envelope"
+	"github.com/micromdm/command/health"
+	"github.com/micromdm/command/profile"
+	"github.com/micromdm/command/publisher"
+	"github.com/micromdm/command/queue"
 	"github.com/micromdm/command/service/simple"
-	nsq "github.com/nsqio/go-nsq"
+	"github.com/micromdm/command/shutdown"
+	"github.com/micromdm/command/stream"
+	"github.com/micromdm/command/tlsreload"
+	"github.com/micromdm/command/tracing"
+	"github.com/micromdm/command/webhook"
 	"github.com/nsqio/nsq/nsqd"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
-	var (
-		httpAddr    = flag.String("http.addr", "0.0.0.0:8080", "HTTP listen address")
-		nsqdTCPAddr = flag.String("nsqd.tcp.addr", "0.0.0.0:4150", "NSQD tcp.listen address")
-	)
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		os.Exit(runRekey(os.Args[2:]))
+	}
+
+	checkConfig := flag.Bool("config.check", false, "Validate the configuration, print it and exit")
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *checkConfig {
+		dump, err := cfg.dump()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(dump)
+		return
+	}
 
 	var logger log.Logger
 	{
@@ -38,63 +70,164 @@ func main() {
 	}
 
 	logger.Log("msg", "server started")
+	logger.Log(append([]interface{}{"msg", "effective configuration"}, cfg.keyvals()...)...)
 	defer logger.Log("msg", "server stopped")
 
 	ctx := context.Background()
+
+	// components are stopped in the reverse order they are added.
+	shutdowns := shutdown.NewManager(cfg.Shutdown.Timeout, log.NewContext(logger).With("component", "shutdown"))
+
+	tp, shutdownTracing, err := newTracerProvider(cfg.Trace.Exporter, cfg.Trace.OTLPEndpoint, cfg.Trace.OTLPInsecure, cfg.Trace.SampleRatio)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	shutdowns.Add("tracing", shutdownTracing)
+	tracer := tp.Tracer(tracing.TracerName)
+
 	// setup BoltDB
-	db, err := bolt.Open("mdm_commands.bolt", 0666, nil)
+	db, err := bolt.Open(cfg.Storage.Path, 0666, nil)
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
+	shutdowns.Add("bolt", shutdown.ErrFunc(db.Close))
 
 	// setup nsq
-	done := make(chan bool)
-	go func() {
-		opts := nsqd.NewOptions()
-		opts.TCPAddress = *nsqdTCPAddr
-		nsqd := nsqd.New(opts)
-		nsqd.Main()
-
-		// wait until we are told to continue and exit
-		<-done
-		nsqd.Exit()
-	}()
+	if cfg.NSQ.Backend == backendEmbedded {
+		done := make(chan bool)
+		exited := make(chan struct{})
+		go func() {
+			opts := nsqd.NewOptions()
+			opts.TCPAddress = cfg.NSQ.TCPAddr
+			nsqd := nsqd.New(opts)
+			nsqd.Main()
+
+			// wait until we are told to continue and exit
+			<-done
+			nsqd.Exit()
+			close(exited)
+		}()
+		shutdowns.Add("nsqd", shutdown.Func(func() {
+			close(done)
+			<-exited
+		}))
+	}
 
-	cfg := nsq.NewConfig()
-	producer, err := nsq.NewProducer(*nsqdTCPAddr, cfg)
+	producer, err := publisher.New(publisher.Config{
+		NSQDAddrs:    cfg.nsqdAddrs(),
+		LookupdAddrs: cfg.NSQ.LookupdAddrs,
+		Logger:       log.NewContext(logger).With("component", "publisher"),
+	})
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
+	producer.Start()
+	shutdowns.Add("producer", shutdown.Func(producer.Stop))
 	var duration metrics.Histogram
 	{
 		// Transport level metrics.
 		duration = prometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
-			Namespace: "addsvc",
-			Name:      "request_duration_ns",
-			Help:      "Request duration in nanoseconds.",
+			Namespace: cfg.Metrics.Namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Request duration in seconds.",
 		}, []string{"method", "success"})
 	}
-	var payloads metrics.Counter
+	var commands metrics.Counter
+	var commandDuration metrics.Histogram
 	{
 		// Business level metrics.
-		payloads = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
-			Namespace: "commandsvc",
-			Name:      "payloads_created",
-			Help:      "Total count of payloads created by the NewCommand  method.",
+		commands = prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: cfg.Metrics.Namespace,
+			Name:      "commands_total",
+			Help:      "Total count of NewCommand calls by request type and outcome.",
+		}, []string{"request_type", "outcome"})
+		commandDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: cfg.Metrics.Namespace,
+			Name:      "command_duration_seconds",
+			Help:      "Duration of NewCommand calls by request type and outcome.",
+		}, []string{"request_type", "outcome"})
+	}
+	var archiveMetrics simple.Metrics
+	{
+		// Archive and NSQ metrics.
+		archiveMetrics.ArchiveSize = prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: cfg.Metrics.Namespace,
+			Name:      "archive_events",
+			Help:      "Number of archived events.",
 		}, []string{})
+		archiveMetrics.TxDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: cfg.Metrics.Namespace,
+			Name:      "bolt_tx_duration_seconds",
+			Help:      "Duration of BoltDB transactions of the archive by operation.",
+		}, []string{"op"})
+		archiveMetrics.PublishDuration = prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: cfg.Metrics.Namespace,
+			Name:      "publish_duration_seconds",
+			Help:      "Duration of publishing events to NSQ.",
+		}, []string{"success"})
 	}
 
+	var archive *simple.CommandService
+	var gate *approval.Gate
 	var svc command.Service
 	{
-		svc, err = simple.NewService(db, producer)
+		var gateOpts []approval.Option
+		opts := []simple.Option{
+			simple.WithMetrics(archiveMetrics),
+			simple.WithLogger(log.NewContext(logger).With("component", "archive")),
+			simple.WithTracer(tracing.NewServiceTracer(tracer)),
+			simple.WithRouting(cfg.routing()),
+		}
+		if cfg.Archive.Keys != "" {
+			keyring, err := envelope.LoadKeyring(cfg.Archive.Keys, cfg.Archive.KeyID)
+			if err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+			opts = append(opts, simple.WithKeyring(keyring))
+			gateOpts = append(gateOpts, approval.WithKeyring(keyring))
+		}
+		if cfg.Batch.Size > 0 {
+			opts = append(opts, simple.WithBatching(simple.Batching{
+				Size:  cfg.Batch.Size,
+				Delay: cfg.Batch.Delay,
+			}))
+		}
+		archive, err = simple.NewService(db, producer, opts...)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		shutdowns.Add("batching", shutdown.Func(archive.Close))
+		if cfg.Archive.Retention > 0 {
+			startPruning(shutdowns, "retention", archive, cfg.Archive.Retention, log.NewContext(logger).With("component", "retention"))
+		}
+		approvalPolicy := approval.Policy{RequestTypes: cfg.Approval.RequestTypes}
+		gate, err = approval.NewGate(db, approvalPolicy, archive, gateOpts...)
 		if err != nil {
 			logger.Log("err", err)
 			os.Exit(1)
-			svc = command.ServiceLoggingMiddleware(logger)(svc)
-			svc = command.ServiceInstrumentingMiddleware(payloads)(svc)
 		}
+		svc = gate
+		policy := profile.SigningPolicy{Strict: cfg.Profile.RequireSigned}
+		if cfg.Profile.SignCert != "" {
+			policy.Signer, err = profile.LoadSigner(cfg.Profile.SignCert, cfg.Profile.SignKey)
+			if err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+		}
+		svc = profile.SigningMiddleware(policy)(svc)
+		svc = profile.LintMiddleware(logger)(svc)
+		svc = command.ServiceLoggingMiddleware(logger)(svc)
+		svc = command.ServiceInstrumentingMiddleware(commands, commandDuration)(svc)
+		svc = tracing.ServiceMiddleware(tracer)(svc)
+		// approved commands are created through the whole chain, and
+		// passed through by the gate.
+		gate.CreateApproved(svc)
 	}
 
 	var commandEndpoint endpoint.Endpoint
@@ -107,24 +240,231 @@ func main() {
 			newCommandDuration)(commandEndpoint)
 		commandEndpoint = command.EndpointLoggingMiddleware(
 			newCommandLogger)(commandEndpoint)
+		commandEndpoint = tracing.EndpointMiddleware(
+			tracer, "endpoint.NewCommand")(commandEndpoint)
 	}
 
 	endpoints := command.Endpoints{
 		NewCommandEndpoint: commandEndpoint,
 	}
 
+	var auditEndpoint endpoint.Endpoint
+	{
+		auditDuration := duration.With("method", "ListEvents")
+		auditLogger := log.NewContext(logger).With("method", "ListEvents")
+
+		auditEndpoint = audit.MakeListEventsEndpoint(archive)
+		auditEndpoint = command.EndpointInstrumentingMiddleware(
+			auditDuration)(auditEndpoint)
+		auditEndpoint = command.EndpointLoggingMiddleware(
+			auditLogger)(auditEndpoint)
+		auditEndpoint = tracing.EndpointMiddleware(
+			tracer, "endpoint.ListEvents")(auditEndpoint)
+	}
+
+	auditEndpoints := audit.Endpoints{
+		ListEventsEndpoint: auditEndpoint,
+	}
+
+	approvalEndpoints := approval.MakeEndpoints(gate)
+	{
+		if cfg.HTTP.RedactResponses {
+			approvalEndpoints.ListRequestsEndpoint = approval.RedactRequests(command.DefaultRedactor)(approvalEndpoints.ListRequestsEndpoint)
+		}
+		for method, e := range map[string]*endpoint.Endpoint{
+			"ListApprovals": &approvalEndpoints.ListRequestsEndpoint,
+			"Approve":       &approvalEndpoints.ApproveEndpoint,
+			"Reject":        &approvalEndpoints.RejectEndpoint,
+		} {
+			*e = command.EndpointInstrumentingMiddleware(
+				duration.With("method", method))(*e)
+			*e = command.EndpointLoggingMiddleware(
+				log.NewContext(logger).With("method", method))(*e)
+			*e = tracing.EndpointMiddleware(
+				tracer, "endpoint."+method)(*e)
+		}
+	}
+
+	var dispatcher *webhook.Dispatcher
+	{
+		var hooks []webhook.Hook
+		for _, url := range cfg.Webhook.URLs {
+			hooks = append(hooks, webhook.Hook{URL: url, Secret: cfg.Webhook.Secret})
+		}
+		dispatcher, err = webhook.NewDispatcher(db, hooks)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		dispatcher.Logger = log.NewContext(logger).With("component", "webhook")
+		// in-flight deliveries are flushed after the consumers stop.
+		// Pending deliveries stay in the outbox and resume on restart.
+		shutdowns.Add("webhook outbox", shutdown.Func(dispatcher.Stop))
+		switch cfg.Webhook.Source {
+		case "inprocess":
+			archive.Subscribe(dispatcher.Dispatch)
+		case "nsq":
+			c, err := consumer.New(consumer.Config{
+				Topic:   simple.CommandTopic,
+				Channel: "webhook",
+				Logger:  dispatcher.Logger,
+				Tracer:  tracing.NewConsumerTracer(tracer),
+			}, dispatcher)
+			if err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+			if err := connect(c, cfg); err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+			shutdowns.Add("webhook consumer", c.Stop)
+		default:
+			logger.Log("err", fmt.Sprintf("unknown webhook source %q", cfg.Webhook.Source))
+			os.Exit(1)
+		}
+		if err := dispatcher.Start(); err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		if cfg.Webhook.Retention > 0 {
+			startPruning(shutdowns, "webhook retention", dispatcher, cfg.Webhook.Retention, log.NewContext(logger).With("component", "webhook retention"))
+		}
+	}
+	var queueEndpoints queue.Endpoints
+	{
+		q, err := queue.NewQueue(db, log.NewContext(logger).With("component", "queue"))
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		q.DependencyTimeout = cfg.Queue.DependencyTimeout
+		c, err := consumer.New(consumer.Config{
+			Topic:   simple.CommandTopic,
+			Channel: "queue",
+			Logger:  log.NewContext(logger).With("component", "queue"),
+			Tracer:  tracing.NewConsumerTracer(tracer),
+		}, q)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		if err := connect(c, cfg); err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		shutdowns.Add("queue consumer", c.Stop)
+		queueEndpoints = queue.MakeEndpoints(q)
+	}
+
+	broker := stream.NewBroker()
+	archive.Subscribe(broker.Publish)
+	streamHandler := stream.NewHandler(broker, archive)
+	streamHandler.Logger = log.NewContext(logger).With("component", "stream")
+
+	webhookEndpoints := webhook.Endpoints{
+		ListDeliveriesEndpoint: webhook.MakeListDeliveriesEndpoint(dispatcher),
+	}
+
+	var identify command.IdentityFunc
+	{
+		var identities []command.IdentityFunc
+		if cfg.TLS.ClientAuth != clientAuthNone {
+			var subjects map[string]string
+			if cfg.TLS.ClientIdentities != "" {
+				subjects, err = loadSubjects(cfg.TLS.ClientIdentities)
+				if err != nil {
+					logger.Log("err", err)
+					os.Exit(1)
+				}
+			}
+			identities = append(identities, command.ClientCertificate(subjects))
+		}
+		if cfg.Auth.BasicUsers != "" {
+			users, err := loadUsers(cfg.Auth.BasicUsers)
+			if err != nil {
+				logger.Log("err", err)
+				os.Exit(1)
+			}
+			identities = append(identities, command.BasicAuth(users))
+		}
+		if len(identities) > 0 {
+			identify = command.AnyIdentity(identities...)
+		}
+	}
+
 	r := mux.NewRouter()
 	{
 		httpLogger := log.NewContext(logger).With("transport", "http")
 		opts := []httptransport.ServerOption{
 			httptransport.ServerErrorLogger(httpLogger),
 			httptransport.ServerErrorEncoder(command.EncodeError),
+			httptransport.ServerBefore(
+				command.OriginRequestFunc(identify),
+				command.CorrelationRequestFunc,
+				tracing.RequestFunc,
+			),
+			httptransport.ServerAfter(
+				command.SetRequestIDHeader,
+				command.SetCorrelationIDHeader,
+			),
+		}
+		limits := command.BodyLimits{
+			MaxBodySize: cfg.HTTP.MaxBodySize,
+			Routes:      cfg.HTTP.RouteBodySizes,
+			RequestTypes: map[string]int64{
+				"InstallProfile": cfg.HTTP.MaxProfileSize,
+			},
 		}
-		handlers := command.MakeHTTPHandlers(ctx, endpoints, opts...)
-		r.Handle("/v1/commands", handlers.NewCommandHandler).Methods("POST")
+		handlers := command.MakeHTTPHandlers(ctx, endpoints, limits, opts...)
+		auditHandlers := audit.MakeHTTPHandlers(ctx, auditEndpoints, opts...)
+		r.Handle("/v1/commands", authenticated(identify, handlers.NewCommandHandler)).Methods("POST")
+		r.Handle("/v1/commands/stream", authenticated(identify, streamHandler)).Methods("GET")
+		r.Handle("/v1/audit", authenticated(identify, auditHandlers.ListEventsHandler)).Methods("GET")
+		approvalHandlers := approval.MakeHTTPHandlers(ctx, approvalEndpoints, limits, opts...)
+		r.Handle("/v1/approvals", authenticated(identify, approvalHandlers.ListRequestsHandler)).Methods("GET")
+		r.Handle("/v1/approvals/{id}/approve", authenticated(identify, approvalHandlers.ApproveHandler)).Methods("POST")
+		r.Handle("/v1/approvals/{id}/reject", authenticated(identify, approvalHandlers.RejectHandler)).Methods("POST")
+		webhookHandlers := webhook.MakeHTTPHandlers(ctx, webhookEndpoints, opts...)
+		r.Handle("/v1/webhooks/deliveries", authenticated(identify, webhookHandlers.ListDeliveriesHandler)).Methods("GET")
+		queueHandlers := queue.MakeHTTPHandlers(ctx, queueEndpoints, opts...)
+		r.Handle("/v1/queue/{udid}/next", authenticated(identify, queueHandlers.NextHandler)).Methods("POST")
+		r.Handle("/v1/queue/{udid}/{uuid}/ack", authenticated(identify, queueHandlers.AckHandler)).Methods("POST")
+		r.Handle("/v1/queue/{udid}/{uuid}/error", authenticated(identify, queueHandlers.FailHandler)).Methods("POST")
+		r.Handle("/v1/queue/{udid}/{uuid}/notnow", authenticated(identify, queueHandlers.NotNowHandler)).Methods("POST")
 		r.Handle("/metrics", stdprometheus.Handler())
+		boltCheck := health.Check{Name: "bolt", Check: health.BoltWritable(db)}
+		nsqdCheck := health.Check{Name: "nsqd", Check: health.NSQPing(producer)}
+		r.Handle("/healthz", health.NewHandler(boltCheck)).Methods("GET")
+		r.Handle("/readyz", health.NewHandler(boltCheck, nsqdCheck)).Methods("GET")
 	}
 
+	srv := &http.Server{
+		Addr:    cfg.HTTP.Addr,
+		Handler: tracing.Handler(tracer, r),
+	}
+	if cfg.TLS.Cert != "" {
+		certs, err := tlsreload.New(tlsreload.Config{
+			CertFile:     cfg.TLS.Cert,
+			KeyFile:      cfg.TLS.Key,
+			ClientCAFile: cfg.TLS.ClientCA,
+			ClientAuth:   cfg.clientAuth(),
+			Interval:     cfg.TLS.ReloadInterval,
+			Logger:       log.NewContext(logger).With("component", "tls"),
+		})
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		certs.Start()
+		shutdowns.Add("tls reload", shutdown.Func(certs.Stop))
+		srv.TLSConfig = certs.TLSConfig()
+	}
+	// event streams never end on their own, end them so that Shutdown
+	// does not wait for the clients to disconnect.
+	srv.RegisterOnShutdown(broker.Close)
+	shutdowns.Add("http", srv.Shutdown)
+
 	errc := make(chan error)
 	go func() {
 		c := make(chan os.Signal, 1)
@@ -133,9 +473,132 @@ func main() {
 	}()
 	go func() {
 		logger := log.NewContext(logger).With("transport", "HTTP")
-		logger.Log("addr", *httpAddr)
-		errc <- http.ListenAndServe(*httpAddr, r)
+		logger.Log("addr", cfg.HTTP.Addr)
+		var err error
+		if srv.TLSConfig != nil {
+			// the certificates are loaded by srv.TLSConfig.
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			errc <- err
+		}
 	}()
 
 	logger.Log("exit", <-errc)
+	if err := shutdowns.Shutdown(ctx); err != nil {
+		logger.Log("err", err)
+	}
+}
+
+// pruneInterval is the interval between deletions of expired records.
+const pruneInterval = time.Hour
+
+// pruner deletes the records created before a time. It is satisfied by a
+// *simple.CommandService and a *webhook.Dispatcher.
+type pruner interface {
+	Prune(ctx context.Context, before time.Time) (int, error)
+}
+
+// startPruning runs prune in the background until shutdown.
+func startPruning(shutdowns *shutdown.Manager, name string, p pruner, retention time.Duration, logger log.Logger) {
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		prune(p, retention, logger, stop)
+	}()
+	shutdowns.Add(name, shutdown.Func(func() {
+		close(stop)
+		<-stopped
+	}))
+}
+
+// prune deletes the records which are older than retention every
+// pruneInterval, until stop is closed.
+func prune(p pruner, retention time.Duration, logger log.Logger, stop <-chan struct{}) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		n, err := p.Prune(context.Background(), time.Now().Add(-retention))
+		logger.Log("msg", "prune", "deleted", n, "err", err)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// connect connects a consumer to the configured nsqd and nsqlookupd
+// instances.
+func connect(c *consumer.Consumer, cfg *config) error {
+	if addrs := cfg.nsqdAddrs(); len(addrs) > 0 {
+		if err := c.ConnectToNSQD(addrs...); err != nil {
+			return err
+		}
+	}
+	if len(cfg.NSQ.LookupdAddrs) > 0 {
+		return c.ConnectToNSQLookupd(cfg.NSQ.LookupdAddrs...)
+	}
+	return nil
+}
+
+// authenticated requires callers of h to be authenticated when
+// authentication is configured.
+func authenticated(identify command.IdentityFunc, h http.Handler) http.Handler {
+	if identify == nil {
+		return h
+	}
+	return command.RequireIdentity(identify, h)
+}
+
+// loadUsers reads a file of user:password lines.
+// Empty lines and lines starting with # are ignored.
+func loadUsers(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid line in %s: expected user:password", path)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, scanner.Err()
+}
+
+// loadSubjects reads a file of identity:subject lines, and returns the
+// identity of each client certificate subject. Subjects are formatted as
+// by pkix.Name.String, ex: alice:CN=alice,O=Example.
+// Empty lines and lines starting with # are ignored.
+func loadSubjects(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	subjects := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid line in %s: expected identity:subject", path)
+		}
+		subjects[parts[1]] = parts[0]
+	}
+	return subjects, scanner.Err()
 }
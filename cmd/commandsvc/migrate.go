@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/envelope"
+	"github.com/micromdm/command/migrate"
+	"github.com/micromdm/command/service/simple"
+)
+
+// runMigrate converts the keys of the archived events to the current key
+// format, and upgrades the events to the current schema version. The
+// database and keys of the server configuration are used, unless they are
+// set with the flags of the subcommand.
+//
+//	commandsvc migrate [-config commandsvc.yaml] [-db mdm_commands.bolt] [-batch-size 500] [-dry-run] [-keys keys.txt -key-id id]
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var (
+		dbPath    = fs.String("db", "", "Path to the BoltDB database, defaults to storage.path")
+		batchSize = fs.Int("batch-size", migrate.DefaultBatchSize, "Number of events migrated in one transaction")
+		dryRun    = fs.Bool("dry-run", false, "Report the events which need to be migrated without writing them")
+		keys      = fs.String("keys", "", "Path to the key file of an encrypted archive, defaults to archive.keys")
+		keyID     = fs.String("key-id", "", "ID of the key migrated events are encrypted with, defaults to archive.key-id")
+	)
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg.override(*dbPath, *keys, *keyID)
+
+	logger := log.NewLogfmtLogger(os.Stdout)
+	logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
+
+	db, err := bolt.Open(cfg.Storage.Path, 0666, nil)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	defer db.Close()
+
+	keyResult, err := simple.MigrateKeys(db, simple.CommandBucket, *batchSize, *dryRun)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	logger.Log("msg", "migrated keys", "scanned", keyResult.Scanned, "migrated", keyResult.Migrated, "dry_run", *dryRun)
+
+	m := migrate.NewMigrator(db, simple.CommandBucket)
+	m.BatchSize = *batchSize
+	m.DryRun = *dryRun
+	m.Logger = logger
+	if cfg.Archive.Keys != "" {
+		if m.Keyring, err = envelope.LoadKeyring(cfg.Archive.Keys, cfg.Archive.KeyID); err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+	}
+	result, err := m.Run(context.Background())
+	for version, n := range result.Versions {
+		logger.Log("schema_version", version, "events", n)
+	}
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	logger.Log(
+		"msg", fmt.Sprintf("migrated to schema version %d", command.CurrentSchemaVersion),
+		"scanned", result.Scanned,
+		"migrated", result.Migrated,
+		"dry_run", *dryRun,
+	)
+	return 0
+}
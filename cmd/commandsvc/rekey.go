@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/micromdm/command/approval"
+	"github.com/micromdm/command/envelope"
+	"github.com/micromdm/command/migrate"
+	"github.com/micromdm/command/service/simple"
+)
+
+// runRekey encrypts the archived events and the requests pending approval
+// with the primary key of a key file. Records sealed with older keys are
+// re-encrypted, and plaintext records are encrypted. The database and keys
+// of the server configuration are used, unless they are set with the flags
+// of the subcommand.
+//
+//	commandsvc rekey [-config commandsvc.yaml] [-keys keys.txt -key-id id] [-db mdm_commands.bolt] [-batch-size 500]
+func runRekey(args []string) int {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	var (
+		dbPath    = fs.String("db", "", "Path to the BoltDB database, defaults to storage.path")
+		keys      = fs.String("keys", "", "Path to a file of id:base64-key lines, defaults to archive.keys")
+		keyID     = fs.String("key-id", "", "ID of the key events are re-encrypted with, defaults to archive.key-id")
+		batchSize = fs.Int("batch-size", migrate.DefaultBatchSize, "Number of events re-encrypted in one transaction")
+	)
+	cfg, err := parseConfig(fs, args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg.override(*dbPath, *keys, *keyID)
+
+	logger := log.NewLogfmtLogger(os.Stdout)
+	logger = log.NewContext(logger).With("ts", log.DefaultTimestampUTC)
+
+	keyring, err := envelope.LoadKeyring(cfg.Archive.Keys, cfg.Archive.KeyID)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+
+	db, err := bolt.Open(cfg.Storage.Path, 0666, nil)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	defer db.Close()
+
+	for _, bucket := range []string{simple.CommandBucket, approval.PendingBucket} {
+		if !hasBucket(db, bucket) && bucket == approval.PendingBucket {
+			// the gate has never run on this database.
+			continue
+		}
+		result, err := envelope.Reencrypt(db, bucket, keyring, *batchSize)
+		if err != nil {
+			logger.Log("err", err, "bucket", bucket, "scanned", result.Scanned, "reencrypted", result.Reencrypted)
+			return 1
+		}
+		logger.Log(
+			"msg", "re-encrypted bucket",
+			"bucket", bucket,
+			"key_id", keyring.Primary(),
+			"scanned", result.Scanned,
+			"reencrypted", result.Reencrypted,
+		)
+	}
+	return 0
+}
+
+func hasBucket(db *bolt.DB, name string) bool {
+	var ok bool
+	db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket([]byte(name)) != nil
+		return nil
+	})
+	return ok
+}
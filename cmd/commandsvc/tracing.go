@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// newTracerProvider creates the TracerProvider of the exporter: none,
+// stdout or otlp. The otlp exporter sends spans over HTTPS to the endpoint,
+// or to the endpoint of the OTEL_EXPORTER_OTLP_ENDPOINT environment
+// variable if endpoint is empty. Spans are sent over plain HTTP if insecure
+// is true. The returned function flushes and stops the exporter.
+func newTracerProvider(exporter, endpoint string, insecure bool, ratio float64) (trace.TracerProvider, func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil, fmt.Errorf("unknown trace exporter %q, want none, stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("commandsvc"))),
+	)
+	return tp, tp.Shutdown, nil
+}
@@ -2,6 +2,7 @@
 package command
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -18,50 +19,147 @@ type Service interface {
 type Middleware func(Service) Service
 
 // ServiceLoggingMiddleware returns a service middleware that logs the
-// parameters and result of each method invocation.
+// parameters and result of each method invocation, with the request ID,
+// caller and correlation ID in the context. The secret fields of the
+// request are masked by the DefaultRedactor.
 func ServiceLoggingMiddleware(logger log.Logger) Middleware {
 	return func(next Service) Service {
 		return serviceLoggingMiddleware{
-			logger: logger,
-			next:   next,
+			logger:   logger,
+			redactor: DefaultRedactor,
+			next:     next,
 		}
 	}
 }
 
 func (mw serviceLoggingMiddleware) NewCommand(ctx context.Context, req *mdm.CommandRequest) (p *mdm.Payload, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
-			"method", "NewCommand",
+		keyvals := []interface{}{"method", "NewCommand"}
+		keyvals = append(keyvals, contextKeyvals(ctx)...)
+		keyvals = append(keyvals, requestKeyvals(req)...)
+		if p != nil {
+			keyvals = append(keyvals, "command_uuid", p.CommandUUID)
+		}
+		keyvals = append(keyvals,
+			"request", loggedRequest{mw.redactor.Request(req)},
 			"error", err,
 			"took", time.Since(begin),
 		)
+		mw.logger.Log(keyvals...)
 	}(time.Now())
 	return mw.next.NewCommand(ctx, req)
 }
 
 type serviceLoggingMiddleware struct {
-	logger log.Logger
-	next   Service
+	logger   log.Logger
+	redactor *Redactor
+	next     Service
+}
+
+// contextKeyvals returns the request ID, caller and correlation ID in the
+// context as log keyvals.
+func contextKeyvals(ctx context.Context) []interface{} {
+	var keyvals []interface{}
+	if origin, ok := OriginFromContext(ctx); ok {
+		keyvals = append(keyvals, "request_id", origin.RequestID, "caller", origin.Caller)
+	}
+	if id, ok := CorrelationIDFromContext(ctx); ok {
+		keyvals = append(keyvals, "correlation_id", id)
+	}
+	return keyvals
+}
+
+// requestKeyvals returns the UDID and request type of a command request as
+// log keyvals.
+func requestKeyvals(req *mdm.CommandRequest) []interface{} {
+	if req == nil {
+		return nil
+	}
+	return []interface{}{"udid", req.UDID, "request_type", req.RequestType}
+}
+
+// loggedRequest formats a request as JSON in log output.
+type loggedRequest struct {
+	*mdm.CommandRequest
+}
+
+func (r loggedRequest) String() string {
+	if r.CommandRequest == nil {
+		return ""
+	}
+	data, err := json.Marshal(r.CommandRequest)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
 }
 
-// ServiceInstrumentingMiddleware returns a service middleware that tracks the
-// number of payloads created by the service.
-func ServiceInstrumentingMiddleware(p metrics.Counter) Middleware {
+// Outcomes of a NewCommand call, used as the "outcome" label of the
+// service metrics.
+const (
+	OutcomeSuccess         = "success"
+	OutcomePending         = "pending_approval"
+	OutcomeValidationError = "validation_error"
+	OutcomeArchiveError    = "archive_error"
+	OutcomePublishError    = "publish_error"
+	OutcomeError           = "error"
+)
+
+// outcomer is implemented by errors which know their outcome, such as the
+// archive and publish errors of a service.
+type outcomer interface {
+	Outcome() string
+}
+
+// ErrorOutcome returns the outcome of a NewCommand call which returned
+// err.
+func ErrorOutcome(err error) string {
+	if err == nil {
+		return OutcomeSuccess
+	}
+	if e, ok := err.(outcomer); ok {
+		return e.Outcome()
+	}
+	if _, ok := err.(pendingApproval); ok {
+		return OutcomePending
+	}
+	if e, ok := err.(invalidRequest); ok && e.InvalidRequest() {
+		return OutcomeValidationError
+	}
+	if err == errEmptyRequest {
+		return OutcomeValidationError
+	}
+	return OutcomeError
+}
+
+// ServiceInstrumentingMiddleware returns a service middleware that counts
+// the NewCommand calls and observes their duration in seconds. Both
+// metrics are labeled by "request_type" and "outcome".
+func ServiceInstrumentingMiddleware(requests metrics.Counter, duration metrics.Histogram) Middleware {
 	return func(next Service) Service {
 		return serviceInstrumentingMiddleware{
-			payloads: p,
+			requests: requests,
+			duration: duration,
 			next:     next,
 		}
 	}
 }
 
 type serviceInstrumentingMiddleware struct {
-	payloads metrics.Counter
+	requests metrics.Counter
+	duration metrics.Histogram
 	next     Service
 }
 
-func (mw serviceInstrumentingMiddleware) NewCommand(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
-	p, err := mw.next.NewCommand(ctx, req)
-	mw.payloads.Add(1)
-	return p, err
+func (mw serviceInstrumentingMiddleware) NewCommand(ctx context.Context, req *mdm.CommandRequest) (p *mdm.Payload, err error) {
+	defer func(begin time.Time) {
+		var requestType string
+		if req != nil {
+			requestType = req.RequestType
+		}
+		labels := []string{"request_type", requestType, "outcome", ErrorOutcome(err)}
+		mw.requests.With(labels...).Add(1)
+		mw.duration.With(labels...).Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	return mw.next.NewCommand(ctx, req)
 }
@@ -0,0 +1,261 @@
+// Package consumer processes the command events which commandsvc
+// publishes to NSQ.
+//
+// A Consumer decodes each message into a *command.Event and passes it to
+// a Handler. Failed events are requeued with exponential backoff, and
+// dropped after a number of attempts.
+package consumer
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	nsq "github.com/nsqio/go-nsq"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// DefaultTopic is the NSQ topic commandsvc publishes events to. It is
+// simple.CommandTopic, which is not referenced so that consumers do not
+// depend on the service.
+const DefaultTopic = "mdm.Command"
+
+// Handler processes command events.
+type Handler interface {
+	// HandleEvent is called once for every attempt to process the event.
+	// The event is requeued if HandleEvent returns an error.
+	HandleEvent(ctx context.Context, event *command.Event) error
+}
+
+// HandlerFunc is an adapter to use a function as a Handler.
+type HandlerFunc func(ctx context.Context, event *command.Event) error
+
+// HandleEvent calls f(ctx, event).
+func (f HandlerFunc) HandleEvent(ctx context.Context, event *command.Event) error {
+	return f(ctx, event)
+}
+
+// Tracer traces the handling of events. It is satisfied by a
+// *tracing.ConsumerTracer.
+type Tracer interface {
+	// TraceEvent starts a span for an attempt to handle the event, and
+	// returns the context of the handler and a function which ends the
+	// span with the error of the handler.
+	TraceEvent(ctx context.Context, e *command.Event, topic, channel string, attempts uint16) (context.Context, func(error))
+}
+
+type nopTracer struct{}
+
+func (nopTracer) TraceEvent(ctx context.Context, _ *command.Event, _, _ string, _ uint16) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
+
+// Outcomes of a message, used as the "outcome" label of Metrics.Messages.
+const (
+	OutcomeSuccess = "success"
+	OutcomeRetry   = "retry"
+	OutcomePoison  = "poison"
+	OutcomeInvalid = "invalid"
+)
+
+// Metrics of a Consumer.
+type Metrics struct {
+	// Messages counts the consumed messages by "outcome".
+	Messages metrics.Counter
+
+	// Duration observes the seconds spent in HandleEvent.
+	Duration metrics.Histogram
+}
+
+// Config configures a Consumer.
+type Config struct {
+	// Topic defaults to DefaultTopic.
+	Topic string
+
+	// Channel is the NSQ channel of the consumer. Every channel receives
+	// a copy of each event.
+	Channel string
+
+	// Concurrency is the number of events handled at once. Defaults to 1.
+	Concurrency int
+
+	// MaxAttempts is the number of times an event is handled before it
+	// is dropped as a poison message. Defaults to 5.
+	MaxAttempts uint16
+
+	// Backoff is the requeue delay after the first failed attempt. It
+	// doubles after each attempt, up to MaxBackoff. Defaults to one
+	// second and ten minutes.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// OnPoison is called with messages which are dropped, either because
+	// they failed MaxAttempts times, or because they can not be decoded.
+	OnPoison func(m *nsq.Message, err error)
+
+	Logger  log.Logger
+	Metrics Metrics
+
+	// Tracer records the handling of each event as a span, which
+	// continues the trace of the request that created the command.
+	Tracer Tracer
+
+	// NSQ is the configuration of the underlying NSQ consumer.
+	// MaxInFlight and MaxAttempts are overwritten.
+	NSQ *nsq.Config
+}
+
+// Consumer consumes command events from NSQ.
+type Consumer struct {
+	cfg     Config
+	handler Handler
+	nsq     *nsq.Consumer
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// New creates a Consumer which passes events to the handler. Events are
+// received once the Consumer is connected to nsqd or nsqlookupd.
+func New(cfg Config, handler Handler) (*Consumer, error) {
+	if cfg.Channel == "" {
+		return nil, errors.New("consumer: channel is required")
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultTopic
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Minute
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+	if cfg.Metrics.Messages == nil {
+		cfg.Metrics.Messages = discard.NewCounter()
+	}
+	if cfg.Metrics.Duration == nil {
+		cfg.Metrics.Duration = discard.NewHistogram()
+	}
+	if cfg.Tracer == nil {
+		cfg.Tracer = nopTracer{}
+	}
+	if cfg.NSQ == nil {
+		cfg.NSQ = nsq.NewConfig()
+	}
+	// attempts are counted by the consumer, so that poison messages are
+	// passed to OnPoison instead of being dropped by go-nsq.
+	cfg.NSQ.MaxAttempts = 0
+	cfg.NSQ.MaxInFlight = cfg.Concurrency
+
+	q, err := nsq.NewConsumer(cfg.Topic, cfg.Channel, cfg.NSQ)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Consumer{
+		cfg:     cfg,
+		handler: handler,
+		nsq:     q,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	q.AddConcurrentHandlers(nsq.HandlerFunc(c.handleMessage), cfg.Concurrency)
+	return c, nil
+}
+
+// ConnectToNSQD connects the consumer to nsqd instances.
+func (c *Consumer) ConnectToNSQD(addrs ...string) error {
+	return c.nsq.ConnectToNSQDs(addrs)
+}
+
+// ConnectToNSQLookupd discovers the nsqd instances of the topic
+// through nsqlookupd.
+func (c *Consumer) ConnectToNSQLookupd(addrs ...string) error {
+	return c.nsq.ConnectToNSQLookupds(addrs)
+}
+
+// Stop stops receiving new events and waits for the events in flight
+// to be handled. If ctx is done first, the context passed to the handler
+// is canceled and Stop returns ctx.Err().
+func (c *Consumer) Stop(ctx context.Context) error {
+	defer c.cancel()
+	c.nsq.Stop()
+	select {
+	case <-c.nsq.StopChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Consumer) handleMessage(m *nsq.Message) error {
+	m.DisableAutoResponse()
+	logger := log.NewContext(c.cfg.Logger).With("message", string(m.ID[:]), "attempts", m.Attempts)
+
+	var event command.Event
+	if err := command.UnmarshalEvent(m.Body, &event); err != nil {
+		logger.Log("msg", "dropping invalid message", "err", err)
+		c.cfg.Metrics.Messages.With("outcome", OutcomeInvalid).Add(1)
+		c.poison(m, err)
+		return nil
+	}
+
+	ctx := c.ctx
+	if event.CorrelationID != "" {
+		ctx = command.NewCorrelationContext(ctx, event.CorrelationID)
+		logger = log.NewContext(logger).With("correlation_id", event.CorrelationID)
+	}
+
+	ctx, end := c.cfg.Tracer.TraceEvent(ctx, &event, c.cfg.Topic, c.cfg.Channel, m.Attempts)
+
+	begin := time.Now()
+	err := c.handler.HandleEvent(ctx, &event)
+	c.cfg.Metrics.Duration.Observe(time.Since(begin).Seconds())
+	end(err)
+
+	switch {
+	case err == nil:
+		c.cfg.Metrics.Messages.With("outcome", OutcomeSuccess).Add(1)
+		m.Finish()
+	case m.Attempts >= c.cfg.MaxAttempts:
+		logger.Log("msg", "dropping poison message", "event", event.ID, "err", err)
+		c.cfg.Metrics.Messages.With("outcome", OutcomePoison).Add(1)
+		c.poison(m, err)
+	default:
+		delay := c.backoff(m.Attempts)
+		logger.Log("msg", "requeue event", "event", event.ID, "delay", delay, "err", err)
+		c.cfg.Metrics.Messages.With("outcome", OutcomeRetry).Add(1)
+		m.RequeueWithoutBackoff(delay)
+	}
+	return nil
+}
+
+func (c *Consumer) poison(m *nsq.Message, err error) {
+	if c.cfg.OnPoison != nil {
+		c.cfg.OnPoison(m, err)
+	}
+	m.Finish()
+}
+
+// backoff returns the requeue delay after the attempt.
+func (c *Consumer) backoff(attempts uint16) time.Duration {
+	delay := c.cfg.Backoff
+	for i := uint16(1); i < attempts; i++ {
+		if delay *= 2; delay >= c.cfg.MaxBackoff {
+			return c.cfg.MaxBackoff
+		}
+	}
+	return delay
+}
@@ -0,0 +1,190 @@
+package consumer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromdm/mdm"
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/nsqd"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/service/simple"
+)
+
+func TestDefaultTopic(t *testing.T) {
+	if want, have := simple.CommandTopic, DefaultTopic; want != have {
+		t.Errorf("want DefaultTopic %q, have %q", want, have)
+	}
+}
+
+func TestConsumer(t *testing.T) {
+	addr, done := setupNSQD(t)
+	defer done()
+
+	var (
+		mu       sync.Mutex
+		attempts int
+		handled  = make(chan *command.Event, 1)
+	)
+	handler := HandlerFunc(func(ctx context.Context, e *command.Event) error {
+		mu.Lock()
+		attempts++
+		n := attempts
+		mu.Unlock()
+		if n == 1 {
+			return errors.New("try again")
+		}
+		handled <- e
+		return nil
+	})
+	c := setupConsumer(t, addr, Config{Channel: "test"}, handler)
+
+	want := publish(t, addr)
+	select {
+	case e := <-handled:
+		if want.ID != e.ID {
+			t.Errorf("want event %s, have %s", want.ID, e.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not handled")
+	}
+	if want, have := 2, attempts; want != have {
+		t.Errorf("want %d attempts, have %d", want, have)
+	}
+
+	if err := c.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumer_poison(t *testing.T) {
+	addr, done := setupNSQD(t)
+	defer done()
+
+	var (
+		mu       sync.Mutex
+		attempts int
+		poisoned = make(chan error, 2)
+	)
+	handler := HandlerFunc(func(ctx context.Context, e *command.Event) error {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		return errors.New("always fails")
+	})
+	cfg := Config{
+		Channel:     "test",
+		MaxAttempts: 3,
+		OnPoison:    func(m *nsq.Message, err error) { poisoned <- err },
+	}
+	c := setupConsumer(t, addr, cfg, handler)
+	defer c.Stop(context.Background())
+
+	publish(t, addr)
+	select {
+	case <-poisoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not dropped")
+	}
+	mu.Lock()
+	if want, have := 3, attempts; want != have {
+		t.Errorf("want %d attempts, have %d", want, have)
+	}
+	mu.Unlock()
+
+	// messages which can not be decoded are dropped without calling
+	// the handler.
+	producer, err := nsq.NewProducer(addr, nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Stop()
+	if err := producer.Publish(DefaultTopic, []byte("foobarbaz")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-poisoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("invalid message was not dropped")
+	}
+	mu.Lock()
+	if want, have := 3, attempts; want != have {
+		t.Errorf("invalid message was handled: want %d attempts, have %d", want, have)
+	}
+	mu.Unlock()
+}
+
+func TestConsumer_backoff(t *testing.T) {
+	c := &Consumer{cfg: Config{Backoff: time.Second, MaxBackoff: 5 * time.Second}}
+	tests := []struct {
+		attempts uint16
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if have := c.backoff(tt.attempts); tt.want != have {
+			t.Errorf("attempt %d: want %s, have %s", tt.attempts, tt.want, have)
+		}
+	}
+}
+
+func publish(t *testing.T, addr string) *command.Event {
+	producer, err := nsq.NewProducer(addr, nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Stop()
+	event := command.NewEvent(mdm.Payload{
+		CommandUUID: "foo",
+		Command:     &mdm.Command{RequestType: "DeviceInformation"},
+	})
+	msg, err := command.MarshalEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(DefaultTopic, msg); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func setupConsumer(t *testing.T, addr string, cfg Config, handler Handler) *Consumer {
+	cfg.Backoff = 10 * time.Millisecond
+	c, err := New(cfg, handler)
+	if err != nil {
+		t.Fatalf("couldn't create consumer, err %s\n", err)
+	}
+	if err := c.ConnectToNSQD(addr); err != nil {
+		t.Fatalf("couldn't connect to nsqd, err %s\n", err)
+	}
+	return c
+}
+
+// setupNSQD starts an embedded nsqd on a random port.
+func setupNSQD(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "nsqd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.DataPath = dir
+	n := nsqd.New(opts)
+	n.Main()
+	return n.RealTCPAddr().String(), func() {
+		n.Exit()
+		os.RemoveAll(dir)
+	}
+}
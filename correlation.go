@@ -0,0 +1,73 @@
+package command
+
+import (
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+)
+
+// CorrelationIDHeader is the HTTP header which carries the correlation ID.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// MaxCorrelationIDLength is the maximum length of a correlation ID passed
+// in the X-Correlation-ID header.
+const MaxCorrelationIDLength = 128
+
+// NewCorrelationContext returns a new Context carrying the correlation ID
+// of a command. The correlation ID is recorded in the event of the command,
+// so that the command can be traced from the HTTP request to the consumers
+// of the event.
+func NewCorrelationContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey, id)
+}
+
+// CorrelationIDFromContext returns the correlation ID stored in ctx, if any.
+func CorrelationIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(correlationKey).(string)
+	return id, ok
+}
+
+// CorrelationRequestFunc is a RequestFunc which stores the correlation ID
+// of the HTTP request in the context. Callers which already trace a
+// workflow can pass their ID in the X-Correlation-ID header, otherwise a
+// new ID is generated. IDs which are longer than MaxCorrelationIDLength or
+// contain characters other than ASCII letters, digits, '-', '_', '.' and
+// ':' are replaced with a new ID, because they end up in logs and events.
+func CorrelationRequestFunc(ctx context.Context, r *http.Request) context.Context {
+	id := r.Header.Get(CorrelationIDHeader)
+	if !validCorrelationID(id) {
+		id = uuid.NewV4().String()
+	}
+	return NewCorrelationContext(ctx, id)
+}
+
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > MaxCorrelationIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SetCorrelationIDHeader is a ServerResponseFunc which returns the
+// correlation ID in the context to the caller.
+func SetCorrelationIDHeader(ctx context.Context, w http.ResponseWriter) context.Context {
+	if id, ok := CorrelationIDFromContext(ctx); ok {
+		w.Header().Set(CorrelationIDHeader, id)
+	}
+	return ctx
+}
+
+var (
+	_ httptransport.RequestFunc        = CorrelationRequestFunc
+	_ httptransport.ServerResponseFunc = SetCorrelationIDHeader
+)
@@ -0,0 +1,82 @@
+package command
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command/service/mock"
+)
+
+func TestCorrelationRequestFunc(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/commands", nil)
+	ctx := CorrelationRequestFunc(context.Background(), r)
+	generated, ok := CorrelationIDFromContext(ctx)
+	if !ok || generated == "" {
+		t.Fatal("correlation ID was not generated")
+	}
+
+	r.Header.Set(CorrelationIDHeader, "workflow-1")
+	ctx = CorrelationRequestFunc(context.Background(), r)
+	if id, _ := CorrelationIDFromContext(ctx); id != "workflow-1" {
+		t.Errorf("want correlation ID %q, have %q", "workflow-1", id)
+	}
+
+	rec := httptest.NewRecorder()
+	SetCorrelationIDHeader(ctx, rec)
+	if want, have := "workflow-1", rec.Header().Get(CorrelationIDHeader); want != have {
+		t.Errorf("want header %q, have %q", want, have)
+	}
+
+	for _, invalid := range []string{
+		strings.Repeat("a", MaxCorrelationIDLength+1),
+		"workflow 1",
+		"workflow-1\" level=error",
+		"wörkflow",
+	} {
+		r.Header.Set(CorrelationIDHeader, invalid)
+		ctx = CorrelationRequestFunc(context.Background(), r)
+		if id, _ := CorrelationIDFromContext(ctx); id == invalid || id == "" {
+			t.Errorf("want invalid correlation ID %q replaced, have %q", invalid, id)
+		}
+	}
+	r.Header.Set(CorrelationIDHeader, strings.Repeat("a", MaxCorrelationIDLength))
+	ctx = CorrelationRequestFunc(context.Background(), r)
+	if id, _ := CorrelationIDFromContext(ctx); len(id) != MaxCorrelationIDLength {
+		t.Errorf("want correlation ID of %d characters kept, have %q", MaxCorrelationIDLength, id)
+	}
+}
+
+func TestServiceLoggingMiddleware_context(t *testing.T) {
+	var buf bytes.Buffer
+	svc := ServiceLoggingMiddleware(log.NewLogfmtLogger(&buf))(&mock.CommandService{
+		NewCommandFunc: mock.ReturnMockPayload,
+	})
+	ctx := NewOriginContext(context.Background(), Origin{Caller: "alice", RequestID: "req-1"})
+	ctx = NewCorrelationContext(ctx, "workflow-1")
+	p, err := svc.NewCommand(ctx, &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"udid=foobarbaz",
+		"request_type=DeviceInformation",
+		"command_uuid=" + p.CommandUUID,
+		"request_id=req-1",
+		"caller=alice",
+		"correlation_id=workflow-1",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %s in the log output, have %s", want, out)
+		}
+	}
+}
@@ -26,23 +26,36 @@ func MakeNewCommandEndpoint(svc Service) endpoint.Endpoint {
 		if req.UDID == "" || req.RequestType == "" {
 			return newCommandResponse{Err: errEmptyRequest}, nil
 		}
+		if err := req.Scheduling.Validate(); err != nil {
+			return newCommandResponse{Err: err}, nil
+		}
+		ctx = NewSchedulingContext(ctx, req.Scheduling)
+		ctx = NewWarningsContext(ctx)
 		payload, err := svc.NewCommand(ctx, req.CommandRequest)
+		warnings := WarningsFromContext(ctx)
+		if e, ok := err.(pendingApproval); ok {
+			return newCommandResponse{ApprovalID: e.ApprovalID(), Warnings: warnings}, nil
+		}
 		if err != nil {
 			return newCommandResponse{Err: err}, nil
 		}
-		return newCommandResponse{Payload: payload}, nil
+		return newCommandResponse{Payload: payload, Warnings: warnings}, nil
 	}
 }
 
 // EndpointInstrumentingMiddleware returns an endpoint middleware that records
 // the duration of each invocation to the passed histogram. The middleware adds
 // a single field: "success", which is "true" if no error is returned, and
-// "false" otherwise.
+// "false" otherwise. The error of a NewCommand response counts as an error.
 func EndpointInstrumentingMiddleware(duration metrics.Histogram) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 			defer func(begin time.Time) {
-				duration.With("success", fmt.Sprint(err == nil)).Observe(time.Since(begin).Seconds())
+				success := err == nil
+				if resp, ok := response.(newCommandResponse); ok && resp.Err != nil {
+					success = false
+				}
+				duration.With("success", fmt.Sprint(success)).Observe(time.Since(begin).Seconds())
 			}(time.Now())
 			return next(ctx, request)
 
@@ -51,13 +64,23 @@ func EndpointInstrumentingMiddleware(duration metrics.Histogram) endpoint.Middle
 }
 
 // EndpointLoggingMiddleware returns an endpoint middleware that logs the
-// duration of each invocation, and the resulting error, if any.
+// duration of each invocation, and the resulting error, if any. The
+// request ID, caller and correlation ID in the context are logged, and for
+// command requests the UDID, request type and command UUID.
 func EndpointLoggingMiddleware(logger log.Logger) endpoint.Middleware {
 	return func(next endpoint.Endpoint) endpoint.Endpoint {
 		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 			defer func(begin time.Time) {
-				logger.Log("error", err, "took", time.Since(begin))
+				keyvals := contextKeyvals(ctx)
+				if req, ok := request.(newCommandRequest); ok {
+					keyvals = append(keyvals, requestKeyvals(req.CommandRequest)...)
+				}
+				if resp, ok := response.(newCommandResponse); ok && resp.Payload != nil {
+					keyvals = append(keyvals, "command_uuid", resp.Payload.CommandUUID)
+				}
+				keyvals = append(keyvals, "error", err, "took", time.Since(begin))
+				logger.Log(keyvals...)
 			}(time.Now())
 			return next(ctx, request)
 
@@ -67,12 +90,31 @@ func EndpointLoggingMiddleware(logger log.Logger) endpoint.Middleware {
 
 type newCommandRequest struct {
 	*mdm.CommandRequest
+	Scheduling
+}
+
+// pendingApproval is implemented by errors which are returned when a
+// command request is held for approval instead of being created.
+type pendingApproval interface {
+	ApprovalID() string
 }
 
 type newCommandResponse struct {
-	Payload *mdm.Payload `json:"payload,omitempty"`
-	Err     error        `json:"error,omitempty"`
+	Payload    *mdm.Payload `json:"payload,omitempty"`
+	ApprovalID string       `json:"approval_id,omitempty"`
+	Warnings   []Warning    `json:"warnings,omitempty"`
+	Err        error        `json:"error,omitempty"`
 }
 
 func (r newCommandResponse) error() error { return r.Err }
-func (r newCommandResponse) status() int  { return http.StatusCreated }
+
+// Failed returns the error of the request, for middlewares of other
+// packages which can not see the response type.
+func (r newCommandResponse) Failed() error { return r.Err }
+
+func (r newCommandResponse) status() int {
+	if r.ApprovalID != "" {
+		return http.StatusAccepted
+	}
+	return http.StatusCreated
+}
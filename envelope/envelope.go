@@ -0,0 +1,241 @@
+// Package envelope encrypts archived events with AES-GCM envelope
+// encryption.
+//
+// Every record is encrypted with a random data key, and the data key is
+// encrypted with a key encryption key from a Keyring. Sealed records
+// carry the ID of the key encryption key, so keys can be rotated: new
+// records are sealed with the primary key, and older records can still be
+// opened with the previous keys until they are re-encrypted.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// magic starts every sealed record. A serialized protocol buffer can not
+// start with 0xff, so sealed and plaintext records can be told apart.
+var magic = []byte{0xff, 'E', 'N', 'C'}
+
+const (
+	formatVersion = 1
+	dataKeySize   = 32
+)
+
+var (
+	// ErrUnknownKey is returned when a record is sealed with a key which
+	// is not in the Keyring.
+	ErrUnknownKey = errors.New("envelope: record is sealed with an unknown key")
+
+	// ErrMalformed is returned when a sealed record can not be parsed.
+	ErrMalformed = errors.New("envelope: malformed sealed record")
+)
+
+// Keyring holds the key encryption keys by ID.
+type Keyring struct {
+	primary string
+	keys    map[string][]byte
+}
+
+// NewKeyring creates a Keyring which seals records with the primary key.
+// Keys must be 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256.
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("envelope: primary key %q not found", primary)
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("envelope: invalid key ID %q", id)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("envelope: key %q must be 16, 24 or 32 bytes, not %d", id, len(key))
+		}
+	}
+	return &Keyring{primary: primary, keys: keys}, nil
+}
+
+// LoadKeyring reads a key file of id:base64-key lines. Empty lines and
+// lines starting with # are ignored.
+func LoadKeyring(path, primary string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: expected id:base64-key", path)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("decode key %q in %s: %s", parts[0], path, err)
+		}
+		keys[parts[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewKeyring(primary, keys)
+}
+
+// Primary returns the ID of the key new records are sealed with.
+func (k *Keyring) Primary() string { return k.primary }
+
+// Seal encrypts plaintext with a new data key, which is encrypted with
+// the primary key.
+//
+// A sealed record is laid out as:
+//
+//	magic | version | len(key ID) | key ID | len(wrapped key) | wrapped key | nonce | ciphertext
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.Write(magic)
+	header.WriteByte(formatVersion)
+	header.WriteByte(byte(len(k.primary)))
+	header.WriteString(k.primary)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+
+	// the header is authenticated with the record, so that the key ID
+	// and wrapped key can not be swapped between records.
+	body, err := seal(dataKey, plaintext, header.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return append(header.Bytes(), body...), nil
+}
+
+// Open decrypts a sealed record. Records which are not sealed are
+// returned unchanged, so that archives can be encrypted gradually.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	r, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := k.keys[r.keyID]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	dataKey, err := open(kek, r.wrapped, []byte(r.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: unwrap data key: %s", err)
+	}
+	plaintext, err := open(dataKey, r.body, r.header)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: decrypt record: %s", err)
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether data is a sealed record.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// KeyID returns the ID of the key a record is sealed with.
+func KeyID(data []byte) (string, error) {
+	r, err := parse(data)
+	if err != nil {
+		return "", err
+	}
+	return r.keyID, nil
+}
+
+type record struct {
+	keyID   string
+	wrapped []byte
+	header  []byte
+	body    []byte
+}
+
+func parse(data []byte) (*record, error) {
+	if !IsSealed(data) {
+		return nil, ErrMalformed
+	}
+	rest := data[len(magic):]
+	if len(rest) < 2 || rest[0] != formatVersion {
+		return nil, ErrMalformed
+	}
+	idLen := int(rest[1])
+	rest = rest[2:]
+	if len(rest) < idLen+2 {
+		return nil, ErrMalformed
+	}
+	r := &record{keyID: string(rest[:idLen])}
+	rest = rest[idLen:]
+	wrappedLen := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < wrappedLen {
+		return nil, ErrMalformed
+	}
+	r.wrapped = rest[:wrappedLen]
+	rest = rest[wrappedLen:]
+	r.header = data[:len(data)-len(rest)]
+	r.body = rest
+	return r, nil
+}
+
+// seal encrypts plaintext with AES-GCM and prepends the nonce.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts data sealed by seal.
+func open(key, data, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,215 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestKeyring_SealOpen(t *testing.T) {
+	k := testKeyring(t, "k1", "k1")
+	plaintext := []byte("archived event")
+
+	sealed, err := k.Seal(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) {
+		t.Fatal("sealed record is not recognized as sealed")
+	}
+	if bytes.Contains(sealed, plaintext) {
+		t.Fatal("sealed record contains the plaintext")
+	}
+	if id, err := KeyID(sealed); err != nil || id != "k1" {
+		t.Errorf("want key ID %q, have %q (%v)", "k1", id, err)
+	}
+
+	opened, err := k.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, opened) {
+		t.Errorf("want %q, have %q", plaintext, opened)
+	}
+
+	// records which are not sealed are returned unchanged.
+	opened, err = k.Open(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, opened) {
+		t.Errorf("want plaintext %q, have %q", plaintext, opened)
+	}
+}
+
+func TestKeyring_Open_errors(t *testing.T) {
+	k := testKeyring(t, "k1", "k1")
+	sealed, err := k.Seal([]byte("archived event"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := k.Open(tampered); err == nil {
+		t.Error("want error for a tampered record")
+	}
+
+	if _, err := k.Open(sealed[:len(magic)+3]); err != ErrMalformed {
+		t.Errorf("want %v for a truncated record, have %v", ErrMalformed, err)
+	}
+
+	other := testKeyring(t, "k2", "k2")
+	if _, err := other.Open(sealed); err != ErrUnknownKey {
+		t.Errorf("want %v, have %v", ErrUnknownKey, err)
+	}
+}
+
+func TestNewKeyring_errors(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	tests := []struct {
+		name    string
+		primary string
+		keys    map[string][]byte
+	}{
+		{"missing primary", "k2", map[string][]byte{"k1": key}},
+		{"short key", "k1", map[string][]byte{"k1": key[:10]}},
+		{"empty id", "k1", map[string][]byte{"k1": key, "": key}},
+	}
+	for _, tt := range tests {
+		if _, err := NewKeyring(tt.primary, tt.keys); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	f, err := ioutil.TempFile("", "keys-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprintf(f, "# rotated 2016-11-30\nk1:%s\n\nk2:%s\n",
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)),
+		base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16)),
+	)
+	f.Close()
+
+	k, err := LoadKeyring(f.Name(), "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "k2", k.Primary(); want != have {
+		t.Errorf("want primary %q, have %q", want, have)
+	}
+	if want, have := 2, len(k.keys); want != have {
+		t.Errorf("want %d keys, have %d", want, have)
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	db := setupDB(t)
+	old := testKeyring(t, "k1", "k1")
+	records := map[string][]byte{
+		"1": []byte("plaintext event"),
+		"2": []byte("old event"),
+		"3": []byte("another old event"),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(testBucket))
+		for key, v := range records {
+			if key != "1" {
+				var err error
+				if v, err = old.Seal(v); err != nil {
+					return err
+				}
+			}
+			if err := bkt.Put([]byte(key), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate to k2, keeping k1 to open the old records.
+	rotated := testKeyring(t, "k2", "k1", "k2")
+	result, err := Reencrypt(db, testBucket, rotated, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, result.Reencrypted; want != have {
+		t.Errorf("want %d re-encrypted records, have %d", want, have)
+	}
+
+	// without k1, every record must still open.
+	current := testKeyring(t, "k2", "k2")
+	db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(testBucket))
+		for key, want := range records {
+			v := bkt.Get([]byte(key))
+			if id, _ := KeyID(v); id != "k2" {
+				t.Errorf("%s: want key ID %q, have %q", key, "k2", id)
+			}
+			have, err := current.Open(v)
+			if err != nil {
+				t.Errorf("%s: %s", key, err)
+				continue
+			}
+			if !bytes.Equal(want, have) {
+				t.Errorf("%s: want %q, have %q", key, want, have)
+			}
+		}
+		return nil
+	})
+
+	// records sealed with the primary key are not rewritten.
+	result, err = Reencrypt(db, testBucket, rotated, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, result.Reencrypted; want != have {
+		t.Errorf("want %d re-encrypted records, have %d", want, have)
+	}
+}
+
+const testBucket = "mdm.Command.ARCHIVE"
+
+// testKeyring creates a Keyring of 32 byte keys derived from the key IDs.
+func testKeyring(t *testing.T, primary string, ids ...string) *Keyring {
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte(id[len(id)-1:]), 32)
+	}
+	k, err := NewKeyring(primary, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func setupDB(t *testing.T) *bolt.DB {
+	f, _ := ioutil.TempFile("", "bolt-")
+	f.Close()
+	os.Remove(f.Name())
+
+	db, err := bolt.Open(f.Name(), 0777, nil)
+	if err != nil {
+		t.Fatalf("couldn't open bolt, err %s\n", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(testBucket))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,79 @@
+package envelope
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// ReencryptResult summarizes a re-encryption run.
+type ReencryptResult struct {
+	// Scanned is the number of records read.
+	Scanned int
+	// Reencrypted is the number of records which were sealed with the
+	// primary key.
+	Reencrypted int
+}
+
+// Reencrypt seals every record in the bucket with the primary key of the
+// keyring, batchSize records per transaction. Plaintext records are
+// encrypted, and records sealed with another key are re-encrypted.
+// Records which are already sealed with the primary key are unchanged, so
+// an interrupted run can be resumed by running it again.
+func Reencrypt(db *bolt.DB, bucket string, k *Keyring, batchSize int) (ReencryptResult, error) {
+	var (
+		result ReencryptResult
+		after  []byte
+	)
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	for {
+		var last []byte
+		err := db.Update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte(bucket))
+			if bkt == nil {
+				return fmt.Errorf("bucket %q not found", bucket)
+			}
+			type record struct{ k, v []byte }
+			var rewritten []record
+			c := bkt.Cursor()
+			key, v := c.First()
+			if after != nil {
+				if key, v = c.Seek(after); key != nil && string(key) == string(after) {
+					key, v = c.Next()
+				}
+			}
+			for n := 0; key != nil && n < batchSize; key, v = c.Next() {
+				n++
+				last = append([]byte(nil), key...)
+				result.Scanned++
+				if id, err := KeyID(v); err == nil && id == k.primary {
+					continue
+				}
+				plaintext, err := k.Open(v)
+				if err != nil {
+					return fmt.Errorf("open record %s: %s", key, err)
+				}
+				sealed, err := k.Seal(plaintext)
+				if err != nil {
+					return err
+				}
+				rewritten = append(rewritten, record{last, sealed})
+			}
+			// values are written after the cursor is done, because
+			// modifying a bucket invalidates its cursors.
+			for _, r := range rewritten {
+				if err := bkt.Put(r.k, r.v); err != nil {
+					return err
+				}
+			}
+			result.Reencrypted += len(rewritten)
+			return nil
+		})
+		if err != nil || last == nil {
+			return result, err
+		}
+		after = last
+	}
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -10,10 +11,43 @@ import (
 	"github.com/micromdm/command/internal/commandproto"
 )
 
+// CurrentSchemaVersion is the schema version of the events serialized by
+// MarshalEvent. Events archived before the schema was versioned have
+// version 0. Archived events are upgraded with the migrate package.
+const CurrentSchemaVersion = 1
+
 type Event struct {
-	ID      string
-	Time    time.Time
-	Payload mdm.Payload
+	ID      string      `json:"id"`
+	Time    time.Time   `json:"time"`
+	Payload mdm.Payload `json:"payload"`
+
+	// UDID of the device the command is for.
+	UDID string `json:"udid,omitempty"`
+
+	// Origin records who requested the command.
+	Origin Origin `json:"origin"`
+
+	// ProfileIdentifier is the PayloadIdentifier of the profile
+	// installed by an InstallProfile command.
+	ProfileIdentifier string `json:"profile_identifier,omitempty"`
+
+	// Priority and DependsOn order the commands of a device.
+	Priority  int      `json:"priority,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// CorrelationID traces the command from the HTTP request which
+	// created it to the consumers of the event.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// TraceParent and TraceState are the W3C trace context of the span
+	// which created the command. See tracing.Extract.
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+
+	// ArchiveKey is the key the event is archived under, set by the
+	// archive. It orders events which were created in the same
+	// nanosecond, and is not serialized.
+	ArchiveKey []byte `json:"-"`
 }
 
 // NewEvent returns an Event with a unique ID and the current time.
@@ -47,9 +81,24 @@ func MarshalEvent(e *Event) ([]byte, error) {
 		}
 	}
 	return proto.Marshal(&commandproto.Event{
-		Id:      e.ID,
-		Time:    e.Time.UnixNano(),
-		Payload: payload,
+		SchemaVersion:     CurrentSchemaVersion,
+		Id:                e.ID,
+		Time:              e.Time.UnixNano(),
+		Payload:           payload,
+		ProfileIdentifier: e.ProfileIdentifier,
+		Udid:              e.UDID,
+		Priority:          int32(e.Priority),
+		DependsOn:         e.DependsOn,
+		CorrelationId:     e.CorrelationID,
+		Traceparent:       e.TraceParent,
+		Tracestate:        e.TraceState,
+		Origin: &commandproto.Origin{
+			Caller:    e.Origin.Caller,
+			SourceIp:  e.Origin.SourceIP,
+			UserAgent: e.Origin.UserAgent,
+			RequestId: e.Origin.RequestID,
+			Approver:  e.Origin.Approver,
+		},
 	})
 
 }
@@ -61,8 +110,27 @@ func UnmarshalEvent(data []byte, e *Event) error {
 	if err := proto.Unmarshal(data, &pb); err != nil {
 		return err
 	}
+	if pb.SchemaVersion > CurrentSchemaVersion {
+		return fmt.Errorf("unsupported event schema version %d, want at most %d", pb.SchemaVersion, CurrentSchemaVersion)
+	}
 	e.ID = pb.Id
 	e.Time = time.Unix(0, pb.Time).UTC()
+	e.ProfileIdentifier = pb.ProfileIdentifier
+	e.UDID = pb.Udid
+	e.Priority = int(pb.Priority)
+	e.DependsOn = pb.DependsOn
+	e.CorrelationID = pb.CorrelationId
+	e.TraceParent = pb.Traceparent
+	e.TraceState = pb.Tracestate
+	if pb.Origin != nil {
+		e.Origin = Origin{
+			Caller:    pb.Origin.Caller,
+			SourceIP:  pb.Origin.SourceIp,
+			UserAgent: pb.Origin.UserAgent,
+			RequestID: pb.Origin.RequestId,
+			Approver:  pb.Origin.Approver,
+		}
+	}
 	if pb.Payload == nil {
 		return nil
 	}
@@ -87,3 +155,12 @@ func UnmarshalEvent(data []byte, e *Event) error {
 	}
 	return nil
 }
+
+// EventSchemaVersion returns the schema version of a serialized event.
+func EventSchemaVersion(data []byte) (int, error) {
+	var pb commandproto.Event
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return 0, err
+	}
+	return int(pb.SchemaVersion), nil
+}
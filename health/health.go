@@ -0,0 +1,151 @@
+// Package health reports whether commandsvc and its dependencies are
+// healthy.
+//
+// A Handler runs a set of named checks and reports the status of each
+// component as JSON. commandsvc serves two handlers: /healthz checks that
+// the process can make progress, and /readyz also checks the dependencies
+// which are needed to serve requests, so that orchestrators can hold back
+// traffic until nsqd is reachable.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+// Bucket is the *bolt.DB bucket written by the BoltWritable check.
+const Bucket = "mdm.Command.HEALTH"
+
+// DefaultTimeout is the time a check may take before it fails.
+const DefaultTimeout = 2 * time.Second
+
+// Statuses of a component and of a Handler.
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+)
+
+// Check is a named health check of a component.
+type Check struct {
+	Name  string
+	Check func(context.Context) error
+}
+
+// Component is the status of a component.
+type Component struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Took   string `json:"took"`
+}
+
+// Report is the response of a Handler.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+}
+
+// Handler responds with the Report of its checks. The status code is 200
+// if all checks pass, and 503 otherwise.
+type Handler struct {
+	// Timeout is the time each check may take. Checks which take longer
+	// fail, but are not interrupted.
+	Timeout time.Duration
+
+	checks []Check
+}
+
+// NewHandler creates a Handler which runs the checks.
+func NewHandler(checks ...Check) *Handler {
+	return &Handler{Timeout: DefaultTimeout, checks: checks}
+}
+
+// Run runs the checks concurrently and returns the report.
+func (h *Handler) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	report := Report{Status: StatusOK, Components: make(map[string]Component)}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c Check) {
+			defer wg.Done()
+			begin := time.Now()
+			err := run(ctx, c)
+			component := Component{Status: StatusOK, Took: time.Since(begin).String()}
+			if err != nil {
+				component.Status = StatusUnavailable
+				component.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[c.Name] = component
+			if err != nil {
+				report.Status = StatusUnavailable
+			}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+// run returns the result of the check, or the context error if the check
+// does not finish in time.
+func run(ctx context.Context, c Check) error {
+	errc := make(chan error, 1)
+	go func() { errc <- c.Check(ctx) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("check timed out: %s", ctx.Err())
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := h.Run(r.Context())
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// BoltWritable checks that a write transaction can be committed to the
+// database. The time of the check is written to the health Bucket.
+func BoltWritable(db *bolt.DB) func(context.Context) error {
+	return func(context.Context) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			bkt, err := tx.CreateBucketIfNotExists([]byte(Bucket))
+			if err != nil {
+				return err
+			}
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+			return bkt.Put([]byte("checked_at"), []byte(now))
+		})
+	}
+}
+
+// Pinger is satisfied by an *nsq.Producer.
+type Pinger interface {
+	Ping() error
+}
+
+// NSQPing checks that the producer can reach nsqd.
+func NSQPing(p Pinger) func(context.Context) error {
+	return func(context.Context) error {
+		return p.Ping()
+	}
+}
@@ -0,0 +1,91 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/net/context"
+)
+
+func TestHandler(t *testing.T) {
+	db := setupDB(t)
+	pinger := &mockPinger{}
+	h := NewHandler(
+		Check{Name: "bolt", Check: BoltWritable(db)},
+		Check{Name: "nsqd", Check: NSQPing(pinger)},
+	)
+
+	report, code := serve(t, h)
+	if want, have := http.StatusOK, code; want != have {
+		t.Fatalf("want status %d, have %d", want, have)
+	}
+	if report.Status != StatusOK || len(report.Components) != 2 {
+		t.Errorf("unexpected report %#v", report)
+	}
+
+	pinger.err = errors.New("connection refused")
+	report, code = serve(t, h)
+	if want, have := http.StatusServiceUnavailable, code; want != have {
+		t.Fatalf("want status %d, have %d", want, have)
+	}
+	if want, have := StatusUnavailable, report.Status; want != have {
+		t.Errorf("want status %q, have %q", want, have)
+	}
+	if c := report.Components["nsqd"]; c.Status != StatusUnavailable || c.Error != "connection refused" {
+		t.Errorf("unexpected nsqd status %#v", c)
+	}
+	if want, have := StatusOK, report.Components["bolt"].Status; want != have {
+		t.Errorf("want bolt status %q, have %q", want, have)
+	}
+
+	db.Close()
+	report, _ = serve(t, h)
+	if want, have := StatusUnavailable, report.Components["bolt"].Status; want != have {
+		t.Errorf("want bolt status %q after close, have %q", want, have)
+	}
+}
+
+func TestHandler_timeout(t *testing.T) {
+	h := NewHandler(Check{Name: "slow", Check: func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}})
+	h.Timeout = 10 * time.Millisecond
+	report := h.Run(context.Background())
+	if want, have := StatusUnavailable, report.Components["slow"].Status; want != have {
+		t.Errorf("want status %q, have %q", want, have)
+	}
+}
+
+func serve(t *testing.T, h http.Handler) (Report, int) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return report, rec.Code
+}
+
+type mockPinger struct{ err error }
+
+func (p *mockPinger) Ping() error { return p.err }
+
+func setupDB(t *testing.T) *bolt.DB {
+	f, _ := ioutil.TempFile("", "bolt-")
+	f.Close()
+	os.Remove(f.Name())
+
+	db, err := bolt.Open(f.Name(), 0777, nil)
+	if err != nil {
+		t.Fatalf("couldn't open bolt, err %s\n", err)
+	}
+	return db
+}
@@ -1,3 +1,8 @@
 package commandproto
 
+// command.pb.go is generated with the protoc-gen-go of the golang/protobuf
+// revision the package was first generated with:
+//
+//	go install github.com/golang/protobuf/protoc-gen-go@v0.0.0-20161109072736-4bd1920723d7
+//
 //go:generate protoc --go_out=. command.proto
@@ -10,6 +10,7 @@ It is generated from these files:
 
 It has these top-level messages:
 	Event
+	Origin
 	Payload
 	Command
 	DeviceInformation
@@ -33,9 +34,18 @@ var _ = math.Inf
 const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 
 type Event struct {
-	Id      string   `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
-	Time    int64    `protobuf:"varint,2,opt,name=time" json:"time,omitempty"`
-	Payload *Payload `protobuf:"bytes,3,opt,name=payload" json:"payload,omitempty"`
+	Id                string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Time              int64    `protobuf:"varint,2,opt,name=time,proto3" json:"time,omitempty"`
+	Payload           *Payload `protobuf:"bytes,3,opt,name=payload" json:"payload,omitempty"`
+	ProfileIdentifier string   `protobuf:"bytes,4,opt,name=profile_identifier,json=profileIdentifier,proto3" json:"profile_identifier,omitempty"`
+	Origin            *Origin  `protobuf:"bytes,5,opt,name=origin" json:"origin,omitempty"`
+	Udid              string   `protobuf:"bytes,6,opt,name=udid,proto3" json:"udid,omitempty"`
+	Priority          int32    `protobuf:"varint,7,opt,name=priority,proto3" json:"priority,omitempty"`
+	DependsOn         []string `protobuf:"bytes,8,rep,name=depends_on,json=dependsOn" json:"depends_on,omitempty"`
+	SchemaVersion     uint32   `protobuf:"varint,9,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+	CorrelationId     string   `protobuf:"bytes,10,opt,name=correlation_id,json=correlationId,proto3" json:"correlation_id,omitempty"`
+	Traceparent       string   `protobuf:"bytes,11,opt,name=traceparent,proto3" json:"traceparent,omitempty"`
+	Tracestate        string   `protobuf:"bytes,12,opt,name=tracestate,proto3" json:"tracestate,omitempty"`
 }
 
 func (m *Event) Reset()                    { *m = Event{} }
@@ -64,15 +74,126 @@ func (m *Event) GetPayload() *Payload {
 	return nil
 }
 
+func (m *Event) GetProfileIdentifier() string {
+	if m != nil {
+		return m.ProfileIdentifier
+	}
+	return ""
+}
+
+func (m *Event) GetOrigin() *Origin {
+	if m != nil {
+		return m.Origin
+	}
+	return nil
+}
+
+func (m *Event) GetUdid() string {
+	if m != nil {
+		return m.Udid
+	}
+	return ""
+}
+
+func (m *Event) GetPriority() int32 {
+	if m != nil {
+		return m.Priority
+	}
+	return 0
+}
+
+func (m *Event) GetDependsOn() []string {
+	if m != nil {
+		return m.DependsOn
+	}
+	return nil
+}
+
+func (m *Event) GetSchemaVersion() uint32 {
+	if m != nil {
+		return m.SchemaVersion
+	}
+	return 0
+}
+
+func (m *Event) GetCorrelationId() string {
+	if m != nil {
+		return m.CorrelationId
+	}
+	return ""
+}
+
+func (m *Event) GetTraceparent() string {
+	if m != nil {
+		return m.Traceparent
+	}
+	return ""
+}
+
+func (m *Event) GetTracestate() string {
+	if m != nil {
+		return m.Tracestate
+	}
+	return ""
+}
+
+type Origin struct {
+	Caller    string `protobuf:"bytes,1,opt,name=caller,proto3" json:"caller,omitempty"`
+	SourceIp  string `protobuf:"bytes,2,opt,name=source_ip,json=sourceIp,proto3" json:"source_ip,omitempty"`
+	UserAgent string `protobuf:"bytes,3,opt,name=user_agent,json=userAgent,proto3" json:"user_agent,omitempty"`
+	RequestId string `protobuf:"bytes,4,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Approver  string `protobuf:"bytes,5,opt,name=approver,proto3" json:"approver,omitempty"`
+}
+
+func (m *Origin) Reset()                    { *m = Origin{} }
+func (m *Origin) String() string            { return proto.CompactTextString(m) }
+func (*Origin) ProtoMessage()               {}
+func (*Origin) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+
+func (m *Origin) GetCaller() string {
+	if m != nil {
+		return m.Caller
+	}
+	return ""
+}
+
+func (m *Origin) GetSourceIp() string {
+	if m != nil {
+		return m.SourceIp
+	}
+	return ""
+}
+
+func (m *Origin) GetUserAgent() string {
+	if m != nil {
+		return m.UserAgent
+	}
+	return ""
+}
+
+func (m *Origin) GetRequestId() string {
+	if m != nil {
+		return m.RequestId
+	}
+	return ""
+}
+
+func (m *Origin) GetApprover() string {
+	if m != nil {
+		return m.Approver
+	}
+	return ""
+}
+
 type Payload struct {
-	CommandUuid string   `protobuf:"bytes,1,opt,name=command_uuid,json=commandUuid" json:"command_uuid,omitempty"`
+	CommandUuid string   `protobuf:"bytes,1,opt,name=command_uuid,json=commandUuid,proto3" json:"command_uuid,omitempty"`
 	Command     *Command `protobuf:"bytes,2,opt,name=command" json:"command,omitempty"`
 }
 
 func (m *Payload) Reset()                    { *m = Payload{} }
 func (m *Payload) String() string            { return proto.CompactTextString(m) }
 func (*Payload) ProtoMessage()               {}
-func (*Payload) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
+func (*Payload) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
 
 func (m *Payload) GetCommandUuid() string {
 	if m != nil {
@@ -89,7 +210,7 @@ func (m *Payload) GetCommand() *Command {
 }
 
 type Command struct {
-	RequestType       string             `protobuf:"bytes,1,opt,name=request_type,json=requestType" json:"request_type,omitempty"`
+	RequestType       string             `protobuf:"bytes,1,opt,name=request_type,json=requestType,proto3" json:"request_type,omitempty"`
 	DeviceInformation *DeviceInformation `protobuf:"bytes,2,opt,name=device_information,json=deviceInformation" json:"device_information,omitempty"`
 	InstallProfile    *InstallProfile    `protobuf:"bytes,3,opt,name=install_profile,json=installProfile" json:"install_profile,omitempty"`
 }
@@ -97,7 +218,7 @@ type Command struct {
 func (m *Command) Reset()                    { *m = Command{} }
 func (m *Command) String() string            { return proto.CompactTextString(m) }
 func (*Command) ProtoMessage()               {}
-func (*Command) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+func (*Command) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
 func (m *Command) GetRequestType() string {
 	if m != nil {
@@ -127,7 +248,7 @@ type DeviceInformation struct {
 func (m *DeviceInformation) Reset()                    { *m = DeviceInformation{} }
 func (m *DeviceInformation) String() string            { return proto.CompactTextString(m) }
 func (*DeviceInformation) ProtoMessage()               {}
-func (*DeviceInformation) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*DeviceInformation) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 func (m *DeviceInformation) GetQueries() []string {
 	if m != nil {
@@ -143,7 +264,7 @@ type InstallProfile struct {
 func (m *InstallProfile) Reset()                    { *m = InstallProfile{} }
 func (m *InstallProfile) String() string            { return proto.CompactTextString(m) }
 func (*InstallProfile) ProtoMessage()               {}
-func (*InstallProfile) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+func (*InstallProfile) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
 
 func (m *InstallProfile) GetPayload() []byte {
 	if m != nil {
@@ -154,6 +275,7 @@ func (m *InstallProfile) GetPayload() []byte {
 
 func init() {
 	proto.RegisterType((*Event)(nil), "commandproto.Event")
+	proto.RegisterType((*Origin)(nil), "commandproto.Origin")
 	proto.RegisterType((*Payload)(nil), "commandproto.Payload")
 	proto.RegisterType((*Command)(nil), "commandproto.Command")
 	proto.RegisterType((*DeviceInformation)(nil), "commandproto.DeviceInformation")
@@ -163,24 +285,38 @@ func init() {
 func init() { proto.RegisterFile("command.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 290 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x64, 0x91, 0xd1, 0x4a, 0xb4, 0x40,
-	0x18, 0x86, 0x19, 0xfd, 0xff, 0x64, 0xbf, 0xdd, 0x8c, 0x1d, 0x08, 0x3c, 0x08, 0x32, 0x8f, 0x24,
-	0xc8, 0xa0, 0x2e, 0xa1, 0xf6, 0x60, 0x4f, 0x62, 0x19, 0xea, 0xac, 0x10, 0xdb, 0xf9, 0x16, 0x3e,
-	0x50, 0xc7, 0xd5, 0x71, 0xc1, 0xeb, 0xeb, 0xc6, 0x42, 0x9d, 0xd9, 0xb2, 0x3d, 0xf3, 0x7d, 0x7d,
-	0x78, 0x5e, 0x9d, 0x81, 0xf3, 0xad, 0x2a, 0x8a, 0xac, 0x94, 0x49, 0x55, 0x2b, 0xad, 0xf8, 0xc2,
-	0xc4, 0x21, 0x45, 0xef, 0xf0, 0x7f, 0x75, 0xc0, 0x52, 0x73, 0x1f, 0x1c, 0x92, 0x01, 0x0b, 0x59,
-	0x3c, 0x13, 0x0e, 0x49, 0xce, 0xe1, 0x9f, 0xa6, 0x02, 0x03, 0x27, 0x64, 0xb1, 0x2b, 0x86, 0x67,
-	0x7e, 0x0f, 0x5e, 0x95, 0x75, 0xb9, 0xca, 0x64, 0xe0, 0x86, 0x2c, 0x9e, 0x3f, 0x5c, 0x26, 0xbf,
-	0x65, 0xc9, 0x66, 0x7c, 0x29, 0x2c, 0x15, 0x7d, 0x80, 0x67, 0x3a, 0x7e, 0x03, 0x76, 0x38, 0x6d,
-	0xdb, 0xe3, 0xd2, 0xdc, 0x74, 0x6f, 0x2d, 0xc9, 0x5e, 0x6f, 0xe2, 0xb0, 0x7a, 0xa2, 0x7f, 0x1a,
-	0x83, 0xb0, 0x54, 0xf4, 0xc5, 0xc0, 0x33, 0x65, 0xef, 0xaf, 0x71, 0xdf, 0x62, 0xa3, 0x53, 0xdd,
-	0x55, 0x68, 0xfd, 0xa6, 0x7b, 0xed, 0x2a, 0xe4, 0x2f, 0xc0, 0x25, 0x1e, 0x68, 0x8b, 0x29, 0x95,
-	0x3b, 0x55, 0x17, 0x99, 0x26, 0x55, 0x9a, 0xa9, 0xeb, 0xe9, 0xd4, 0xf3, 0xc0, 0xad, 0x7f, 0x30,
-	0xb1, 0x94, 0x7f, 0x2b, 0xbe, 0x82, 0x0b, 0x2a, 0x1b, 0x9d, 0xe5, 0x79, 0x5a, 0xd5, 0x6a, 0x47,
-	0x39, 0x9a, 0x63, 0xb9, 0x9a, 0xca, 0xd6, 0x23, 0xb4, 0x19, 0x19, 0xe1, 0xd3, 0x24, 0x47, 0x77,
-	0xb0, 0x3c, 0x99, 0xe3, 0x01, 0x78, 0xfb, 0x16, 0x6b, 0xc2, 0x26, 0x60, 0xa1, 0x1b, 0xcf, 0x84,
-	0x8d, 0xd1, 0x2d, 0xf8, 0x53, 0x61, 0xcf, 0xda, 0x6b, 0xe9, 0xff, 0x7a, 0x71, 0x3c, 0xff, 0xcf,
-	0xb3, 0xe1, 0x03, 0x1e, 0xbf, 0x03, 0x00, 0x00, 0xff, 0xff, 0x08, 0xd9, 0xa1, 0xac, 0x03, 0x02,
-	0x00, 0x00,
+	// 518 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x53, 0xdd, 0x8e, 0xd3, 0x3c,
+	0x10, 0x55, 0xda, 0xdd, 0x76, 0x33, 0xfd, 0xf9, 0x54, 0xeb, 0x03, 0x59, 0xfc, 0x86, 0x48, 0x48,
+	0x11, 0x62, 0x8b, 0x04, 0x4f, 0x80, 0x60, 0x2f, 0x72, 0xc3, 0xae, 0x2c, 0xe0, 0x0e, 0x45, 0x26,
+	0x9e, 0x2e, 0x96, 0x52, 0xdb, 0xeb, 0x38, 0x95, 0xfa, 0x24, 0xf0, 0x3e, 0xbc, 0x18, 0xb2, 0xe3,
+	0x94, 0x16, 0xb8, 0xcb, 0x39, 0x73, 0x74, 0x66, 0x26, 0x73, 0x0c, 0x8b, 0x5a, 0x6f, 0xb7, 0x5c,
+	0x89, 0xb5, 0xb1, 0xda, 0x69, 0x32, 0x8f, 0x30, 0xa0, 0xfc, 0xc7, 0x18, 0xce, 0xaf, 0x76, 0xa8,
+	0x1c, 0x59, 0xc2, 0x48, 0x0a, 0x9a, 0x64, 0x49, 0x91, 0xb2, 0x91, 0x14, 0x84, 0xc0, 0x99, 0x93,
+	0x5b, 0xa4, 0xa3, 0x2c, 0x29, 0xc6, 0x2c, 0x7c, 0x93, 0x57, 0x30, 0x35, 0x7c, 0xdf, 0x68, 0x2e,
+	0xe8, 0x38, 0x4b, 0x8a, 0xd9, 0xeb, 0x7b, 0xeb, 0x63, 0xb7, 0xf5, 0x4d, 0x5f, 0x64, 0x83, 0x8a,
+	0x5c, 0x02, 0x31, 0x56, 0x6f, 0x64, 0x83, 0x95, 0x14, 0xa8, 0x9c, 0xdc, 0x48, 0xb4, 0xf4, 0x2c,
+	0x34, 0x59, 0xc5, 0x4a, 0x79, 0x28, 0x90, 0x97, 0x30, 0xd1, 0x56, 0xde, 0x4a, 0x45, 0xcf, 0x83,
+	0xfd, 0xff, 0xa7, 0xf6, 0xd7, 0xa1, 0xc6, 0xa2, 0xc6, 0x4f, 0xd8, 0x09, 0x29, 0xe8, 0x24, 0xd8,
+	0x85, 0x6f, 0xf2, 0x00, 0x2e, 0x8c, 0x95, 0xda, 0x4a, 0xb7, 0xa7, 0xd3, 0x2c, 0x29, 0xce, 0xd9,
+	0x01, 0x93, 0xc7, 0x00, 0x02, 0x0d, 0x2a, 0xd1, 0x56, 0x5a, 0xd1, 0x8b, 0x6c, 0x5c, 0xa4, 0x2c,
+	0x8d, 0xcc, 0xb5, 0x22, 0xcf, 0x61, 0xd9, 0xd6, 0xdf, 0x70, 0xcb, 0xab, 0x1d, 0xda, 0x56, 0x6a,
+	0x45, 0xd3, 0x2c, 0x29, 0x16, 0x6c, 0xd1, 0xb3, 0x9f, 0x7b, 0xd2, 0xcb, 0x6a, 0x6d, 0x2d, 0x36,
+	0xdc, 0x49, 0xad, 0x2a, 0x29, 0x28, 0x84, 0xfe, 0x8b, 0x23, 0xb6, 0x14, 0x24, 0x83, 0x99, 0xb3,
+	0xbc, 0x46, 0xc3, 0x2d, 0x2a, 0x47, 0x67, 0x41, 0x73, 0x4c, 0x91, 0x27, 0x00, 0x01, 0xb6, 0x8e,
+	0x3b, 0xa4, 0xf3, 0x20, 0x38, 0x62, 0xf2, 0xef, 0x09, 0x4c, 0xfa, 0x8d, 0xc9, 0x7d, 0x98, 0xd4,
+	0xbc, 0x69, 0xd0, 0xc6, 0xfb, 0x44, 0x44, 0x1e, 0x42, 0xda, 0xea, 0xce, 0xd6, 0x58, 0x49, 0x13,
+	0x0e, 0x95, 0xb2, 0x8b, 0x9e, 0x28, 0x8d, 0x5f, 0xb7, 0x6b, 0xd1, 0x56, 0xfc, 0xd6, 0x0f, 0x30,
+	0x0e, 0xd5, 0xd4, 0x33, 0x6f, 0x3d, 0xe1, 0xcb, 0x16, 0xef, 0x3a, 0x6c, 0x9d, 0xdf, 0xa1, 0x3f,
+	0x49, 0x1a, 0x99, 0x32, 0xfc, 0x48, 0x6e, 0x8c, 0xd5, 0x3b, 0xb4, 0xe1, 0x18, 0x29, 0x3b, 0xe0,
+	0xfc, 0x0b, 0x4c, 0xe3, 0xa5, 0xc9, 0x33, 0x18, 0xf2, 0x54, 0x75, 0xdd, 0x21, 0x3f, 0xb3, 0xc8,
+	0x7d, 0xea, 0xa4, 0xf0, 0xa1, 0x89, 0x90, 0x8e, 0xfe, 0x15, 0x9a, 0x77, 0x3d, 0x60, 0x83, 0x2a,
+	0xff, 0x99, 0xc0, 0x34, 0x92, 0xde, 0x7f, 0x98, 0xd2, 0xed, 0x0d, 0x0e, 0xfe, 0x91, 0xfb, 0xb8,
+	0x37, 0x48, 0x3e, 0x00, 0x11, 0xb8, 0x93, 0xfe, 0x27, 0xa8, 0x8d, 0xb6, 0xdb, 0x70, 0x81, 0xd8,
+	0xea, 0xe9, 0x69, 0xab, 0xf7, 0x41, 0x57, 0xfe, 0x96, 0xb1, 0x95, 0xf8, 0x93, 0x22, 0x57, 0xf0,
+	0x9f, 0x54, 0xad, 0xe3, 0x4d, 0x53, 0xc5, 0x84, 0xc6, 0xb0, 0x3f, 0x3a, 0x35, 0x2b, 0x7b, 0xd1,
+	0x4d, 0xaf, 0x61, 0x4b, 0x79, 0x82, 0xf3, 0x4b, 0x58, 0xfd, 0xd5, 0x8e, 0x50, 0x98, 0xde, 0x75,
+	0x68, 0x25, 0xb6, 0x34, 0x09, 0xf9, 0x1b, 0x60, 0xfe, 0x02, 0x96, 0xa7, 0x86, 0x5e, 0x3b, 0x3c,
+	0x36, 0xbf, 0xf5, 0xfc, 0xf0, 0xaa, 0xbe, 0x4e, 0xc2, 0x00, 0x6f, 0x7e, 0x0d, 0x00, 0x04, 0x7f,
+	0xfc, 0x84, 0xda, 0x03, 0x00, 0x00,
 }
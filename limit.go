@@ -0,0 +1,102 @@
+package command
+
+import (
+	"fmt"
+	"io"
+)
+
+// DefaultMaxBodySize is the maximum size in bytes of a request body
+// when no other limit is configured.
+const DefaultMaxBodySize = 10000
+
+// RouteNewCommand is the name of the route of command requests in
+// BodyLimits.Routes.
+const RouteNewCommand = "NewCommand"
+
+// BodyLimits configures the maximum size of HTTP request bodies.
+// A zero BodyLimits uses DefaultMaxBodySize for every request.
+type BodyLimits struct {
+	// MaxBodySize is the limit in bytes for routes without an override.
+	MaxBodySize int64
+
+	// Routes overrides MaxBodySize for a route. The key is the name
+	// of the endpoint, for example RouteNewCommand or approval.RouteApprove.
+	Routes map[string]int64
+
+	// RequestTypes overrides the route limit for an MDM RequestType,
+	// for example "InstallProfile".
+	RequestTypes map[string]int64
+}
+
+// route returns the body size limit for the named route.
+func (l BodyLimits) route(name string) int64 {
+	if n, ok := l.Routes[name]; ok && n > 0 {
+		return n
+	}
+	if l.MaxBodySize > 0 {
+		return l.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// requestType returns the body size limit for an MDM RequestType on
+// the named route.
+func (l BodyLimits) requestType(route, requestType string) int64 {
+	if n, ok := l.RequestTypes[requestType]; ok && n > 0 {
+		return n
+	}
+	return l.route(route)
+}
+
+// Reader returns a reader of the body of a request to the named route,
+// which fails once the body exceeds the limit of the route. EncodeError
+// responds to the error with 413 Request Entity Too Large.
+func (l BodyLimits) Reader(route string, body io.Reader) io.Reader {
+	return &limitedReader{r: body, limit: l.route(route)}
+}
+
+// max returns the largest limit that applies to the named route.
+// The request type is not known until the body is decoded, so the
+// body is read up to this limit before checking the request type.
+func (l BodyLimits) max(route string) int64 {
+	max := l.route(route)
+	for _, n := range l.RequestTypes {
+		if n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// bodyTooLargeError is returned when a request body exceeds the configured limit.
+type bodyTooLargeError struct {
+	limit int64
+}
+
+func (e bodyTooLargeError) Error() string {
+	return fmt.Sprintf("request body exceeds the limit of %d bytes", e.limit)
+}
+
+// limitedReader reads from r until more than limit bytes are read, and then
+// returns a bodyTooLargeError. Unlike io.LimitReader, an oversized body
+// is reported as an error instead of being silently truncated.
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.read > l.limit {
+		return 0, bodyTooLargeError{l.limit}
+	}
+	if remaining := l.limit - l.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, bodyTooLargeError{l.limit}
+	}
+	return n, err
+}
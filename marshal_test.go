@@ -1,10 +1,13 @@
 package command_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/groob/plist"
 	"github.com/micromdm/command"
@@ -17,6 +20,83 @@ var marshalTests = []string{
 	"InstallProfile",
 }
 
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenIDs are the event IDs of the golden files.
+var goldenIDs = map[string]string{
+	"DeviceInformation":               "d9b1e2a4-2f1c-4f0e-9a53-0c4c3c2c6a01",
+	"DeviceInformation_empty_queries": "d9b1e2a4-2f1c-4f0e-9a53-0c4c3c2c6a02",
+	"InstallProfile":                  "d9b1e2a4-2f1c-4f0e-9a53-0c4c3c2c6a03",
+}
+
+// TestMarshalEvent_golden compares serialized events with the golden files
+// of the current schema version. Run with -update after a schema change,
+// and add a migration if older events need to be upgraded.
+func TestMarshalEvent_golden(t *testing.T) {
+	for _, name := range marshalTests {
+		t.Run(name, func(t *testing.T) {
+			event := goldenEvent(t, name)
+			have, err := command.MarshalEvent(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := "testdata/" + name + ".golden"
+			if *update {
+				if err := ioutil.WriteFile(golden, have, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, have) {
+				t.Errorf("serialized event does not match %s, run go test -update if the schema changed", golden)
+			}
+			if version, err := command.EventSchemaVersion(want); err != nil || version != command.CurrentSchemaVersion {
+				t.Errorf("want schema version %d, have %d (%v)", command.CurrentSchemaVersion, version, err)
+			}
+		})
+	}
+}
+
+// TestUnmarshalEvent_legacy checks that events archived before the schema
+// was versioned can still be read. The v0 golden files were written by the
+// MarshalEvent of the first release, which only encoded the ID, time and
+// payload of an event. Once read, they are written in the current schema.
+func TestUnmarshalEvent_legacy(t *testing.T) {
+	for _, name := range marshalTests {
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile("testdata/" + name + ".v0.golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, err := command.EventSchemaVersion(data); err != nil || version != 0 {
+				t.Fatalf("want schema version 0, have %d (%v)", version, err)
+			}
+			var have command.Event
+			if err := command.UnmarshalEvent(data, &have); err != nil {
+				t.Fatal(err)
+			}
+			if want := goldenEvent(t, name); !reflect.DeepEqual(want, &have) {
+				t.Fatalf("\nwant: %#v\n \nhave: %#v\n", want, have)
+			}
+
+			upgraded, err := command.MarshalEvent(&have)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := ioutil.ReadFile("testdata/" + name + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(want, upgraded) {
+				t.Errorf("upgraded event does not match testdata/%s.golden", name)
+			}
+		})
+	}
+}
+
 func TestMarshalEvent(t *testing.T) {
 	for _, tt := range marshalTests {
 		name := tt
@@ -36,6 +116,22 @@ func TestMarshalEvent(t *testing.T) {
 	}
 }
 
+func TestMarshalEvent_scheduling(t *testing.T) {
+	v := command.NewEvent(mustLoadPayload(t, "DeviceInformation"))
+	v.Priority = command.PriorityHigh
+	v.DependsOn = []string{"a00258bc-b1d5-4c7e-addb-9c2215eb9c0f"}
+	v.CorrelationID = "6c3b1e0e-3f0d-4b8e-9d2a-6f1f0c1b2a3d"
+	v.TraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var other command.Event
+	if buf, err := command.MarshalEvent(v); err != nil {
+		t.Fatal(err)
+	} else if err := command.UnmarshalEvent(buf, &other); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(v, &other) {
+		t.Fatalf("\nwant: %#v\n \nhave: %#v\n", v, other)
+	}
+}
+
 func BenchmarkMarshalProto(b *testing.B) {
 	for _, tt := range marshalTests {
 		v := command.NewEvent(mustLoadPayload(&testing.T{}, tt))
@@ -68,6 +164,14 @@ func BenchmarkMarshalJSON(b *testing.B) {
 	}
 }
 
+func goldenEvent(t *testing.T, name string) *command.Event {
+	return &command.Event{
+		ID:      goldenIDs[name],
+		Time:    time.Date(2016, 11, 30, 1, 21, 33, 0, time.UTC),
+		Payload: mustLoadPayload(t, name),
+	}
+}
+
 func mustLoadPayload(t *testing.T, name string) mdm.Payload {
 	var payload mdm.Payload
 	data, err := ioutil.ReadFile("testdata/" + name + ".plist")
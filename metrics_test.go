@@ -0,0 +1,99 @@
+package command
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command/service/mock"
+)
+
+type outcomeError string
+
+func (e outcomeError) Error() string   { return string(e) }
+func (e outcomeError) Outcome() string { return string(e) }
+
+type pendingError struct{}
+
+func (pendingError) Error() string      { return "pending" }
+func (pendingError) ApprovalID() string { return "foo" }
+
+func TestErrorOutcome(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, OutcomeSuccess},
+		{outcomeError(OutcomePublishError), OutcomePublishError},
+		{pendingError{}, OutcomePending},
+		{schedulingError("bad priority"), OutcomeValidationError},
+		{errEmptyRequest, OutcomeValidationError},
+		{errors.New("failed"), OutcomeError},
+	}
+	for _, tt := range tests {
+		if have := ErrorOutcome(tt.err); tt.want != have {
+			t.Errorf("%v: want outcome %q, have %q", tt.err, tt.want, have)
+		}
+	}
+}
+
+func TestServiceInstrumentingMiddleware(t *testing.T) {
+	requests := newLabeledCounter()
+	next := &mock.CommandService{NewCommandFunc: mock.ReturnMockPayload}
+	svc := ServiceInstrumentingMiddleware(requests, discard.NewHistogram())(next)
+
+	svc.NewCommand(context.Background(), &mdm.CommandRequest{RequestType: "DeviceInformation"})
+	svc.NewCommand(context.Background(), &mdm.CommandRequest{RequestType: "DeviceInformation"})
+	next.NewCommandFunc = func(context.Context, *mdm.CommandRequest) (*mdm.Payload, error) {
+		return nil, outcomeError(OutcomeArchiveError)
+	}
+	svc.NewCommand(context.Background(), &mdm.CommandRequest{RequestType: "EraseDevice"})
+
+	want := map[string]float64{
+		"request_type=DeviceInformation,outcome=success": 2,
+		"request_type=EraseDevice,outcome=archive_error": 1,
+	}
+	for labels, n := range want {
+		if have := requests.values[labels]; n != have {
+			t.Errorf("%s: want %v, have %v", labels, n, have)
+		}
+	}
+	if want, have := len(want), len(requests.values); want != have {
+		t.Errorf("want %d label sets, have %d: %v", want, have, requests.values)
+	}
+}
+
+// labeledCounter records the value of a counter by label values.
+type labeledCounter struct {
+	mu     *sync.Mutex
+	labels []string
+	values map[string]float64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{mu: new(sync.Mutex), values: make(map[string]float64)}
+}
+
+func (c *labeledCounter) With(labelValues ...string) metrics.Counter {
+	return &labeledCounter{
+		mu:     c.mu,
+		labels: append(append([]string{}, c.labels...), labelValues...),
+		values: c.values,
+	}
+}
+
+func (c *labeledCounter) Add(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var pairs []string
+	for i := 0; i+1 < len(c.labels); i += 2 {
+		pairs = append(pairs, c.labels[i]+"="+c.labels[i+1])
+	}
+	c.values[strings.Join(pairs, ",")] += delta
+}
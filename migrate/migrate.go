@@ -0,0 +1,205 @@
+// Package migrate upgrades archived events to the current schema version.
+//
+// Events are stored as serialized commandproto.Event messages. A
+// Migration upgrades a message from the previous schema version, and the
+// Migrator applies the migrations to every archived event in place, in
+// batches of BoltDB transactions.
+package migrate
+
+import (
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/envelope"
+	"github.com/micromdm/command/internal/commandproto"
+)
+
+// DefaultBatchSize is the number of events migrated in one transaction.
+const DefaultBatchSize = 500
+
+// Migration upgrades an event from schema version Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(*commandproto.Event) error
+}
+
+// Result summarizes a migration run.
+type Result struct {
+	// Scanned is the number of events read.
+	Scanned int
+	// Migrated is the number of events which were upgraded.
+	Migrated int
+	// Versions counts the scanned events by their schema version before
+	// the migration.
+	Versions map[int]int
+}
+
+// Migrator upgrades the events archived in a bucket.
+type Migrator struct {
+	db     *bolt.DB
+	bucket string
+
+	// BatchSize is the number of events migrated in one transaction.
+	BatchSize int
+
+	// DryRun reports the events which need to be migrated without
+	// writing them.
+	DryRun bool
+
+	// Migrations are applied in order of their version. Defaults to
+	// the migrations of this package.
+	Migrations []Migration
+
+	// Keyring opens encrypted events, and seals the migrated events with
+	// its primary key. Required if the archive is encrypted.
+	Keyring *envelope.Keyring
+
+	Logger log.Logger
+}
+
+// NewMigrator creates a Migrator for the events archived in bucket.
+func NewMigrator(db *bolt.DB, bucket string) *Migrator {
+	return &Migrator{
+		db:         db,
+		bucket:     bucket,
+		BatchSize:  DefaultBatchSize,
+		Migrations: Migrations,
+		Logger:     log.NewNopLogger(),
+	}
+}
+
+// Run migrates all events in the bucket to command.CurrentSchemaVersion.
+// Each batch is committed separately, so an interrupted run can be
+// resumed by running it again.
+func (m *Migrator) Run(ctx context.Context) (Result, error) {
+	result := Result{Versions: make(map[int]int)}
+	if err := m.validate(); err != nil {
+		return result, err
+	}
+	var after []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		default:
+		}
+		last, err := m.batch(after, &result)
+		if err != nil {
+			return result, err
+		}
+		if last == nil {
+			return result, nil
+		}
+		m.Logger.Log("msg", "migrated batch", "scanned", result.Scanned, "migrated", result.Migrated)
+		after = last
+	}
+}
+
+// batch migrates up to BatchSize events after the key, and returns the
+// last key of the batch, or nil if there are no more events.
+func (m *Migrator) batch(after []byte, result *Result) ([]byte, error) {
+	var last []byte
+	update := m.db.Update
+	if m.DryRun {
+		update = m.db.View
+	}
+	err := update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(m.bucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found", m.bucket)
+		}
+		type record struct{ k, v []byte }
+		var migrated []record
+		c := bkt.Cursor()
+		k, v := c.First()
+		if after != nil {
+			if k, v = c.Seek(after); k != nil && string(k) == string(after) {
+				k, v = c.Next()
+			}
+		}
+		for n := 0; k != nil && n < m.BatchSize; k, v = c.Next() {
+			n++
+			last = append([]byte(nil), k...)
+			result.Scanned++
+			if m.Keyring != nil {
+				var err error
+				if v, err = m.Keyring.Open(v); err != nil {
+					return fmt.Errorf("open event %s: %s", k, err)
+				}
+			}
+			var pb commandproto.Event
+			if err := proto.Unmarshal(v, &pb); err != nil {
+				return fmt.Errorf("unmarshal event %s: %s", k, err)
+			}
+			version := int(pb.SchemaVersion)
+			result.Versions[version]++
+			if version == command.CurrentSchemaVersion {
+				continue
+			}
+			if err := m.upgrade(&pb); err != nil {
+				return fmt.Errorf("migrate event %s: %s", k, err)
+			}
+			data, err := proto.Marshal(&pb)
+			if err != nil {
+				return err
+			}
+			if m.Keyring != nil {
+				if data, err = m.Keyring.Seal(data); err != nil {
+					return err
+				}
+			}
+			result.Migrated++
+			migrated = append(migrated, record{last, data})
+		}
+		if m.DryRun {
+			return nil
+		}
+		// values are written after the cursor is done, because
+		// modifying a bucket invalidates its cursors.
+		for _, r := range migrated {
+			if err := bkt.Put(r.k, r.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return last, err
+}
+
+// upgrade applies the migrations to an event.
+func (m *Migrator) upgrade(pb *commandproto.Event) error {
+	version := int(pb.SchemaVersion)
+	if version > command.CurrentSchemaVersion {
+		return fmt.Errorf("schema version %d is newer than %d", version, command.CurrentSchemaVersion)
+	}
+	for _, migration := range m.Migrations {
+		if migration.Version <= version {
+			continue
+		}
+		if err := migration.Migrate(pb); err != nil {
+			return fmt.Errorf("version %d: %s", migration.Version, err)
+		}
+		pb.SchemaVersion = uint32(migration.Version)
+	}
+	return nil
+}
+
+// validate checks that the migrations are in order and upgrade events to
+// the current schema version.
+func (m *Migrator) validate() error {
+	for i, migration := range m.Migrations {
+		if migration.Version != i+1 {
+			return fmt.Errorf("migration %d has version %d, want %d", i, migration.Version, i+1)
+		}
+	}
+	if len(m.Migrations) != command.CurrentSchemaVersion {
+		return fmt.Errorf("migrations upgrade to version %d, want %d", len(m.Migrations), command.CurrentSchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package migrate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gogo/protobuf/proto"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/internal/commandproto"
+)
+
+const testBucket = "mdm.Command.ARCHIVE"
+
+var goldenTests = []string{
+	"DeviceInformation",
+	"DeviceInformation_empty_queries",
+	"InstallProfile",
+}
+
+// TestMigrator_golden migrates the legacy golden files in testdata and
+// compares them to the golden files of the current schema version.
+func TestMigrator_golden(t *testing.T) {
+	db := setupDB(t)
+	for i, name := range goldenTests {
+		put(t, db, fmt.Sprintf("%d", i), mustReadFile(t, "../testdata/"+name+".v0.golden"))
+	}
+
+	m := NewMigrator(db, testBucket)
+	m.BatchSize = 2
+	result, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := len(goldenTests), result.Migrated; want != have {
+		t.Fatalf("want %d migrated events, have %d", want, have)
+	}
+
+	for i, name := range goldenTests {
+		migrated := get(t, db, fmt.Sprintf("%d", i))
+		if version, err := command.EventSchemaVersion(migrated); err != nil || version != command.CurrentSchemaVersion {
+			t.Errorf("%s: want schema version %d, have %d (%v)", name, command.CurrentSchemaVersion, version, err)
+		}
+		var want, have command.Event
+		if err := command.UnmarshalEvent(mustReadFile(t, "../testdata/"+name+".golden"), &want); err != nil {
+			t.Fatal(err)
+		}
+		if err := command.UnmarshalEvent(migrated, &have); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(want, have) {
+			t.Errorf("%s:\nwant: %#v\nhave: %#v", name, want, have)
+		}
+	}
+
+	// migrated events are not migrated again.
+	result, err = m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, result.Migrated; want != have {
+		t.Errorf("want %d migrated events, have %d", want, have)
+	}
+	if want, have := len(goldenTests), result.Versions[command.CurrentSchemaVersion]; want != have {
+		t.Errorf("want %d events with the current version, have %d", want, have)
+	}
+}
+
+func TestMigrator_backfillProfileIdentifier(t *testing.T) {
+	db := setupDB(t)
+	profile := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>4A5A5E4C-4B7B-4B93-8E2A-7B0E2A1F6A11</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+	<key>PayloadContent</key>
+	<array/>
+</dict>
+</plist>`)
+	data, err := proto.Marshal(&commandproto.Event{
+		Id: "foo",
+		Payload: &commandproto.Payload{
+			CommandUuid: "bar",
+			Command: &commandproto.Command{
+				RequestType:    "InstallProfile",
+				InstallProfile: &commandproto.InstallProfile{Payload: profile},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, db, "1", data)
+
+	m := NewMigrator(db, testBucket)
+	m.DryRun = true
+	result, err := m.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, result.Migrated; want != have {
+		t.Fatalf("want %d events to migrate, have %d", want, have)
+	}
+	if version, _ := command.EventSchemaVersion(get(t, db, "1")); version != 0 {
+		t.Fatal("dry run wrote the migrated event")
+	}
+
+	m.DryRun = false
+	if _, err := m.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var event command.Event
+	if err := command.UnmarshalEvent(get(t, db, "1"), &event); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "com.example.profile", event.ProfileIdentifier; want != have {
+		t.Errorf("want profile identifier %q, have %q", want, have)
+	}
+}
+
+func TestMigrator_newerVersion(t *testing.T) {
+	db := setupDB(t)
+	data, err := proto.Marshal(&commandproto.Event{Id: "foo", SchemaVersion: command.CurrentSchemaVersion + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, db, "1", data)
+	if _, err := NewMigrator(db, testBucket).Run(context.Background()); err == nil {
+		t.Fatal("want error for an event with a newer schema version")
+	}
+}
+
+func put(t *testing.T, db *bolt.DB, key string, value []byte) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(testBucket)).Put([]byte(key), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, db *bolt.DB, key string) []byte {
+	var value []byte
+	db.View(func(tx *bolt.Tx) error {
+		value = append(value, tx.Bucket([]byte(testBucket)).Get([]byte(key))...)
+		return nil
+	})
+	return value
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to open test file %q, err: %s", path, err)
+	}
+	return data
+}
+
+func setupDB(t *testing.T) *bolt.DB {
+	f, _ := ioutil.TempFile("", "bolt-")
+	f.Close()
+	os.Remove(f.Name())
+
+	db, err := bolt.Open(f.Name(), 0777, nil)
+	if err != nil {
+		t.Fatalf("couldn't open bolt, err %s\n", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(testBucket))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
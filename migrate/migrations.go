@@ -0,0 +1,36 @@
+package migrate
+
+import (
+	"github.com/micromdm/command/internal/commandproto"
+	"github.com/micromdm/command/profile"
+)
+
+// Migrations upgrade events to command.CurrentSchemaVersion. A schema
+// change which makes archived events unreadable, or which needs older
+// events to be backfilled, must increment command.CurrentSchemaVersion
+// and add a migration here.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "backfill the profile identifier of InstallProfile events",
+		Migrate:     backfillProfileIdentifier,
+	},
+}
+
+// backfillProfileIdentifier sets the profile identifier of InstallProfile
+// events which were archived before the identifier was recorded.
+func backfillProfileIdentifier(pb *commandproto.Event) error {
+	if pb.ProfileIdentifier != "" || pb.Payload == nil || pb.Payload.Command == nil {
+		return nil
+	}
+	cmd := pb.Payload.Command
+	if cmd.RequestType != "InstallProfile" || cmd.InstallProfile == nil {
+		return nil
+	}
+	// profiles which can not be inspected are archived without an
+	// identifier, as they were when the event was created.
+	if insp, err := profile.Inspect(cmd.InstallProfile.Payload); err == nil {
+		pb.ProfileIdentifier = insp.Identifier
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package command
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+)
+
+// Origin records who issued a command request and from where.
+type Origin struct {
+	// Caller is the authenticated identity of the caller.
+	Caller    string `json:"caller,omitempty"`
+	SourceIP  string `json:"source_ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Approver is the identity which approved the request, if the
+	// request type requires approval.
+	Approver string `json:"approver,omitempty"`
+}
+
+type contextKey int
+
+const (
+	originKey contextKey = iota
+	schedulingKey
+	correlationKey
+	warningsKey
+)
+
+// NewOriginContext returns a new Context carrying the Origin of a request.
+func NewOriginContext(ctx context.Context, origin Origin) context.Context {
+	return context.WithValue(ctx, originKey, origin)
+}
+
+// OriginFromContext returns the Origin stored in ctx, if any.
+func OriginFromContext(ctx context.Context) (Origin, bool) {
+	origin, ok := ctx.Value(originKey).(Origin)
+	return origin, ok
+}
+
+// IdentityFunc returns the authenticated identity of the caller of an
+// HTTP request, or an empty string if the caller is not authenticated.
+type IdentityFunc func(*http.Request) string
+
+// BasicAuth returns an IdentityFunc which authenticates callers with HTTP
+// Basic Authentication. The users map holds the password of each user,
+// and the username is used as the identity.
+func BasicAuth(users map[string]string) IdentityFunc {
+	return func(r *http.Request) string {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return ""
+		}
+		want, ok := users[username]
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+			return ""
+		}
+		return username
+	}
+}
+
+// ClientCertificate returns an IdentityFunc which authenticates callers
+// with the verified TLS client certificate of the connection. The subjects
+// map holds the identity of each certificate subject, formatted as by
+// pkix.Name.String, ex: "CN=alice,O=Example". If subjects is nil, the
+// common name of the subject is used as the identity.
+func ClientCertificate(subjects map[string]string) IdentityFunc {
+	return func(r *http.Request) string {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			return ""
+		}
+		subject := r.TLS.VerifiedChains[0][0].Subject
+		if subjects == nil {
+			return subject.CommonName
+		}
+		return subjects[subject.String()]
+	}
+}
+
+// AnyIdentity returns an IdentityFunc which returns the first identity
+// returned by the funcs, ex: to accept client certificates and passwords.
+func AnyIdentity(funcs ...IdentityFunc) IdentityFunc {
+	return func(r *http.Request) string {
+		for _, identify := range funcs {
+			if id := identify(r); id != "" {
+				return id
+			}
+		}
+		return ""
+	}
+}
+
+// RequireIdentity returns a handler which responds with 401 Unauthorized
+// to requests which are not authenticated by identify.
+func RequireIdentity(identify IdentityFunc, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identify(r) == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="commandsvc"`)
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": "authentication required",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequestIDHeader is the HTTP header which carries the request ID.
+const RequestIDHeader = "X-Request-ID"
+
+// OriginRequestFunc returns a RequestFunc which stores the Origin of the HTTP
+// request in the context. A request ID is generated if the request does not
+// have an X-Request-ID header. identify may be nil if callers are not
+// authenticated.
+func OriginRequestFunc(identify IdentityFunc) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		origin := Origin{
+			SourceIP:  sourceIP(r),
+			UserAgent: r.UserAgent(),
+			RequestID: r.Header.Get(RequestIDHeader),
+		}
+		if origin.RequestID == "" {
+			origin.RequestID = uuid.NewV4().String()
+		}
+		if identify != nil {
+			origin.Caller = identify(r)
+		}
+		return NewOriginContext(ctx, origin)
+	}
+}
+
+// SetRequestIDHeader is a ServerResponseFunc which returns the request ID
+// of the Origin in the context to the caller.
+func SetRequestIDHeader(ctx context.Context, w http.ResponseWriter) context.Context {
+	if origin, ok := OriginFromContext(ctx); ok {
+		w.Header().Set(RequestIDHeader, origin.RequestID)
+	}
+	return ctx
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,151 @@
+package command
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestOriginRequestFunc(t *testing.T) {
+	identify := BasicAuth(map[string]string{"admin": "secret"})
+
+	tests := []struct {
+		name       string
+		user, pass string
+		requestID  string
+		wantCaller string
+	}{
+		{
+			name:       "authenticated",
+			user:       "admin",
+			pass:       "secret",
+			requestID:  "req-1",
+			wantCaller: "admin",
+		},
+		{
+			name: "wrong_password",
+			user: "admin",
+			pass: "guess",
+		},
+		{
+			name: "anonymous",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/commands", nil)
+			r.RemoteAddr = "192.0.2.1:54321"
+			r.Header.Set("User-Agent", "test-agent")
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			if tt.requestID != "" {
+				r.Header.Set(RequestIDHeader, tt.requestID)
+			}
+
+			ctx := OriginRequestFunc(identify)(context.Background(), r)
+			origin, ok := OriginFromContext(ctx)
+			if !ok {
+				t.Fatal("no origin in context")
+			}
+			if want, have := tt.wantCaller, origin.Caller; want != have {
+				t.Errorf("caller: want %q, have %q", want, have)
+			}
+			if want, have := "192.0.2.1", origin.SourceIP; want != have {
+				t.Errorf("source ip: want %q, have %q", want, have)
+			}
+			if want, have := "test-agent", origin.UserAgent; want != have {
+				t.Errorf("user agent: want %q, have %q", want, have)
+			}
+			if origin.RequestID == "" {
+				t.Error("request ID was not generated")
+			}
+			if tt.requestID != "" && tt.requestID != origin.RequestID {
+				t.Errorf("request id: want %q, have %q", tt.requestID, origin.RequestID)
+			}
+
+			rec := httptest.NewRecorder()
+			RequireIdentity(identify, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})).ServeHTTP(rec, r)
+			want := http.StatusNoContent
+			if tt.wantCaller == "" {
+				want = http.StatusUnauthorized
+			}
+			if have := rec.Code; want != have {
+				t.Errorf("status: want %d, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	alice := &x509.Certificate{Subject: pkix.Name{CommonName: "alice", Organization: []string{"Example"}}}
+	verified := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		state    *tls.ConnectionState
+		subjects map[string]string
+		want     string
+	}{
+		{
+			name:  "common_name",
+			state: verified(alice),
+			want:  "alice",
+		},
+		{
+			name:     "mapped_subject",
+			state:    verified(alice),
+			subjects: map[string]string{"CN=alice,O=Example": "alice@example.com"},
+			want:     "alice@example.com",
+		},
+		{
+			name:     "unmapped_subject",
+			state:    verified(alice),
+			subjects: map[string]string{"CN=bob,O=Example": "bob@example.com"},
+		},
+		{
+			name:  "unverified",
+			state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{alice}},
+		},
+		{
+			name: "plain_http",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/v1/commands", nil)
+			r.TLS = tt.state
+			if want, have := tt.want, ClientCertificate(tt.subjects)(r); want != have {
+				t.Errorf("want identity %q, have %q", want, have)
+			}
+		})
+	}
+}
+
+func TestAnyIdentity(t *testing.T) {
+	identify := AnyIdentity(
+		ClientCertificate(nil),
+		BasicAuth(map[string]string{"admin": "secret"}),
+	)
+	r := httptest.NewRequest("POST", "/v1/commands", nil)
+	r.SetBasicAuth("admin", "secret")
+	if want, have := "admin", identify(r); want != have {
+		t.Errorf("want identity %q, have %q", want, have)
+	}
+	r.SetBasicAuth("admin", "guess")
+	if want, have := "", identify(r); want != have {
+		t.Errorf("want identity %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,206 @@
+package profile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/go-kit/kit/log"
+	"github.com/groob/plist"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// Severity of a Finding.
+type Severity string
+
+const (
+	// SeverityError findings make the profile invalid.
+	SeverityError Severity = "error"
+
+	// SeverityWarning findings are reported, but do not reject the profile.
+	SeverityWarning Severity = "warning"
+)
+
+// Finding is a problem found while inspecting a profile.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Path     string   `json:"path"`
+	Message  string   `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Path, f.Message)
+}
+
+// Inspection is the result of inspecting a configuration profile.
+type Inspection struct {
+	// Identifier is the top level PayloadIdentifier of the profile.
+	Identifier string
+
+	// UUID is the top level PayloadUUID of the profile.
+	UUID string
+
+	// Findings lists the problems found in the profile.
+	Findings []Finding
+}
+
+// Valid reports whether the profile has no error findings.
+func (i *Inspection) Valid() bool {
+	for _, f := range i.Findings {
+		if f.Severity == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+// Inspect parses the configuration profile in data and checks that it is
+// well formed. Signed profiles are inspected using their signed content.
+// An error is only returned if the data is not a plist.
+func Inspect(data []byte) (*Inspection, error) {
+	if p7, err := pkcs7.Parse(data); err == nil && len(p7.Signers) > 0 {
+		data = p7.Content
+	}
+	var top map[string]interface{}
+	if err := plist.Unmarshal(data, &top); err != nil {
+		return nil, fmt.Errorf("profile: parse profile plist: %s", err)
+	}
+	var (
+		insp  Inspection
+		uuids = make(map[string]string)
+	)
+	insp.Identifier, _ = top["PayloadIdentifier"].(string)
+	insp.UUID, _ = top["PayloadUUID"].(string)
+	insp.inspectPayload("Profile", top, uuids)
+	if t, ok := top["PayloadType"].(string); ok && t != "Configuration" {
+		insp.warn("Profile.PayloadType", "top level PayloadType is %q, expected \"Configuration\"", t)
+	}
+
+	content, ok := top["PayloadContent"]
+	if !ok {
+		insp.warn("Profile.PayloadContent", "profile has no PayloadContent")
+		return &insp, nil
+	}
+	items, ok := content.([]interface{})
+	if !ok {
+		insp.error("Profile.PayloadContent", "PayloadContent must be an array")
+		return &insp, nil
+	}
+	for i, item := range items {
+		path := fmt.Sprintf("PayloadContent[%d]", i)
+		payload, ok := item.(map[string]interface{})
+		if !ok {
+			insp.error(path, "payload must be a dictionary")
+			continue
+		}
+		insp.inspectPayload(path, payload, uuids)
+	}
+	return &insp, nil
+}
+
+// requiredKeys must be present in the profile and in every payload.
+var requiredKeys = []string{
+	"PayloadIdentifier",
+	"PayloadUUID",
+	"PayloadType",
+	"PayloadVersion",
+}
+
+func (insp *Inspection) inspectPayload(path string, payload map[string]interface{}, uuids map[string]string) {
+	for _, key := range requiredKeys {
+		v, ok := payload[key]
+		if !ok {
+			insp.error(path+"."+key, "missing required key %s", key)
+			continue
+		}
+		if key == "PayloadVersion" {
+			continue
+		}
+		if s, ok := v.(string); !ok || s == "" {
+			insp.error(path+"."+key, "%s must be a non-empty string", key)
+		}
+	}
+	uuid, ok := payload["PayloadUUID"].(string)
+	if !ok || uuid == "" {
+		return
+	}
+	key := strings.ToUpper(uuid)
+	if other, ok := uuids[key]; ok {
+		insp.error(path+".PayloadUUID", "duplicate PayloadUUID %s, also used by %s", uuid, other)
+		return
+	}
+	uuids[key] = path
+}
+
+func (insp *Inspection) error(path, format string, args ...interface{}) {
+	insp.Findings = append(insp.Findings, Finding{SeverityError, path, fmt.Sprintf(format, args...)})
+}
+
+func (insp *Inspection) warn(path, format string, args ...interface{}) {
+	insp.Findings = append(insp.Findings, Finding{SeverityWarning, path, fmt.Sprintf(format, args...)})
+}
+
+// LintError is returned when an InstallProfile request contains a
+// profile which is not well formed.
+type LintError struct {
+	Findings []Finding
+}
+
+func (e *LintError) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("profile: invalid profile")
+	for _, f := range e.Findings {
+		buf.WriteString("; ")
+		buf.WriteString(f.String())
+	}
+	return buf.String()
+}
+
+// InvalidRequest marks the error as caused by the command request, so that
+// the HTTP transport responds with 400 Bad Request.
+func (e *LintError) InvalidRequest() bool { return true }
+
+// LintMiddleware returns a service middleware which inspects the profile of
+// every InstallProfile request. Requests with error findings are rejected
+// with a *LintError listing all findings. Warnings for accepted profiles are
+// logged, and returned to the caller with command.AddWarning.
+func LintMiddleware(logger log.Logger) command.Middleware {
+	return func(next command.Service) command.Service {
+		return lintMiddleware{
+			logger: logger,
+			next:   next,
+		}
+	}
+}
+
+type lintMiddleware struct {
+	logger log.Logger
+	next   command.Service
+}
+
+func (mw lintMiddleware) NewCommand(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+	if req == nil || req.RequestType != "InstallProfile" {
+		return mw.next.NewCommand(ctx, req)
+	}
+	insp, err := Inspect(req.Payload)
+	if err != nil {
+		return nil, &LintError{Findings: []Finding{{SeverityError, "Profile", err.Error()}}}
+	}
+	if !insp.Valid() {
+		return nil, &LintError{Findings: insp.Findings}
+	}
+	for _, f := range insp.Findings {
+		mw.logger.Log(
+			"msg", "profile lint warning",
+			"profile", insp.Identifier,
+			"path", f.Path,
+			"warning", f.Message,
+		)
+		command.AddWarning(ctx, command.Warning{Path: f.Path, Message: f.Message})
+	}
+	return mw.next.NewCommand(ctx, req)
+}
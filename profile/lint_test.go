@@ -0,0 +1,175 @@
+package profile
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/service/mock"
+)
+
+func TestInspect(t *testing.T) {
+	signed, err := newTestSigner(t).Sign(testProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		profile      []byte
+		wantErr      bool
+		wantValid    bool
+		wantFindings []string
+	}{
+		{
+			name:      "valid",
+			profile:   testProfile,
+			wantValid: true,
+		},
+		{
+			name:      "signed",
+			profile:   signed,
+			wantValid: true,
+		},
+		{
+			name:    "not_a_plist",
+			profile: []byte("foobarbaz"),
+			wantErr: true,
+		},
+		{
+			name: "missing_keys",
+			profile: profilePlist(`
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadContent</key>
+	<array/>`),
+			wantFindings: []string{
+				"error: Profile.PayloadUUID: missing required key PayloadUUID",
+				"error: Profile.PayloadVersion: missing required key PayloadVersion",
+			},
+		},
+		{
+			name: "duplicate_uuid",
+			profile: profilePlist(`
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>4A5A5E4C-4B7B-4B93-8E2A-7B0E2A1F6A11</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadIdentifier</key>
+			<string>com.example.profile.wifi</string>
+			<key>PayloadType</key>
+			<string>com.apple.wifi.managed</string>
+			<key>PayloadUUID</key>
+			<string>4a5a5e4c-4b7b-4b93-8e2a-7b0e2a1f6a11</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>`),
+			wantFindings: []string{
+				"error: PayloadContent[0].PayloadUUID: duplicate PayloadUUID 4a5a5e4c-4b7b-4b93-8e2a-7b0e2a1f6a11, also used by Profile",
+			},
+		},
+		{
+			name: "warnings",
+			profile: profilePlist(`
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+	<key>PayloadType</key>
+	<string>com.apple.wifi.managed</string>
+	<key>PayloadUUID</key>
+	<string>4A5A5E4C-4B7B-4B93-8E2A-7B0E2A1F6A11</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>`),
+			wantValid: true,
+			wantFindings: []string{
+				`warning: Profile.PayloadType: top level PayloadType is "com.apple.wifi.managed", expected "Configuration"`,
+				"warning: Profile.PayloadContent: profile has no PayloadContent",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			insp, err := Inspect(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Inspect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if want, have := "com.example.profile", insp.Identifier; want != have {
+				t.Errorf("want identifier %q, have %q", want, have)
+			}
+			if want, have := tt.wantValid, insp.Valid(); want != have {
+				t.Errorf("want valid %v, have %v", want, have)
+			}
+			if want, have := len(tt.wantFindings), len(insp.Findings); want != have {
+				t.Fatalf("want %d findings, have %d: %v", want, have, insp.Findings)
+			}
+			for i, f := range insp.Findings {
+				if want, have := tt.wantFindings[i], f.String(); want != have {
+					t.Errorf("\nwant: %s\nhave: %s", want, have)
+				}
+			}
+		})
+	}
+}
+
+func TestLintMiddleware(t *testing.T) {
+	svc := &mock.CommandService{NewCommandFunc: mock.ReturnMockPayload}
+	lint := LintMiddleware(log.NewNopLogger())(svc)
+
+	_, err := lint.NewCommand(context.Background(), installProfile(profilePlist("")))
+	if _, ok := err.(*LintError); !ok {
+		t.Fatalf("want *LintError, have %v", err)
+	}
+	if svc.NewCommandInvoked {
+		t.Fatal("invalid profile was passed to the service")
+	}
+
+	if _, err := lint.NewCommand(context.Background(), installProfile(testProfile)); err != nil {
+		t.Fatal(err)
+	}
+	if !svc.NewCommandInvoked {
+		t.Fatal("valid profile was not passed to the service")
+	}
+	// warnings are returned to the caller.
+	ctx := command.NewWarningsContext(context.Background())
+	warn := profilePlist(`
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>4A5A5E4C-4B7B-4B93-8E2A-7B0E2A1F6A11</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>`)
+	if _, err := lint.NewCommand(ctx, installProfile(warn)); err != nil {
+		t.Fatal(err)
+	}
+	want := []command.Warning{{Path: "Profile.PayloadContent", Message: "profile has no PayloadContent"}}
+	if have := command.WarningsFromContext(ctx); !reflect.DeepEqual(want, have) {
+		t.Errorf("want warnings %v, have %v", want, have)
+	}
+}
+
+func profilePlist(dict string) []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>` + dict + `
+</dict>
+</plist>`)
+}
@@ -0,0 +1,157 @@
+// Package profile signs and inspects the configuration profiles
+// carried by InstallProfile commands.
+package profile
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// ErrUnsigned is returned when an unsigned profile is rejected by a strict
+// signing policy.
+var ErrUnsigned = invalidProfileError("profile: unsigned profiles are not allowed")
+
+// invalidProfileError is returned for profiles which can not be accepted.
+type invalidProfileError string
+
+func (e invalidProfileError) Error() string { return string(e) }
+
+// InvalidRequest marks the error as caused by the command request, so that
+// the HTTP transport responds with 400 Bad Request.
+func (e invalidProfileError) InvalidRequest() bool { return true }
+
+// Signer CMS-signs configuration profiles with a certificate and key.
+type Signer struct {
+	cert *x509.Certificate
+	key  crypto.PrivateKey
+}
+
+// NewSigner creates a Signer from a certificate and its private key.
+func NewSigner(cert *x509.Certificate, key crypto.PrivateKey) *Signer {
+	return &Signer{cert: cert, key: key}
+}
+
+// LoadSigner creates a Signer from PEM encoded certificate and key files.
+func LoadSigner(certPath, keyPath string) (*Signer, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("profile: no PEM certificate found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("profile: no PEM private key found in %s", keyPath)
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigner(cert, key), nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("profile: unsupported private key type")
+}
+
+// Sign returns the profile wrapped in a CMS SignedData structure.
+func (s *Signer) Sign(profile []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.AddSigner(s.cert, s.key, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+// IsSigned reports whether data is a CMS signed profile.
+func IsSigned(data []byte) bool {
+	p7, err := pkcs7.Parse(data)
+	return err == nil && len(p7.Signers) > 0
+}
+
+// SigningPolicy decides how unsigned InstallProfile payloads are handled.
+type SigningPolicy struct {
+	// Signer signs unsigned profiles. Profiles are passed through unsigned
+	// when Signer is nil and Strict is false.
+	Signer *Signer
+
+	// Strict rejects unsigned profiles with ErrUnsigned instead of
+	// signing them.
+	Strict bool
+}
+
+// SigningMiddleware returns a service middleware which applies the signing
+// policy to the payload of every InstallProfile request before the MDM
+// Payload is created. Profiles which are already signed must have a valid
+// signature.
+func SigningMiddleware(policy SigningPolicy) command.Middleware {
+	return func(next command.Service) command.Service {
+		return signingMiddleware{
+			policy: policy,
+			next:   next,
+		}
+	}
+}
+
+type signingMiddleware struct {
+	policy SigningPolicy
+	next   command.Service
+}
+
+func (mw signingMiddleware) NewCommand(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+	if req == nil || req.RequestType != "InstallProfile" || len(req.Payload) == 0 {
+		return mw.next.NewCommand(ctx, req)
+	}
+	if p7, err := pkcs7.Parse(req.Payload); err == nil && len(p7.Signers) > 0 {
+		if err := p7.Verify(); err != nil {
+			return nil, invalidProfileError(fmt.Sprintf("profile: invalid signature: %s", err))
+		}
+		return mw.next.NewCommand(ctx, req)
+	}
+	if mw.policy.Strict {
+		return nil, ErrUnsigned
+	}
+	if mw.policy.Signer == nil {
+		return mw.next.NewCommand(ctx, req)
+	}
+	signed, err := mw.policy.Signer.Sign(req.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("profile: sign profile: %s", err)
+	}
+	signedReq := *req
+	signedReq.Payload = signed
+	return mw.next.NewCommand(ctx, &signedReq)
+}
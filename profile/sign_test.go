@@ -0,0 +1,168 @@
+package profile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command/service/mock"
+)
+
+var testProfile = []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>4A5A5E4C-4B7B-4B93-8E2A-7B0E2A1F6A11</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+	<key>PayloadContent</key>
+	<array/>
+</dict>
+</plist>`)
+
+func TestSigningMiddleware(t *testing.T) {
+	signer := newTestSigner(t)
+	presigned, err := signer.Sign(testProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, presigned...)
+	if i := bytes.Index(tampered, []byte("com.example.profile")); i >= 0 {
+		tampered[i] = 'C'
+	}
+
+	tests := []struct {
+		name       string
+		policy     SigningPolicy
+		request    *mdm.CommandRequest
+		wantErr    bool
+		wantSigned bool
+	}{
+		{
+			name:       "sign_unsigned",
+			policy:     SigningPolicy{Signer: signer},
+			request:    installProfile(testProfile),
+			wantSigned: true,
+		},
+		{
+			name:       "presigned",
+			policy:     SigningPolicy{Signer: signer},
+			request:    installProfile(presigned),
+			wantSigned: true,
+		},
+		{
+			name:    "strict_unsigned",
+			policy:  SigningPolicy{Strict: true},
+			request: installProfile(testProfile),
+			wantErr: true,
+		},
+		{
+			name:       "strict_presigned",
+			policy:     SigningPolicy{Strict: true},
+			request:    installProfile(presigned),
+			wantSigned: true,
+		},
+		{
+			name:    "tampered",
+			policy:  SigningPolicy{Signer: signer},
+			request: installProfile(tampered),
+			wantErr: true,
+		},
+		{
+			name:    "no_signer",
+			policy:  SigningPolicy{},
+			request: installProfile(testProfile),
+		},
+		{
+			name:   "other_request_type",
+			policy: SigningPolicy{Strict: true},
+			request: &mdm.CommandRequest{
+				RequestType: "DeviceInformation",
+				UDID:        "some-device",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received *mdm.CommandRequest
+			svc := &mock.CommandService{
+				NewCommandFunc: func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+					received = req
+					return mock.MockPayload, nil
+				},
+			}
+			_, err := SigningMiddleware(tt.policy)(svc).NewCommand(context.Background(), tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if svc.NewCommandInvoked {
+					t.Error("rejected profile was passed to the service")
+				}
+				return
+			}
+			if have := IsSigned(received.Payload); have != tt.wantSigned {
+				t.Fatalf("want signed %v, have %v", tt.wantSigned, have)
+			}
+			if !tt.wantSigned {
+				return
+			}
+			p7, err := pkcs7.Parse(received.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p7.Verify(); err != nil {
+				t.Fatalf("verify signed profile: %s", err)
+			}
+			if !bytes.Equal(p7.Content, testProfile) {
+				t.Error("signed content does not match the original profile")
+			}
+		})
+	}
+}
+
+func installProfile(payload []byte) *mdm.CommandRequest {
+	return &mdm.CommandRequest{
+		RequestType: "InstallProfile",
+		UDID:        "some-device",
+		Payload:     payload,
+	}
+}
+
+func newTestSigner(t *testing.T) *Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "command test signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSigner(cert, key)
+}
@@ -0,0 +1,257 @@
+// Package publisher publishes events to a pool of nsqd instances, and
+// fails over to another instance when publishing fails.
+//
+// The instances are listed, or discovered through nsqlookupd. Consumers
+// which discover the same instances through nsqlookupd receive the events
+// no matter which instance they were published to.
+package publisher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+// DefaultRefreshInterval is the interval between queries of nsqlookupd
+// for new nsqd instances.
+const DefaultRefreshInterval = time.Minute
+
+// ErrNoNSQD is returned when no nsqd instance is known.
+var ErrNoNSQD = errors.New("publisher: no nsqd instances")
+
+// Config of a Pool.
+type Config struct {
+	// NSQDAddrs are the TCP addresses of nsqd instances.
+	NSQDAddrs []string
+
+	// LookupdAddrs are the HTTP addresses of nsqlookupd instances, which
+	// are queried for nsqd instances every RefreshInterval.
+	LookupdAddrs    []string
+	RefreshInterval time.Duration
+
+	// NSQ configures the producers. Defaults to nsq.NewConfig().
+	NSQ *nsq.Config
+
+	// HTTPClient queries nsqlookupd. Defaults to a client with a 5
+	// second timeout.
+	HTTPClient *http.Client
+
+	Logger log.Logger
+}
+
+// Pool publishes to one nsqd instance at a time. When publishing fails,
+// the other instances are tried in order, and the first which succeeds is
+// used from then on.
+type Pool struct {
+	cfg Config
+
+	mu        sync.RWMutex
+	producers []*producer // instances are only added, never removed
+	current   int         // index of the producer in use
+
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+type producer struct {
+	addr string
+	*nsq.Producer
+}
+
+// New creates a Pool of the nsqd instances in cfg and the instances known
+// to nsqlookupd.
+func New(cfg Config) (*Pool, error) {
+	if len(cfg.NSQDAddrs) == 0 && len(cfg.LookupdAddrs) == 0 {
+		return nil, errors.New("publisher: nsqd or nsqlookupd addresses are required")
+	}
+	if cfg.RefreshInterval <= 0 {
+		cfg.RefreshInterval = DefaultRefreshInterval
+	}
+	if cfg.NSQ == nil {
+		cfg.NSQ = nsq.NewConfig()
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+	p := &Pool{cfg: cfg, stop: make(chan struct{})}
+	if err := p.add(cfg.NSQDAddrs...); err != nil {
+		return nil, err
+	}
+	if len(cfg.LookupdAddrs) > 0 {
+		if err := p.Refresh(); err != nil && len(cfg.NSQDAddrs) == 0 {
+			p.Stop()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Publish publishes the body to the topic, on the instance in use or on
+// the first instance which succeeds.
+func (p *Pool) Publish(topic string, body []byte) error {
+	return p.do(func(w *nsq.Producer) error { return w.Publish(topic, body) })
+}
+
+// MultiPublish publishes the bodies to the topic in one round trip, on the
+// instance in use or on the first instance which succeeds.
+func (p *Pool) MultiPublish(topic string, bodies [][]byte) error {
+	return p.do(func(w *nsq.Producer) error { return w.MultiPublish(topic, bodies) })
+}
+
+// Ping checks that an nsqd instance is reachable. Ping satisfies the
+// health.Pinger interface.
+func (p *Pool) Ping() error {
+	return p.do(func(w *nsq.Producer) error { return w.Ping() })
+}
+
+// do calls fn with the producer in use, and fails over to the other
+// producers in order until fn succeeds.
+func (p *Pool) do(fn func(*nsq.Producer) error) error {
+	p.mu.RLock()
+	producers, current := p.producers, p.current
+	p.mu.RUnlock()
+	if len(producers) == 0 {
+		return ErrNoNSQD
+	}
+	var err error
+	for i := range producers {
+		w := producers[(current+i)%len(producers)]
+		if err = fn(w.Producer); err == nil {
+			if i > 0 {
+				p.mu.Lock()
+				p.current = (current + i) % len(producers)
+				p.mu.Unlock()
+				p.cfg.Logger.Log("msg", "failed over", "nsqd", w.addr)
+			}
+			return nil
+		}
+		p.cfg.Logger.Log("msg", "nsqd unavailable", "nsqd", w.addr, "err", err)
+	}
+	return err
+}
+
+// Refresh adds the nsqd instances which are known to nsqlookupd. Refresh
+// fails if no nsqlookupd instance can be queried.
+func (p *Pool) Refresh() error {
+	var addrs []string
+	var err error
+	for _, lookupd := range p.cfg.LookupdAddrs {
+		found, lookupErr := p.lookup(lookupd)
+		if lookupErr != nil {
+			err = lookupErr
+			p.cfg.Logger.Log("msg", "query nsqlookupd", "nsqlookupd", lookupd, "err", lookupErr)
+			continue
+		}
+		addrs = append(addrs, found...)
+	}
+	if addrs == nil && err != nil {
+		return err
+	}
+	return p.add(addrs...)
+}
+
+// lookup returns the TCP addresses of the nsqd instances known to an
+// nsqlookupd.
+func (p *Pool) lookup(lookupd string) ([]string, error) {
+	endpoint := lookupd
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	resp, err := p.cfg.HTTPClient.Get(strings.TrimSuffix(endpoint, "/") + "/nodes")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("publisher: nsqlookupd %s responded with %s", lookupd, resp.Status)
+	}
+	// nsqlookupd before v1.0 wraps the response in a data object.
+	var nodes struct {
+		nodesResponse
+		Data nodesResponse `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, fmt.Errorf("publisher: decode nsqlookupd %s response: %s", lookupd, err)
+	}
+	var addrs []string
+	for _, n := range append(nodes.Producers, nodes.Data.Producers...) {
+		addrs = append(addrs, net.JoinHostPort(n.BroadcastAddress, strconv.Itoa(n.TCPPort)))
+	}
+	return addrs, nil
+}
+
+type nodesResponse struct {
+	Producers []struct {
+		BroadcastAddress string `json:"broadcast_address"`
+		TCPPort          int    `json:"tcp_port"`
+	} `json:"producers"`
+}
+
+// add creates producers for the addresses which are not in the pool.
+func (p *Pool) add(addrs ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known := make(map[string]bool)
+	for _, w := range p.producers {
+		known[w.addr] = true
+	}
+	for _, addr := range addrs {
+		if known[addr] {
+			continue
+		}
+		w, err := nsq.NewProducer(addr, p.cfg.NSQ)
+		if err != nil {
+			return err
+		}
+		known[addr] = true
+		p.producers = append(p.producers, &producer{addr: addr, Producer: w})
+		p.cfg.Logger.Log("msg", "added nsqd", "nsqd", addr)
+	}
+	return nil
+}
+
+// Start queries nsqlookupd for new nsqd instances every RefreshInterval in
+// the background, if nsqlookupd addresses are configured.
+func (p *Pool) Start() {
+	if len(p.cfg.LookupdAddrs) == 0 {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.cfg.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Refresh()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops querying nsqlookupd and stops the producers.
+func (p *Pool) Stop() {
+	p.once.Do(func() { close(p.stop) })
+	p.wg.Wait()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, w := range p.producers {
+		w.Stop()
+	}
+}
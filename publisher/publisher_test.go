@@ -0,0 +1,134 @@
+package publisher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/nsqio/nsq/nsqd"
+)
+
+func TestPool_failover(t *testing.T) {
+	addr1, stop1 := setupNSQD(t)
+	addr2, stop2 := setupNSQD(t)
+	defer stop2()
+
+	pool, err := New(Config{NSQDAddrs: []string{unusedAddr(t), addr1, addr2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Stop()
+
+	if err := pool.Publish("mdm.Command", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := addr1, pool.producers[pool.current].addr; want != have {
+		t.Fatalf("want nsqd %s in use, have %s", want, have)
+	}
+
+	stop1()
+	if err := pool.Publish("mdm.Command", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := addr2, pool.producers[pool.current].addr; want != have {
+		t.Fatalf("want nsqd %s in use, have %s", want, have)
+	}
+	if err := pool.MultiPublish("mdm.Command", [][]byte{[]byte("3"), []byte("4")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.Ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop2()
+	if err := pool.Publish("mdm.Command", []byte("5")); err == nil {
+		t.Fatal("want error when no nsqd is available")
+	}
+}
+
+func TestPool_lookupd(t *testing.T) {
+	addr, stop := setupNSQD(t)
+	defer stop()
+	host, port, _ := net.SplitHostPort(addr)
+
+	responses := map[string]string{
+		"v1": `{"producers":[{"broadcast_address":%q,"tcp_port":%s}]}`,
+		"v0": `{"status_code":200,"data":{"producers":[{"broadcast_address":%q,"tcp_port":%s}]}}`,
+	}
+	for version, format := range responses {
+		t.Run(version, func(t *testing.T) {
+			lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/nodes" {
+					http.NotFound(w, r)
+					return
+				}
+				fmt.Fprintf(w, format, host, port)
+			}))
+			defer lookupd.Close()
+
+			pool, err := New(Config{LookupdAddrs: []string{lookupd.Listener.Addr().String()}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.Stop()
+			if err := pool.Publish("mdm.Command", []byte("1")); err != nil {
+				t.Fatal(err)
+			}
+
+			// known instances are not added again.
+			if err := pool.Refresh(); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := 1, len(pool.producers); want != have {
+				t.Errorf("want %d producers, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestNew_lookupdUnavailable(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Error("want error without addresses")
+	}
+	if _, err := New(Config{LookupdAddrs: []string{unusedAddr(t)}}); err == nil {
+		t.Error("want error when nsqlookupd is unavailable and no nsqd is configured")
+	}
+}
+
+// unusedAddr returns an address which refuses connections.
+func unusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// setupNSQD starts an embedded nsqd on a random port.
+func setupNSQD(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "nsqd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.DataPath = dir
+	n := nsqd.New(opts)
+	n.Main()
+	var once bool
+	return n.RealTCPAddr().String(), func() {
+		if once {
+			return
+		}
+		once = true
+		n.Exit()
+		os.RemoveAll(dir)
+	}
+}
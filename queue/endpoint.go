@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"golang.org/x/net/context"
+)
+
+type Endpoints struct {
+	NextEndpoint   endpoint.Endpoint
+	AckEndpoint    endpoint.Endpoint
+	FailEndpoint   endpoint.Endpoint
+	NotNowEndpoint endpoint.Endpoint
+}
+
+// MakeEndpoints creates the endpoints of a queue Service.
+func MakeEndpoints(svc Service) Endpoints {
+	return Endpoints{
+		NextEndpoint:   MakeNextEndpoint(svc),
+		AckEndpoint:    MakeAckEndpoint(svc),
+		FailEndpoint:   MakeFailEndpoint(svc),
+		NotNowEndpoint: MakeNotNowEndpoint(svc),
+	}
+}
+
+// MakeNextEndpoint creates an endpoint which returns the next command of
+// a device.
+func MakeNextEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(commandRequest)
+		cmd, err := svc.Next(ctx, req.UDID)
+		return nextResponse{Command: cmd, Err: err}, nil
+	}
+}
+
+// MakeAckEndpoint creates an endpoint which removes a command from the
+// queue of a device.
+func MakeAckEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(commandRequest)
+		err := svc.Ack(ctx, req.UDID, req.CommandUUID)
+		return commandResponse{Err: err}, nil
+	}
+}
+
+// MakeFailEndpoint creates an endpoint which removes a failed command and
+// its dependents from the queue of a device.
+func MakeFailEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(commandRequest)
+		err := svc.Fail(ctx, req.UDID, req.CommandUUID)
+		return commandResponse{Err: err}, nil
+	}
+}
+
+// MakeNotNowEndpoint creates an endpoint which defers a command until the
+// next check-in of a device.
+func MakeNotNowEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(commandRequest)
+		err := svc.NotNow(ctx, req.UDID, req.CommandUUID)
+		return commandResponse{Err: err}, nil
+	}
+}
+
+type commandRequest struct {
+	UDID        string
+	CommandUUID string
+}
+
+type nextResponse struct {
+	*Command
+	Err error `json:"error,omitempty"`
+}
+
+func (r nextResponse) error() error { return r.Err }
+func (r nextResponse) status() int {
+	if r.Command == nil {
+		return http.StatusNoContent
+	}
+	return http.StatusOK
+}
+
+type commandResponse struct {
+	Err error `json:"error,omitempty"`
+}
+
+func (r commandResponse) error() error { return r.Err }
+func (r commandResponse) status() int  { return http.StatusNoContent }
@@ -0,0 +1,445 @@
+// Package queue keeps an ordered queue of MDM commands for every device.
+//
+// Commands are enqueued from the events which commandsvc publishes to
+// NSQ, and handed to the device one at a time until the device
+// acknowledges them. Commands with a higher priority are sent first,
+// and commands with the same priority in the order they were created.
+// A command which depends on other commands is only sent after they
+// succeeded, and is dropped if one of them failed or was not enqueued
+// within the DependencyTimeout.
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// QueueBucket is the *bolt.DB bucket which holds a nested bucket with
+// the queue of each device.
+const QueueBucket = "mdm.Command.QUEUE"
+
+// ResultBucket is the *bolt.DB bucket which holds a nested bucket with
+// the results of the acknowledged and failed commands of each device, by
+// command UUID. The results decide whether the commands which depend on
+// them can be sent.
+const ResultBucket = "mdm.Command.RESULT"
+
+// Results of commands in ResultBucket.
+const (
+	succeeded = "succeeded"
+	failed    = "failed"
+)
+
+// DefaultDependencyTimeout is the default time a command waits for a
+// dependency which was never enqueued.
+const DefaultDependencyTimeout = 24 * time.Hour
+
+// ErrNotFound is returned when a command is not in the queue of the device.
+var ErrNotFound = errors.New("command not found in device queue")
+
+// Service hands out the queued commands of a device.
+type Service interface {
+	// Next returns the command with the highest priority in the queue of
+	// the device, or nil if there is none. Commands the device deferred
+	// with NotNow and commands whose dependencies have not succeeded yet
+	// are skipped. The same command is returned until it is acknowledged.
+	Next(ctx context.Context, udid string) (*Command, error)
+
+	// Ack removes a command from the queue of the device, after the
+	// device acknowledged it.
+	Ack(ctx context.Context, udid, commandUUID string) error
+
+	// Fail removes a command which the device reported as failed from
+	// the queue, together with the commands which depend on it. Commands
+	// which depend on it and are enqueued later are dropped.
+	Fail(ctx context.Context, udid, commandUUID string) error
+
+	// NotNow defers a command the device can not process right now.
+	// Deferred commands are skipped by Next until the queue has no other
+	// commands, and are sent again on the next check-in of the device.
+	NotNow(ctx context.Context, udid, commandUUID string) error
+}
+
+// Command is a queued MDM command.
+type Command struct {
+	UUID      string      `json:"command_uuid"`
+	Payload   mdm.Payload `json:"payload"`
+	CreatedAt time.Time   `json:"created_at"`
+	Priority  int         `json:"priority,omitempty"`
+	DependsOn []string    `json:"depends_on,omitempty"`
+	NotNow    bool        `json:"not_now,omitempty"`
+}
+
+// Queue stores the device queues in a BoltDB bucket.
+//
+// Queue implements both Service and consumer.Handler, to enqueue the
+// commands published to NSQ.
+type Queue struct {
+	// DependencyTimeout is the time after the creation of a command
+	// after which it fails, if one of its dependencies was not enqueued
+	// yet. Commands wait for their dependencies forever if
+	// DependencyTimeout is 0.
+	DependencyTimeout time.Duration
+
+	db     *bolt.DB
+	logger log.Logger
+}
+
+// NewQueue creates a Queue.
+func NewQueue(db *bolt.DB, logger log.Logger) (*Queue, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{QueueBucket, ResultBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket %s: %s", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{
+		DependencyTimeout: DefaultDependencyTimeout,
+		db:                db,
+		logger:            logger,
+	}, nil
+}
+
+// HandleEvent enqueues the command of an event. Events without a UDID
+// are ignored.
+func (q *Queue) HandleEvent(ctx context.Context, e *command.Event) error {
+	if e.UDID == "" {
+		q.logger.Log("msg", "event has no udid, not queued", "event", e.ID)
+		return nil
+	}
+	return q.Enqueue(ctx, e.UDID, &Command{
+		UUID:      e.Payload.CommandUUID,
+		Payload:   e.Payload,
+		CreatedAt: e.Time,
+		Priority:  e.Priority,
+		DependsOn: e.DependsOn,
+	})
+}
+
+// Enqueue adds a command to the end of the queue of the device. A
+// command which is already queued, or which has a result because it was
+// acknowledged or failed, is not added again. A command which depends on
+// a failed command is recorded as failed instead.
+func (q *Queue) Enqueue(ctx context.Context, udid string, cmd *Command) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.Bucket([]byte(QueueBucket)).CreateBucketIfNotExists([]byte(udid))
+		if err != nil {
+			return err
+		}
+		if k, _, err := find(bkt, cmd.UUID); err != nil || k != nil {
+			return err
+		}
+		results := tx.Bucket([]byte(ResultBucket)).Bucket([]byte(udid))
+		// events are delivered at least once, and can be redelivered
+		// after the command was acknowledged.
+		if results != nil && results.Get([]byte(cmd.UUID)) != nil {
+			return nil
+		}
+		for _, dep := range cmd.DependsOn {
+			if results != nil && string(results.Get([]byte(dep))) == failed {
+				q.logger.Log("msg", "dependency failed, not queued", "command_uuid", cmd.UUID, "depends_on", dep)
+				return record(tx, udid, failed, cmd.UUID)
+			}
+		}
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		return put(bkt, key, cmd)
+	})
+}
+
+// Next returns the next command for the device. When only deferred
+// commands are left, Next returns nil and clears the deferrals, so that
+// the commands are sent again on the next check-in. Commands which waited
+// longer than DependencyTimeout for a dependency to be enqueued fail,
+// together with the commands which depend on them.
+func (q *Queue) Next(ctx context.Context, udid string) (*Command, error) {
+	var next *Command
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(QueueBucket)).Bucket([]byte(udid))
+		if bkt == nil {
+			return nil
+		}
+		cmds, keys, err := all(bkt)
+		if err != nil {
+			return err
+		}
+		queued := make(map[string]bool, len(cmds))
+		for _, cmd := range cmds {
+			queued[cmd.UUID] = true
+		}
+		results := tx.Bucket([]byte(ResultBucket)).Bucket([]byte(udid))
+		if expired := q.expired(cmds, queued, results); len(expired) > 0 {
+			removed, err := failWithDependents(tx, udid, bkt, cmds, keys, expired)
+			if err != nil {
+				return err
+			}
+			cmds, keys = without(cmds, keys, removed)
+		}
+		var deferred bool
+		for _, cmd := range cmds {
+			if cmd.NotNow {
+				deferred = true
+				continue
+			}
+			if blocked(cmd, queued, results) {
+				continue
+			}
+			// commands are in creation order, so the first command with
+			// the highest priority wins.
+			if next == nil || cmd.Priority > next.Priority {
+				next = cmd
+			}
+		}
+		if next != nil || !deferred {
+			return nil
+		}
+		for i, cmd := range cmds {
+			if !cmd.NotNow {
+				continue
+			}
+			cmd.NotNow = false
+			if err := put(bkt, keys[i], cmd); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return next, err
+}
+
+// expired returns the UUIDs of the commands which waited longer than
+// DependencyTimeout for a dependency which is neither queued nor has a
+// result.
+func (q *Queue) expired(cmds []*Command, queued map[string]bool, results *bolt.Bucket) map[string]bool {
+	if q.DependencyTimeout <= 0 {
+		return nil
+	}
+	expired := make(map[string]bool)
+	for _, cmd := range cmds {
+		if cmd.CreatedAt.IsZero() || time.Since(cmd.CreatedAt) < q.DependencyTimeout {
+			continue
+		}
+		for _, dep := range cmd.DependsOn {
+			if queued[dep] || (results != nil && results.Get([]byte(dep)) != nil) {
+				continue
+			}
+			q.logger.Log("msg", "dependency was not queued in time, command failed", "command_uuid", cmd.UUID, "depends_on", dep)
+			expired[cmd.UUID] = true
+			break
+		}
+	}
+	return expired
+}
+
+// blocked reports whether a dependency of the command is queued, or has
+// not succeeded. Dependencies which were not enqueued yet block the
+// command until they are enqueued and succeed.
+func blocked(cmd *Command, queued map[string]bool, results *bolt.Bucket) bool {
+	for _, dep := range cmd.DependsOn {
+		if queued[dep] || results == nil || string(results.Get([]byte(dep))) != succeeded {
+			return true
+		}
+	}
+	return false
+}
+
+// Ack removes the command from the queue of the device, and records that
+// it succeeded.
+func (q *Queue) Ack(ctx context.Context, udid, commandUUID string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(QueueBucket)).Bucket([]byte(udid))
+		if bkt == nil {
+			return ErrNotFound
+		}
+		k, _, err := find(bkt, commandUUID)
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			return ErrNotFound
+		}
+		if err := bkt.Delete(k); err != nil {
+			return err
+		}
+		return record(tx, udid, succeeded, commandUUID)
+	})
+}
+
+// Fail removes the command and every queued command which depends on it,
+// directly or through other commands, and records that they failed.
+func (q *Queue) Fail(ctx context.Context, udid, commandUUID string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(QueueBucket)).Bucket([]byte(udid))
+		if bkt == nil {
+			return ErrNotFound
+		}
+		k, _, err := find(bkt, commandUUID)
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			return ErrNotFound
+		}
+		cmds, keys, err := all(bkt)
+		if err != nil {
+			return err
+		}
+		_, err = failWithDependents(tx, udid, bkt, cmds, keys, map[string]bool{commandUUID: true})
+		return err
+	})
+}
+
+// failWithDependents removes the queued commands with the UUIDs and every
+// queued command which depends on them, directly or through other
+// commands, and records that they failed. It returns the UUIDs of the
+// removed commands.
+func failWithDependents(tx *bolt.Tx, udid string, bkt *bolt.Bucket, cmds []*Command, keys [][]byte, uuids map[string]bool) (map[string]bool, error) {
+	removed := make(map[string]bool)
+	var failedUUIDs []string
+	remove := func(i int) error {
+		removed[cmds[i].UUID] = true
+		failedUUIDs = append(failedUUIDs, cmds[i].UUID)
+		return bkt.Delete(keys[i])
+	}
+	for i, cmd := range cmds {
+		if uuids[cmd.UUID] {
+			if err := remove(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// a dependency can be enqueued after the commands which depend on
+	// it, so the queue is scanned until no more dependents are found.
+	for more := true; more; {
+		more = false
+		for i, cmd := range cmds {
+			if removed[cmd.UUID] || !dependsOn(cmd, removed) {
+				continue
+			}
+			if err := remove(i); err != nil {
+				return nil, err
+			}
+			more = true
+		}
+	}
+	return removed, record(tx, udid, failed, failedUUIDs...)
+}
+
+// without returns the commands and keys which were not removed.
+func without(cmds []*Command, keys [][]byte, removed map[string]bool) ([]*Command, [][]byte) {
+	var (
+		keptCmds []*Command
+		keptKeys [][]byte
+	)
+	for i, cmd := range cmds {
+		if !removed[cmd.UUID] {
+			keptCmds = append(keptCmds, cmd)
+			keptKeys = append(keptKeys, keys[i])
+		}
+	}
+	return keptCmds, keptKeys
+}
+
+// dependsOn reports whether the command depends on one of the commands.
+func dependsOn(cmd *Command, uuids map[string]bool) bool {
+	for _, dep := range cmd.DependsOn {
+		if uuids[dep] {
+			return true
+		}
+	}
+	return false
+}
+
+// record sets the result of the commands of the device.
+func record(tx *bolt.Tx, udid, result string, uuids ...string) error {
+	bkt, err := tx.Bucket([]byte(ResultBucket)).CreateBucketIfNotExists([]byte(udid))
+	if err != nil {
+		return err
+	}
+	for _, uuid := range uuids {
+		if err := bkt.Put([]byte(uuid), []byte(result)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotNow defers the command until the next check-in of the device.
+func (q *Queue) NotNow(ctx context.Context, udid, commandUUID string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(QueueBucket)).Bucket([]byte(udid))
+		if bkt == nil {
+			return ErrNotFound
+		}
+		k, cmd, err := find(bkt, commandUUID)
+		if err != nil {
+			return err
+		}
+		if k == nil {
+			return ErrNotFound
+		}
+		cmd.NotNow = true
+		return put(bkt, k, cmd)
+	})
+}
+
+// find returns the key and the command with the UUID, or a nil key if the
+// command is not in the queue.
+func find(bkt *bolt.Bucket, commandUUID string) ([]byte, *Command, error) {
+	c := bkt.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var cmd Command
+		if err := json.Unmarshal(v, &cmd); err != nil {
+			return nil, nil, err
+		}
+		if cmd.UUID == commandUUID {
+			return k, &cmd, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// all returns the queued commands and their keys in creation order.
+func all(bkt *bolt.Bucket) ([]*Command, [][]byte, error) {
+	var (
+		cmds []*Command
+		keys [][]byte
+	)
+	c := bkt.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		var cmd Command
+		if err := json.Unmarshal(v, &cmd); err != nil {
+			return nil, nil, err
+		}
+		cmds = append(cmds, &cmd)
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	return cmds, keys, nil
+}
+
+func put(bkt *bolt.Bucket, key []byte, cmd *Command) error {
+	v, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return bkt.Put(key, v)
+}
@@ -0,0 +1,376 @@
+package queue
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/micromdm/mdm"
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/nsqd"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/consumer"
+)
+
+func TestQueue(t *testing.T) {
+	q := setupQueue(t)
+	ctx := context.Background()
+
+	events := []*command.Event{newEvent("foo", "a"), newEvent("foo", "b"), newEvent("foo", "c"), newEvent("bar", "d")}
+	for _, e := range events {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// events are delivered at least once, duplicates are not queued again.
+	if err := q.HandleEvent(ctx, events[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		op   func() error
+		next string
+	}{
+		{nil, "a"},
+		{nil, "a"},
+		{func() error { return q.Ack(ctx, "foo", "a") }, "b"},
+		{func() error { return q.NotNow(ctx, "foo", "b") }, "c"},
+		{func() error { return q.Ack(ctx, "foo", "c") }, ""},
+		// the deferred command is sent again on the next check-in.
+		{nil, "b"},
+		{func() error { return q.Ack(ctx, "foo", "b") }, ""},
+	}
+	for i, step := range steps {
+		if step.op != nil {
+			if err := step.op(); err != nil {
+				t.Fatalf("step %d: %s", i, err)
+			}
+		}
+		cmd, err := q.Next(ctx, "foo")
+		if err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+		have := ""
+		if cmd != nil {
+			have = cmd.UUID
+		}
+		if want := step.next; want != have {
+			t.Fatalf("step %d: want next command %q, have %q", i, want, have)
+		}
+	}
+
+	if err := q.Ack(ctx, "foo", "a"); err != ErrNotFound {
+		t.Errorf("want ErrNotFound, have %v", err)
+	}
+	// an event redelivered after its command was acknowledged is not
+	// queued again.
+	if err := q.HandleEvent(ctx, events[0]); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := q.Next(ctx, "foo"); err != nil || cmd != nil {
+		t.Fatalf("want empty queue, have %#v, %v", cmd, err)
+	}
+	if err := q.NotNow(ctx, "baz", "a"); err != ErrNotFound {
+		t.Errorf("want ErrNotFound, have %v", err)
+	}
+	cmd, err := q.Next(ctx, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd == nil || cmd.UUID != "d" {
+		t.Errorf("want command d for device bar, have %#v", cmd)
+	}
+}
+
+func TestQueue_scheduling(t *testing.T) {
+	q := setupQueue(t)
+	ctx := context.Background()
+
+	inventory := newEvent("foo", "inventory")
+	install := newEvent("foo", "install")
+	configure := newEvent("foo", "configure")
+	configure.DependsOn = []string{"install"}
+	lock := newEvent("foo", "lock")
+	lock.Priority = command.PriorityHigh
+	for _, e := range []*command.Event{inventory, install, configure, lock} {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{"lock", "inventory", "install", "configure"} {
+		cmd, err := q.Next(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd == nil || cmd.UUID != want {
+			t.Fatalf("want next command %q, have %#v", want, cmd)
+		}
+		if err := q.Ack(ctx, "foo", want); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// commands which depend on a failed command are removed with it.
+	reinstall := newEvent("foo", "reinstall")
+	reconfigure := newEvent("foo", "reconfigure")
+	reconfigure.DependsOn = []string{"reinstall"}
+	for _, e := range []*command.Event{reinstall, reconfigure} {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Fail(ctx, "foo", "reinstall"); err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := q.Next(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != nil {
+		t.Fatalf("want empty queue, have %#v", cmd)
+	}
+	if err := q.Fail(ctx, "foo", "reinstall"); err != ErrNotFound {
+		t.Errorf("want ErrNotFound, have %v", err)
+	}
+}
+
+func TestQueue_dependencies(t *testing.T) {
+	q := setupQueue(t)
+	ctx := context.Background()
+
+	// configure arrives before the install it depends on, and is not
+	// sent before install succeeded.
+	configure := newEvent("foo", "configure")
+	configure.DependsOn = []string{"install"}
+	for _, e := range []*command.Event{configure, newEvent("foo", "install")} {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"install", "configure"} {
+		cmd, err := q.Next(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd == nil || cmd.UUID != want {
+			t.Fatalf("want next command %q, have %#v", want, cmd)
+		}
+		if err := q.Ack(ctx, "foo", want); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a chain of dependents which arrive before their dependency is
+	// removed when it fails.
+	restart := newEvent("foo", "restart")
+	restart.DependsOn = []string{"update"}
+	update := newEvent("foo", "update")
+	update.DependsOn = []string{"download"}
+	for _, e := range []*command.Event{restart, update, newEvent("foo", "download")} {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Fail(ctx, "foo", "download"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := q.Next(ctx, "foo"); err != nil || cmd != nil {
+		t.Fatalf("want empty queue, have %#v, %v", cmd, err)
+	}
+
+	// commands which depend on a command which already failed, directly
+	// or through other commands, are dropped.
+	retry := newEvent("foo", "retry")
+	retry.DependsOn = []string{"restart"}
+	for _, e := range []*command.Event{retry, newEvent("foo", "inventory")} {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd, err := q.Next(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd == nil || cmd.UUID != "inventory" {
+		t.Fatalf("want next command %q, have %#v", "inventory", cmd)
+	}
+	if err := q.Ack(ctx, "foo", "inventory"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := q.Next(ctx, "foo"); err != nil || cmd != nil {
+		t.Fatalf("want empty queue, have %#v, %v", cmd, err)
+	}
+
+	// commands which depend on a command which was never queued wait
+	// for it.
+	lock := newEvent("foo", "lock")
+	lock.DependsOn = []string{"unknown"}
+	if err := q.HandleEvent(ctx, lock); err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := q.Next(ctx, "foo"); err != nil || cmd != nil {
+		t.Fatalf("want blocked command, have %#v, %v", cmd, err)
+	}
+
+	// until they waited longer than the DependencyTimeout, and fail
+	// together with the commands which depend on them.
+	q.DependencyTimeout = time.Hour
+	wipe := newEvent("foo", "wipe")
+	wipe.DependsOn = []string{"unknown"}
+	wipe.Time = time.Now().Add(-2 * time.Hour)
+	report := newEvent("foo", "report")
+	report.DependsOn = []string{"wipe"}
+	for _, e := range []*command.Event{wipe, report} {
+		if err := q.HandleEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cmd, err := q.Next(ctx, "foo"); err != nil || cmd != nil {
+		t.Fatalf("want blocked command, have %#v, %v", cmd, err)
+	}
+	err = q.db.View(func(tx *bolt.Tx) error {
+		results := tx.Bucket([]byte(ResultBucket)).Bucket([]byte("foo"))
+		for uuid, want := range map[string]string{"wipe": failed, "report": failed, "lock": ""} {
+			if have := string(results.Get([]byte(uuid))); want != have {
+				t.Errorf("want %s result %q, have %q", uuid, want, have)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Fail(ctx, "foo", "lock"); err != nil {
+		t.Errorf("want lock still queued, have %v", err)
+	}
+}
+
+func TestQueueHTTP(t *testing.T) {
+	q := setupQueue(t)
+	if err := q.HandleEvent(context.Background(), newEvent("foo", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := MakeHTTPHandlers(context.Background(), MakeEndpoints(q))
+	r := mux.NewRouter()
+	r.Handle("/v1/queue/{udid}/next", h.NextHandler).Methods("POST")
+	r.Handle("/v1/queue/{udid}/{uuid}/ack", h.AckHandler).Methods("POST")
+	r.Handle("/v1/queue/{udid}/{uuid}/error", h.FailHandler).Methods("POST")
+	r.Handle("/v1/queue/{udid}/{uuid}/notnow", h.NotNowHandler).Methods("POST")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		path         string
+		expectStatus int
+	}{
+		{"next", "/v1/queue/foo/next", http.StatusOK},
+		{"not_now", "/v1/queue/foo/a/notnow", http.StatusNoContent},
+		{"not_found", "/v1/queue/foo/b/ack", http.StatusNotFound},
+		{"fail_not_found", "/v1/queue/foo/b/error", http.StatusNotFound},
+		{"ack", "/v1/queue/foo/a/ack", http.StatusNoContent},
+		{"empty", "/v1/queue/foo/next", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+tt.path, "application/json", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if want, have := tt.expectStatus, resp.StatusCode; want != have {
+				t.Fatalf("want %d, have %d", want, have)
+			}
+		})
+	}
+}
+
+func TestQueue_consumer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nsqd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.DataPath = dir
+	n := nsqd.New(opts)
+	n.Main()
+	defer n.Exit()
+	addr := n.RealTCPAddr().String()
+
+	q := setupQueue(t)
+	c, err := consumer.New(consumer.Config{Channel: "queue"}, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConnectToNSQD(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop(context.Background())
+
+	producer, err := nsq.NewProducer(addr, nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Stop()
+	msg, err := command.MarshalEvent(newEvent("foo", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := producer.Publish(consumer.DefaultTopic, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cmd, err := q.Next(context.Background(), "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd != nil {
+			if want, have := "a", cmd.UUID; want != have {
+				t.Fatalf("want command %q, have %q", want, have)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("command was not queued")
+}
+
+func newEvent(udid, commandUUID string) *command.Event {
+	e := command.NewEvent(mdm.Payload{
+		CommandUUID: commandUUID,
+		Command:     &mdm.Command{RequestType: "DeviceInformation"},
+	})
+	e.UDID = udid
+	return e
+}
+
+func setupQueue(t *testing.T) *Queue {
+	f, _ := ioutil.TempFile("", "bolt-")
+	f.Close()
+	os.Remove(f.Name())
+
+	db, err := bolt.Open(f.Name(), 0777, nil)
+	if err != nil {
+		t.Fatalf("couldn't open bolt, err %s\n", err)
+	}
+	q, err := NewQueue(db, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("couldn't create queue, err %s\n", err)
+	}
+	return q
+}
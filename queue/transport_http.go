@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"encoding/json"
+	"net/http"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+type HTTPHandlers struct {
+	NextHandler   http.Handler
+	AckHandler    http.Handler
+	FailHandler   http.Handler
+	NotNowHandler http.Handler
+}
+
+// MakeHTTPHandlers returns the HTTP handlers for the queue service.
+// The handlers expect the device in the "udid" route variable, and the
+// ack, fail and not now handlers the command in the "uuid" route variable.
+func MakeHTTPHandlers(ctx context.Context, endpoints Endpoints, opts ...httptransport.ServerOption) HTTPHandlers {
+	opts = append(append([]httptransport.ServerOption{}, opts...),
+		httptransport.ServerErrorEncoder(EncodeError))
+	h := HTTPHandlers{
+		NextHandler: httptransport.NewServer(
+			ctx,
+			endpoints.NextEndpoint,
+			decodeCommandRequest,
+			encodeResponse,
+			opts...,
+		),
+		AckHandler: httptransport.NewServer(
+			ctx,
+			endpoints.AckEndpoint,
+			decodeCommandRequest,
+			encodeResponse,
+			opts...,
+		),
+		FailHandler: httptransport.NewServer(
+			ctx,
+			endpoints.FailEndpoint,
+			decodeCommandRequest,
+			encodeResponse,
+			opts...,
+		),
+		NotNowHandler: httptransport.NewServer(
+			ctx,
+			endpoints.NotNowEndpoint,
+			decodeCommandRequest,
+			encodeResponse,
+			opts...,
+		),
+	}
+	return h
+}
+
+type errorer interface {
+	error() error
+}
+
+type statuser interface {
+	status() int
+}
+
+// EncodeError encodes ErrNotFound as 404 Not Found, and other errors
+// with command.EncodeError.
+func EncodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	cause := err
+	if e, ok := err.(httptransport.Error); ok {
+		cause = e.Err
+	}
+	if cause != ErrNotFound {
+		command.EncodeError(ctx, err, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{
+		"error": cause.Error(),
+	})
+}
+
+func decodeCommandRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	vars := mux.Vars(r)
+	return commandRequest{UDID: vars["udid"], CommandUUID: vars["uuid"]}, nil
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		EncodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	if s, ok := response.(statuser); ok && s.status() == http.StatusNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s, ok := response.(statuser); ok {
+		w.WriteHeader(s.status())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(response)
+}
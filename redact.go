@@ -0,0 +1,123 @@
+package command
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/micromdm/mdm"
+)
+
+// Redacted replaces the value of a secret field.
+const Redacted = "REDACTED"
+
+// DefaultRedactor masks the passcodes, unlock tokens and profile contents
+// of commands.
+var DefaultRedactor = &Redactor{
+	Fields: map[string][]string{
+		"ClearPasscode":  {"unlock_token"},
+		"DeviceLock":     {"pin"},
+		"EraseDevice":    {"pin"},
+		"InstallProfile": {"payload"},
+	},
+}
+
+// Redactor masks the secret fields of commands before they are logged or
+// sent to clients. The payload published to NSQ is never redacted, because
+// devices need the secrets.
+//
+// A nil Redactor returns its arguments unchanged.
+type Redactor struct {
+	// Fields are the JSON names of the secret fields, by request type.
+	Fields map[string][]string
+}
+
+// Request returns a copy of the request with the secret fields masked.
+func (r *Redactor) Request(req *mdm.CommandRequest) *mdm.CommandRequest {
+	fields := r.fields(req)
+	if len(fields) == 0 {
+		return req
+	}
+	redacted := *req
+	mask(reflect.ValueOf(&redacted).Elem(), fields)
+	return &redacted
+}
+
+// Payload returns a copy of the payload with the secret fields of the
+// command masked.
+func (r *Redactor) Payload(p *mdm.Payload) *mdm.Payload {
+	if p == nil || p.Command == nil || r == nil {
+		return p
+	}
+	fields := r.Fields[p.Command.RequestType]
+	if len(fields) == 0 {
+		return p
+	}
+	cmd := *p.Command
+	// the fields of a request type are in the embedded struct named
+	// after it, ex: Command.DeviceLock.PIN.
+	v := reflect.ValueOf(&cmd).Elem().FieldByName(cmd.RequestType)
+	if !v.IsValid() || v.Kind() != reflect.Struct {
+		return p
+	}
+	mask(v, fields)
+	return &mdm.Payload{CommandUUID: p.CommandUUID, Command: &cmd}
+}
+
+// Event returns a copy of the event with the secret fields of the command
+// masked.
+func (r *Redactor) Event(e *Event) *Event {
+	if e == nil {
+		return e
+	}
+	payload := r.Payload(&e.Payload)
+	if payload == &e.Payload {
+		return e
+	}
+	redacted := *e
+	redacted.Payload = *payload
+	return &redacted
+}
+
+// MarshalEvent returns the JSON encoding of the redacted event. It can be
+// used as the Encode function of webhooks and event streams.
+func (r *Redactor) MarshalEvent(e *Event) ([]byte, error) {
+	return json.Marshal(r.Event(e))
+}
+
+func (r *Redactor) fields(req *mdm.CommandRequest) []string {
+	if r == nil || req == nil {
+		return nil
+	}
+	return r.Fields[req.RequestType]
+}
+
+// mask replaces the non-empty fields of the struct v with Redacted. Fields
+// are matched by the name in their json tag.
+func mask(v reflect.Value, fields []string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if !contains(fields, name) {
+			continue
+		}
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.String && f.Len() > 0:
+			f.SetString(Redacted)
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8 && f.Len() > 0:
+			f.SetBytes([]byte(Redacted))
+		default:
+			f.Set(reflect.Zero(f.Type()))
+		}
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package command
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command/service/mock"
+)
+
+func TestRedactor_Payload(t *testing.T) {
+	payload := &mdm.Payload{
+		CommandUUID: "foo",
+		Command: &mdm.Command{
+			RequestType: "DeviceLock",
+			DeviceLock: mdm.DeviceLock{
+				PIN:     "123456",
+				Message: "call IT",
+			},
+		},
+	}
+	original := *payload.Command
+
+	redacted := DefaultRedactor.Payload(payload)
+	if want, have := Redacted, redacted.Command.DeviceLock.PIN; want != have {
+		t.Errorf("want pin %q, have %q", want, have)
+	}
+	if want, have := "call IT", redacted.Command.DeviceLock.Message; want != have {
+		t.Errorf("want message %q, have %q", want, have)
+	}
+	if want, have := "foo", redacted.CommandUUID; want != have {
+		t.Errorf("want command uuid %q, have %q", want, have)
+	}
+	if !reflect.DeepEqual(original, *payload.Command) {
+		t.Error("redaction modified the original payload")
+	}
+
+	// commands without secrets are not copied.
+	info := &mdm.Payload{Command: &mdm.Command{RequestType: "DeviceInformation"}}
+	if DefaultRedactor.Payload(info) != info {
+		t.Error("want the payload unchanged")
+	}
+
+	var nop *Redactor
+	if nop.Payload(payload) != payload {
+		t.Error("want a nil Redactor to return the payload unchanged")
+	}
+}
+
+func TestRedactor_Request(t *testing.T) {
+	profile := []byte("<plist>secret</plist>")
+	req := &mdm.CommandRequest{
+		RequestType: "InstallProfile",
+		UDID:        "foobarbaz",
+		Payload:     profile,
+	}
+	redacted := DefaultRedactor.Request(req)
+	if want, have := []byte(Redacted), redacted.Payload; !bytes.Equal(want, have) {
+		t.Errorf("want payload %q, have %q", want, have)
+	}
+	if want, have := "foobarbaz", redacted.UDID; want != have {
+		t.Errorf("want udid %q, have %q", want, have)
+	}
+	if !bytes.Equal(profile, req.Payload) {
+		t.Error("redaction modified the original request")
+	}
+}
+
+func TestRedactor_MarshalEvent(t *testing.T) {
+	event := NewEvent(mdm.Payload{
+		CommandUUID: "foo",
+		Command: &mdm.Command{
+			RequestType: "EraseDevice",
+			EraseDevice: mdm.EraseDevice{PIN: "123456"},
+		},
+	})
+	data, err := DefaultRedactor.MarshalEvent(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("123456")) {
+		t.Errorf("marshaled event contains the pin: %s", data)
+	}
+	if want, have := "123456", event.Payload.Command.EraseDevice.PIN; want != have {
+		t.Errorf("redaction modified the event pin, want %q, have %q", want, have)
+	}
+}
+
+func TestServiceLoggingMiddleware_redacts(t *testing.T) {
+	var buf bytes.Buffer
+	svc := ServiceLoggingMiddleware(log.NewLogfmtLogger(&buf))(&mock.CommandService{
+		NewCommandFunc: mock.ReturnMockPayload,
+	})
+	_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceLock",
+		UDID:        "foobarbaz",
+		PIN:         "123456",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "123456") || !strings.Contains(out, "foobarbaz") {
+		t.Errorf("want the pin masked in the log output, have %s", out)
+	}
+}
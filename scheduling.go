@@ -0,0 +1,57 @@
+package command
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Priorities of common commands. Commands with a higher priority are
+// sent to the device first. The default priority is zero.
+const (
+	PriorityLow    = -10
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+// Scheduling controls the order in which the commands of a device are
+// sent to the device.
+type Scheduling struct {
+	// Priority of the command. Higher is more urgent.
+	Priority int `json:"priority,omitempty"`
+
+	// DependsOn holds the UUIDs of commands which must succeed before
+	// the command is sent.
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// Validate returns an error which implements InvalidRequest if the
+// scheduling fields of a request are invalid.
+func (s Scheduling) Validate() error {
+	for _, dep := range s.DependsOn {
+		if dep == "" {
+			return schedulingError("depends_on must not contain empty command UUIDs")
+		}
+	}
+	if s.Priority < -1000 || s.Priority > 1000 {
+		return schedulingError(fmt.Sprintf("priority %d is out of range [-1000, 1000]", s.Priority))
+	}
+	return nil
+}
+
+type schedulingError string
+
+func (e schedulingError) Error() string        { return string(e) }
+func (e schedulingError) InvalidRequest() bool { return true }
+
+// NewSchedulingContext returns a new Context carrying the Scheduling of
+// a command request.
+func NewSchedulingContext(ctx context.Context, s Scheduling) context.Context {
+	return context.WithValue(ctx, schedulingKey, s)
+}
+
+// SchedulingFromContext returns the Scheduling stored in ctx, if any.
+func SchedulingFromContext(ctx context.Context) (Scheduling, bool) {
+	s, ok := ctx.Value(schedulingKey).(Scheduling)
+	return s, ok
+}
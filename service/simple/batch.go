@@ -0,0 +1,212 @@
+package simple
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Defaults of Batching.
+const (
+	DefaultBatchSize  = 1000
+	DefaultBatchDelay = 10 * time.Millisecond
+)
+
+// ErrClosed is returned by NewCommand after Close.
+var ErrClosed = errors.New("simple: service closed")
+
+// MultiPublisher publishes several events to a topic at once. It is
+// satisfied by an *nsq.Producer and by a *publisher.Pool.
+type MultiPublisher interface {
+	MultiPublish(topic string, bodies [][]byte) error
+}
+
+// Batching groups the work of concurrent NewCommand calls: the events
+// are archived in one BoltDB transaction, and published with one
+// MultiPublish per topic if the Publisher is a MultiPublisher. Each call
+// still waits for its event to be archived and published.
+type Batching struct {
+	// Size is the maximum number of events in a batch.
+	// Defaults to DefaultBatchSize.
+	Size int
+
+	// Delay is the longest time an event waits for the batch to fill.
+	// Defaults to DefaultBatchDelay.
+	Delay time.Duration
+}
+
+// WithBatching batches the archive transactions and NSQ publishes of
+// concurrent NewCommand calls. The batches are collected by the service, so
+// the batch settings of a *bolt.DB shared with other services are not
+// changed. Close must be called to stop batching.
+func WithBatching(b Batching) Option {
+	return func(svc *CommandService) {
+		if b.Size <= 0 {
+			b.Size = DefaultBatchSize
+		}
+		if b.Delay <= 0 {
+			b.Delay = DefaultBatchDelay
+		}
+		svc.batching = &b
+	}
+}
+
+// Close archives and publishes the events which wait for a batch, and
+// stops batching. NewCommand returns ErrClosed after Close. Close does
+// nothing if batching is not enabled.
+func (svc *CommandService) Close() {
+	if svc.archiver != nil {
+		svc.archiver.close()
+	}
+	if svc.batcher != nil {
+		svc.batcher.close()
+	}
+}
+
+// batcher collects concurrent requests into batches, and passes each
+// batch to flush.
+type batcher struct {
+	size  int
+	delay time.Duration
+	flush func([]*batchRequest)
+
+	requests chan *batchRequest
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// batchRequest is an event to archive or to publish to topic.
+type batchRequest struct {
+	topic string
+	body  []byte
+	nano  int64  // time of an archived event
+	key   []byte // key of an archived event, set by flush
+	err   chan error
+}
+
+func newBatcher(b Batching, flush func([]*batchRequest)) *batcher {
+	bt := &batcher{
+		size:     b.Size,
+		delay:    b.Delay,
+		flush:    flush,
+		requests: make(chan *batchRequest),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go bt.run()
+	return bt
+}
+
+// do waits for the request to be flushed with the next batch.
+func (b *batcher) do(req *batchRequest) error {
+	req.err = make(chan error, 1)
+	select {
+	case b.requests <- req:
+		return <-req.err
+	case <-b.stop:
+		return ErrClosed
+	}
+}
+
+func (b *batcher) close() {
+	select {
+	case <-b.stop:
+	default:
+		close(b.stop)
+	}
+	<-b.done
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+	for {
+		var batch []*batchRequest
+		select {
+		case req := <-b.requests:
+			batch = append(batch, req)
+		case <-b.stop:
+			return
+		}
+		timer := time.NewTimer(b.delay)
+		stopped := false
+	collect:
+		for len(batch) < b.size {
+			select {
+			case req := <-b.requests:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			case <-b.stop:
+				stopped = true
+				break collect
+			}
+		}
+		timer.Stop()
+		b.flush(batch)
+		if stopped {
+			return
+		}
+	}
+}
+
+// publishBatch publishes the batch with one MultiPublish per topic, and
+// returns the result to each request.
+func publishBatch(publisher Publisher, batch []*batchRequest) {
+	var topics []string
+	byTopic := make(map[string][]*batchRequest)
+	for _, req := range batch {
+		if _, ok := byTopic[req.topic]; !ok {
+			topics = append(topics, req.topic)
+		}
+		byTopic[req.topic] = append(byTopic[req.topic], req)
+	}
+	for _, topic := range topics {
+		reqs := byTopic[topic]
+		mp, ok := publisher.(MultiPublisher)
+		if !ok || len(reqs) == 1 {
+			for _, req := range reqs {
+				req.err <- publisher.Publish(topic, req.body)
+			}
+			continue
+		}
+		bodies := make([][]byte, len(reqs))
+		for i, req := range reqs {
+			bodies[i] = req.body
+		}
+		err := mp.MultiPublish(topic, bodies)
+		for _, req := range reqs {
+			req.err <- err
+		}
+	}
+}
+
+// archiveBatch archives the batch in one transaction, and returns the
+// result to each request.
+func (svc *CommandService) archiveBatch(batch []*batchRequest) {
+	err := svc.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(CommandBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", CommandBucket)
+		}
+		for _, req := range batch {
+			seq, err := bkt.NextSequence()
+			if err != nil {
+				return err
+			}
+			req.key = eventKey(req.nano, seq)
+			if err := bkt.Put(req.key, req.body); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		svc.metrics.ArchiveSize.Set(float64(atomic.AddInt64(&svc.size, int64(len(batch)))))
+	}
+	for _, req := range batch {
+		req.err <- err
+	}
+}
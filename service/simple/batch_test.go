@@ -0,0 +1,151 @@
+package simple
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/micromdm/mdm"
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/nsqio/nsq/nsqd"
+	"golang.org/x/net/context"
+)
+
+type mockMultiPublisher struct {
+	mockPublisher
+	mu      sync.Mutex
+	batches [][][]byte
+}
+
+func (m *mockMultiPublisher) MultiPublish(topic string, bodies [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, bodies)
+	return nil
+}
+
+func TestService_batching(t *testing.T) {
+	var published int64
+	publisher := &mockMultiPublisher{mockPublisher: mockPublisher{
+		PublishFn: func(string, []byte) error {
+			atomic.AddInt64(&published, 1)
+			return nil
+		},
+	}}
+	db := setupDB(t).db
+	maxBatchSize, maxBatchDelay := db.MaxBatchSize, db.MaxBatchDelay
+	svc, err := NewService(db, publisher, WithBatching(Batching{Size: 100, Delay: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the *bolt.DB may be shared with other services.
+	if db.MaxBatchSize != maxBatchSize || db.MaxBatchDelay != maxBatchDelay {
+		t.Error("want the batch settings of the *bolt.DB unchanged")
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+				RequestType: "DeviceInformation",
+				UDID:        "foobarbaz",
+			})
+			errc <- err
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var batched int
+	for _, bodies := range publisher.batches {
+		batched += len(bodies)
+	}
+	if want, have := int64(n), int64(batched)+atomic.LoadInt64(&published); want != have {
+		t.Errorf("want %d events published, have %d", want, have)
+	}
+	if want, have := int64(n), atomic.LoadInt64(&svc.size); want != have {
+		t.Errorf("want %d events archived, have %d", want, have)
+	}
+	if len(publisher.batches) == 0 || len(publisher.batches) >= n {
+		t.Errorf("want events published in a few batches, have %d batches", len(publisher.batches))
+	}
+
+	svc.Close()
+	_, err = svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if _, ok := err.(archiveError); !ok || err.(archiveError).error != ErrClosed {
+		t.Errorf("want ErrClosed after Close, have %v", err)
+	}
+}
+
+func BenchmarkNewCommand(b *testing.B) {
+	b.Run("unbatched", func(b *testing.B) { benchmarkNewCommand(b) })
+	b.Run("batched", func(b *testing.B) { benchmarkNewCommand(b, WithBatching(Batching{})) })
+}
+
+// benchmarkNewCommand creates commands from many goroutines, archived in
+// BoltDB and published to an embedded nsqd.
+func benchmarkNewCommand(b *testing.B, opts ...Option) {
+	addr, stop := setupNSQD(b)
+	defer stop()
+	producer, err := nsq.NewProducer(addr, nsq.NewConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	producer.SetLogger(nil, nsq.LogLevelError)
+	defer producer.Stop()
+
+	db := setupDB(b).db
+	defer os.Remove(db.Path())
+	defer db.Close()
+	svc, err := NewService(db, producer, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer svc.Close()
+
+	request := &mdm.CommandRequest{RequestType: "DeviceInformation", UDID: "foobarbaz"}
+	b.SetParallelism(512)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := svc.NewCommand(context.Background(), request); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "commands/s")
+}
+
+// setupNSQD starts an embedded nsqd on a random port.
+func setupNSQD(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "nsqd-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := nsqd.NewOptions()
+	opts.TCPAddress = "127.0.0.1:0"
+	opts.HTTPAddress = "127.0.0.1:0"
+	opts.DataPath = dir
+	n := nsqd.New(opts)
+	n.Main()
+	return n.RealTCPAddr().String(), func() {
+		n.Exit()
+		os.RemoveAll(dir)
+	}
+}
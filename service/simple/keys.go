@@ -0,0 +1,160 @@
+package simple
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// KeySize is the size of the keys of archived events.
+const KeySize = 16
+
+// eventKey returns the key of an event archived at nano with a sequence
+// number of the bucket. The time and the sequence are big-endian, so keys
+// sort by time, and events archived in the same nanosecond get different
+// keys.
+func eventKey(nano int64, seq uint64) []byte {
+	key := make([]byte, KeySize)
+	binary.BigEndian.PutUint64(key, uint64(nano))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// timeKey returns the first key at or after t. Times before 1970 are
+// before every key.
+func timeKey(t time.Time) []byte {
+	nano := t.UnixNano()
+	if nano < 0 {
+		nano = 0
+	}
+	return eventKey(nano, 0)
+}
+
+// legacyKey parses a decimal key of an archive before KeySize keys. Keys
+// of KeySize bytes are never decimal: they would be times before April
+// 1970.
+func legacyKey(k []byte) (int64, bool) {
+	if len(k) == 0 || len(k) > 19 || len(k) == KeySize {
+		return 0, false
+	}
+	for _, b := range k {
+		if b < '0' || b > '9' {
+			return 0, false
+		}
+	}
+	nano, err := strconv.ParseInt(string(k), 10, 64)
+	return nano, err == nil
+}
+
+// hasLegacyKeys reports whether the bucket has decimal keys. Decimal keys
+// start with an ASCII digit and sort after the keys of events archived
+// before 2081.
+func hasLegacyKeys(bkt *bolt.Bucket) bool {
+	c := bkt.Cursor()
+	for k, _ := c.Seek([]byte("0")); k != nil && k[0] <= '9'; k, _ = c.Next() {
+		if _, ok := legacyKey(k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyMigrationResult summarizes a MigrateKeys run.
+type KeyMigrationResult struct {
+	// Scanned is the number of events read.
+	Scanned int
+	// Migrated is the number of events whose key was converted.
+	Migrated int
+}
+
+// MigrateKeys converts the decimal keys of the events archived in bucket
+// to KeySize keys, batchSize events per transaction. An interrupted run
+// can be resumed by running it again. DryRun counts the events which need
+// to be migrated without writing them. NewService converts the keys of
+// CommandBucket in one transaction; MigrateKeys converts large archives
+// in smaller transactions ahead of an upgrade.
+func MigrateKeys(db *bolt.DB, bucket string, batchSize int, dryRun bool) (KeyMigrationResult, error) {
+	var (
+		result KeyMigrationResult
+		after  []byte
+	)
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	update := db.Update
+	if dryRun {
+		update = db.View
+	}
+	for {
+		var last []byte
+		err := update(func(tx *bolt.Tx) error {
+			bkt := tx.Bucket([]byte(bucket))
+			if bkt == nil {
+				return fmt.Errorf("bucket %q not found", bucket)
+			}
+			var err error
+			last, err = migrateKeys(bkt, after, batchSize, dryRun, &result)
+			return err
+		})
+		if err != nil || last == nil {
+			return result, err
+		}
+		after = last
+	}
+}
+
+// migrateKeys scans up to limit keys of the bucket after the key after,
+// or from the first key if after is nil, and converts the decimal keys
+// unless dryRun is set. All keys are scanned if limit is 0. migrateKeys
+// returns the last scanned key, or nil if there are no more keys.
+func migrateKeys(bkt *bolt.Bucket, after []byte, limit int, dryRun bool, result *KeyMigrationResult) ([]byte, error) {
+	type record struct {
+		old  []byte
+		nano int64
+		v    []byte
+	}
+	var (
+		rekeyed []record
+		last    []byte
+	)
+	c := bkt.Cursor()
+	key, v := c.First()
+	if after != nil {
+		if key, v = c.Seek(after); key != nil && string(key) == string(after) {
+			key, v = c.Next()
+		}
+	}
+	for n := 0; key != nil && (limit <= 0 || n < limit); key, v = c.Next() {
+		n++
+		last = append([]byte(nil), key...)
+		result.Scanned++
+		nano, ok := legacyKey(key)
+		if !ok {
+			continue
+		}
+		rekeyed = append(rekeyed, record{last, nano, append([]byte(nil), v...)})
+	}
+	result.Migrated += len(rekeyed)
+	if dryRun {
+		return last, nil
+	}
+	// keys are rewritten after the cursor is done, because modifying a
+	// bucket invalidates its cursors. New keys which are scanned by a
+	// later batch are skipped.
+	for _, r := range rekeyed {
+		seq, err := bkt.NextSequence()
+		if err != nil {
+			return nil, err
+		}
+		if err := bkt.Put(eventKey(r.nano, seq), r.v); err != nil {
+			return nil, err
+		}
+		if err := bkt.Delete(r.old); err != nil {
+			return nil, err
+		}
+	}
+	return last, nil
+}
@@ -0,0 +1,160 @@
+package simple
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/audit"
+)
+
+func TestEventKey_order(t *testing.T) {
+	// decimal keys of these times sort the other way around.
+	if bytes.Compare(eventKey(999999999, 0), eventKey(1000000000, 0)) >= 0 {
+		t.Error("want keys ordered by time across digit lengths")
+	}
+	if bytes.Compare(eventKey(1000, 1), eventKey(1000, 2)) >= 0 {
+		t.Error("want keys of the same time ordered by sequence")
+	}
+	if bytes.Compare(timeKey(time.Time{}), eventKey(0, 0)) != 0 {
+		t.Error("want times before 1970 before every key")
+	}
+}
+
+func TestService_sameNanosecond(t *testing.T) {
+	svc := setupDB(t)
+	nano := time.Now().UnixNano()
+	var keys [][]byte
+	for i := 0; i < 3; i++ {
+		msg, err := command.MarshalEvent(testEvent(t, nano))
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := svc.archive(context.Background(), nano, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	events, err := svc.Events(context.Background(), audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(events); want != have {
+		t.Errorf("want %d events archived in the same nanosecond, have %d", want, have)
+	}
+
+	// resuming after the first event returns the others of the same
+	// nanosecond.
+	after, err := svc.EventsAfterKey(context.Background(), keys[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(after); want != have {
+		t.Fatalf("want %d events after the first key, have %d", want, have)
+	}
+	if !bytes.Equal(after[0].ArchiveKey, keys[1]) || !bytes.Equal(after[1].ArchiveKey, keys[2]) {
+		t.Errorf("want events after the first key in order, have keys %x and %x", after[0].ArchiveKey, after[1].ArchiveKey)
+	}
+}
+
+// legacyNanos are the times of events with decimal keys. The decimal keys
+// of the first two sort the other way around.
+var legacyNanos = []int64{999999999, 1000000000, 1480468893000000000, 1480468893000000001}
+
+func TestMigrateKeys(t *testing.T) {
+	db := setupLegacyDB(t)
+
+	result, err := MigrateKeys(db, CommandBucket, 3, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := len(legacyNanos), result.Migrated; want != have {
+		t.Errorf("dry run: want %d events to migrate, have %d", want, have)
+	}
+
+	result, err = MigrateKeys(db, CommandBucket, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := len(legacyNanos), result.Migrated; want != have {
+		t.Errorf("want %d migrated events, have %d", want, have)
+	}
+	checkMigrated(t, db)
+
+	result, err = MigrateKeys(db, CommandBucket, 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, result.Migrated; want != have {
+		t.Errorf("want no events migrated again, have %d", have)
+	}
+}
+
+func TestNewService_migrateKeys(t *testing.T) {
+	db := setupLegacyDB(t)
+	checkMigrated(t, db)
+}
+
+// setupLegacyDB archives events under decimal keys, as earlier versions
+// did.
+func setupLegacyDB(t *testing.T) *bolt.DB {
+	db := setupDB(t).db
+	err := db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(CommandBucket))
+		for _, nano := range legacyNanos {
+			msg, err := command.MarshalEvent(testEvent(t, nano))
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put([]byte(fmt.Sprintf("%d", nano)), msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// checkMigrated checks that the events of setupLegacyDB are archived newest
+// first under KeySize keys.
+func checkMigrated(t *testing.T, db *bolt.DB) {
+	svc, err := NewService(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := svc.Events(context.Background(), audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := len(legacyNanos), len(events); want != have {
+		t.Fatalf("want %d events, have %d", want, have)
+	}
+	for i, e := range events {
+		if want, have := legacyNanos[len(legacyNanos)-1-i], e.Time.UnixNano(); want != have {
+			t.Errorf("event %d: want time %d, have %d", i, want, have)
+		}
+		if want, have := KeySize, len(e.ArchiveKey); want != have {
+			t.Errorf("event %d: want key size %d, have %d", i, want, have)
+		}
+	}
+}
+
+func testEvent(t *testing.T, nano int64) *command.Event {
+	payload, err := mdm.NewPayload(&mdm.CommandRequest{RequestType: "DeviceInformation"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := command.NewEvent(*payload)
+	event.Time = time.Unix(0, nano).UTC()
+	return event
+}
@@ -0,0 +1,128 @@
+package simple
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validTopic matches the topic names which nsqd accepts.
+var validTopic = regexp.MustCompile(`^[\.a-zA-Z0-9_-]{1,64}$`)
+
+// Route publishes the events which match it to Topic. A route matches an
+// event if all of its non-empty fields match.
+type Route struct {
+	// Topic is the NSQ topic. The {request_type} and {udid} placeholders
+	// are replaced with the request type and UDID of the event, ex:
+	// "mdm.Command.{request_type}" publishes to a topic per request type.
+	Topic string
+
+	// RequestTypes matches events with one of the request types.
+	RequestTypes []string
+
+	// UDIDPrefix matches events of devices whose UDID has the prefix.
+	UDIDPrefix string
+
+	// Group matches events of the devices in the group of the Routing.
+	Group string
+}
+
+// Routing configures the topics events are published to, in addition to
+// CommandTopic.
+type Routing struct {
+	Routes []Route
+
+	// Groups are named sets of UDIDs which routes can match.
+	Groups map[string][]string
+}
+
+// WithRouting publishes events to the topics of the routes they match.
+// Events are published to CommandTopic first. NewCommand fails if the
+// event can not be published to CommandTopic, and logs the topics of
+// routes it can not be published to, so that a retry of the request does
+// not create the command twice. Routes whose topic is not a valid NSQ topic
+// for the request type and UDID of an event are logged and skipped.
+func WithRouting(r Routing) Option {
+	return func(svc *CommandService) {
+		svc.router = newRouter(r)
+	}
+}
+
+// Validate checks that every route has a topic, matches on at least one
+// field and refers to a group of the Routing.
+func (r Routing) Validate() error {
+	for i, route := range r.Routes {
+		topic := strings.NewReplacer("{request_type}", "x", "{udid}", "x").Replace(route.Topic)
+		if !validTopic.MatchString(topic) {
+			return fmt.Errorf("route %d: invalid topic %q", i, route.Topic)
+		}
+		if len(route.RequestTypes) == 0 && route.UDIDPrefix == "" && route.Group == "" {
+			return fmt.Errorf("route %d: request types, UDID prefix or group required", i)
+		}
+		if _, ok := r.Groups[route.Group]; route.Group != "" && !ok {
+			return fmt.Errorf("route %d: unknown group %q", i, route.Group)
+		}
+	}
+	return nil
+}
+
+// router matches events against a Routing.
+type router struct {
+	Routing
+	groups map[string]map[string]bool // UDIDs of each group
+}
+
+func newRouter(r Routing) *router {
+	groups := make(map[string]map[string]bool)
+	for name, udids := range r.Groups {
+		groups[name] = make(map[string]bool)
+		for _, udid := range udids {
+			groups[name][udid] = true
+		}
+	}
+	return &router{Routing: r, groups: groups}
+}
+
+// topics returns the topics of the routes an event matches, other than
+// CommandTopic, and the topics which are skipped because they are not
+// valid topic names.
+func (r *router) topics(requestType, udid string) (routed, skipped []string) {
+	seen := map[string]bool{CommandTopic: true}
+	for _, route := range r.Routes {
+		if !r.match(route, requestType, udid) {
+			continue
+		}
+		topic := strings.NewReplacer("{request_type}", requestType, "{udid}", udid).Replace(route.Topic)
+		if !validTopic.MatchString(topic) {
+			skipped = append(skipped, topic)
+			continue
+		}
+		if !seen[topic] {
+			seen[topic] = true
+			routed = append(routed, topic)
+		}
+	}
+	return routed, skipped
+}
+
+func (r *router) match(route Route, requestType, udid string) bool {
+	if len(route.RequestTypes) > 0 && !contains(route.RequestTypes, requestType) {
+		return false
+	}
+	if route.UDIDPrefix != "" && !strings.HasPrefix(udid, route.UDIDPrefix) {
+		return false
+	}
+	if route.Group != "" && !r.groups[route.Group][udid] {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package simple
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+)
+
+func TestRouting_topics(t *testing.T) {
+	routing := Routing{
+		Routes: []Route{
+			{Topic: "mdm.Command.apps", RequestTypes: []string{"InstallApplication"}},
+			{Topic: "mdm.Command.{request_type}", UDIDPrefix: "lab-"},
+			{Topic: "mdm.Command.kiosk", Group: "kiosks"},
+			{Topic: "mdm.Command.kiosk", Group: "kiosks", RequestTypes: []string{"DeviceLock"}},
+			{Topic: "mdm.Command.device.{udid}", Group: "kiosks", RequestTypes: []string{"EraseDevice"}},
+			{Topic: CommandTopic, UDIDPrefix: "all-"},
+		},
+		Groups: map[string][]string{"kiosks": {"kiosk-1", "kiosk-2"}},
+	}
+
+	tests := []struct {
+		name        string
+		requestType string
+		udid        string
+		want        []string
+	}{
+		{
+			name:        "no_route",
+			requestType: "DeviceInformation",
+			udid:        "foo",
+			want:        nil,
+		},
+		{
+			name:        "request_type",
+			requestType: "InstallApplication",
+			udid:        "foo",
+			want:        []string{"mdm.Command.apps"},
+		},
+		{
+			name:        "udid_prefix",
+			requestType: "DeviceInformation",
+			udid:        "lab-1",
+			want:        []string{"mdm.Command.DeviceInformation"},
+		},
+		{
+			name:        "group_once",
+			requestType: "DeviceLock",
+			udid:        "kiosk-1",
+			want:        []string{"mdm.Command.kiosk"},
+		},
+		{
+			name:        "per_device",
+			requestType: "EraseDevice",
+			udid:        "kiosk-2",
+			want:        []string{"mdm.Command.kiosk", "mdm.Command.device.kiosk-2"},
+		},
+		{
+			name:        "command_topic_once",
+			requestType: "DeviceInformation",
+			udid:        "all-1",
+			want:        nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			have, skipped := newRouter(routing).topics(tt.requestType, tt.udid)
+			if len(skipped) > 0 {
+				t.Fatalf("want no skipped topics, have %v", skipped)
+			}
+			if !reflect.DeepEqual(tt.want, have) {
+				t.Errorf("want topics %v, have %v", tt.want, have)
+			}
+		})
+	}
+
+	// routes whose topic is invalid for the UDID are skipped.
+	routing.Groups["kiosks"] = append(routing.Groups["kiosks"], "kiosk 3")
+	routed, skipped := newRouter(routing).topics("EraseDevice", "kiosk 3")
+	if want, have := []string{"mdm.Command.kiosk"}, routed; !reflect.DeepEqual(want, have) {
+		t.Errorf("want topics %v, have %v", want, have)
+	}
+	if want, have := []string{"mdm.Command.device.kiosk 3"}, skipped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want skipped topics %v, have %v", want, have)
+	}
+}
+
+func TestRouting_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		route Route
+	}{
+		{name: "no_topic", route: Route{RequestTypes: []string{"DeviceLock"}}},
+		{name: "invalid_topic", route: Route{Topic: "mdm Command", RequestTypes: []string{"DeviceLock"}}},
+		{name: "no_match", route: Route{Topic: "mdm.Command.all"}},
+		{name: "unknown_group", route: Route{Topic: "mdm.Command.lab", Group: "lab"}},
+	}
+	for _, tt := range tests {
+		if err := (Routing{Routes: []Route{tt.route}}).Validate(); err == nil {
+			t.Errorf("%s: want error", tt.name)
+		}
+	}
+}
+
+func TestService_routing(t *testing.T) {
+	var topics []string
+	publisher := &mockPublisher{
+		PublishFn: func(topic string, _ []byte) error {
+			topics = append(topics, topic)
+			return nil
+		},
+	}
+	svc, err := NewService(setupDB(t).db, publisher, WithRouting(Routing{Routes: []Route{
+		{Topic: "mdm.Command.{udid}", RequestTypes: []string{"DeviceInformation"}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{CommandTopic, "mdm.Command.foobarbaz"}, topics; !reflect.DeepEqual(want, have) {
+		t.Errorf("want topics %v, have %v", want, have)
+	}
+
+	// an event which can not be published to a route is still created,
+	// because it was published to CommandTopic.
+	topics = nil
+	publisher.PublishFn = func(topic string, _ []byte) error {
+		topics = append(topics, topic)
+		if topic != CommandTopic {
+			return errors.New("nsqd unavailable")
+		}
+		return nil
+	}
+	if _, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	}); err != nil {
+		t.Fatalf("want route publish errors logged, have %v", err)
+	}
+	if want, have := []string{CommandTopic, "mdm.Command.foobarbaz"}, topics; !reflect.DeepEqual(want, have) {
+		t.Errorf("want topics %v, have %v", want, have)
+	}
+
+	// no route is published to if CommandTopic fails.
+	topics = nil
+	publisher.PublishFn = func(topic string, _ []byte) error {
+		topics = append(topics, topic)
+		return errors.New("nsqd unavailable")
+	}
+	_, err = svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if _, ok := err.(publishError); !ok {
+		t.Fatalf("want publishError, have %v", err)
+	}
+	if want, have := []string{CommandTopic}, topics; !reflect.DeepEqual(want, have) {
+		t.Errorf("want topics %v, have %v", want, have)
+	}
+
+	// a route whose topic is invalid for the UDID is skipped.
+	topics = nil
+	publisher.PublishFn = func(topic string, _ []byte) error {
+		topics = append(topics, topic)
+		return nil
+	}
+	if _, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foo/bar",
+	}); err != nil {
+		t.Fatalf("want invalid route topics skipped, have %v", err)
+	}
+	if want, have := []string{CommandTopic}, topics; !reflect.DeepEqual(want, have) {
+		t.Errorf("want topics %v, have %v", want, have)
+	}
+}
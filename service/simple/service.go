@@ -3,15 +3,24 @@
 package simple
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
 	"github.com/micromdm/mdm"
-	nsq "github.com/nsqio/go-nsq"
 	"golang.org/x/net/context"
 
 	"github.com/micromdm/command"
+	"github.com/micromdm/command/audit"
+	"github.com/micromdm/command/envelope"
+	"github.com/micromdm/command/profile"
 )
 
 const (
@@ -20,35 +29,190 @@ const (
 	CommandBucket = "mdm.Command.ARCHIVE"
 
 	// CommandTopic is an NSQ topic that events are published to.
+	// Events can also be published to other topics with WithRouting.
 	CommandTopic = "mdm.Command"
 )
 
-// The publisher interface is satisfied by an NSQ producer.
-// Only used in tests.
-type publisher interface {
-	Publish(string, []byte) error
+// Publisher publishes events to an NSQ topic. It is satisfied by an
+// *nsq.Producer and by a *publisher.Pool.
+type Publisher interface {
+	Publish(topic string, body []byte) error
+}
+
+// The sealer interface is satisfied by an *envelope.Keyring.
+type sealer interface {
+	Seal([]byte) ([]byte, error)
+	Open([]byte) ([]byte, error)
 }
 
 // CommandService creates new MDM Payload and publishes them to an NSQ topic.
 // The CommandService also archives all commands to a BoltDB bucket.
 type CommandService struct {
-	db *bolt.DB
-	publisher
+	db        *bolt.DB
+	publisher Publisher
+	sealer    sealer
+	router    *router
+	batching  *Batching
+	batcher   *batcher // publishes in batches
+	archiver  *batcher // archives in batches
+	metrics   Metrics
+	logger    log.Logger
+	tracer    Tracer
+	size      int64 // number of archived events, updated atomically
+
+	mu        sync.RWMutex
+	listeners []Listener
+}
+
+// Option configures a CommandService.
+type Option func(*CommandService)
+
+// WithLogger logs the events which can not be published to the topics of
+// their routes, or whose routes expand to invalid topics.
+func WithLogger(logger log.Logger) Option {
+	return func(svc *CommandService) {
+		svc.logger = logger
+	}
 }
 
-// NewService creates a CommandService.
-func NewService(db *bolt.DB, producer *nsq.Producer) (*CommandService, error) {
+// WithKeyring encrypts archived events with the keyring. Events are
+// published to NSQ unencrypted.
+func WithKeyring(k *envelope.Keyring) Option {
+	return func(svc *CommandService) {
+		svc.sealer = k
+	}
+}
+
+// Tracer traces the archive transactions and NSQ publishes of NewCommand.
+// It is satisfied by a *tracing.ServiceTracer.
+type Tracer interface {
+	// InjectEvent records the trace context of ctx in a new event.
+	InjectEvent(ctx context.Context, e *command.Event)
+
+	// TraceArchive and TracePublish start a span and return a function
+	// which ends it with the error of the operation.
+	TraceArchive(ctx context.Context, bucket string) func(error)
+	TracePublish(ctx context.Context, topic string) func(error)
+}
+
+type nopTracer struct{}
+
+func (nopTracer) InjectEvent(context.Context, *command.Event)      {}
+func (nopTracer) TraceArchive(context.Context, string) func(error) { return func(error) {} }
+func (nopTracer) TracePublish(context.Context, string) func(error) { return func(error) {} }
+
+// WithTracer records the archive transactions and NSQ publishes as spans.
+func WithTracer(tracer Tracer) Option {
+	return func(svc *CommandService) {
+		svc.tracer = tracer
+	}
+}
+
+// Metrics of a CommandService.
+type Metrics struct {
+	// ArchiveSize is the number of archived events.
+	ArchiveSize metrics.Gauge
+
+	// TxDuration observes the seconds of each BoltDB transaction by
+	// "op": archive, events, events_after or prune.
+	TxDuration metrics.Histogram
+
+	// PublishDuration observes the seconds spent publishing each event
+	// to NSQ by "success".
+	PublishDuration metrics.Histogram
+}
+
+// WithMetrics instruments the archive and the NSQ producer.
+func WithMetrics(m Metrics) Option {
+	return func(svc *CommandService) {
+		if m.ArchiveSize != nil {
+			svc.metrics.ArchiveSize = m.ArchiveSize
+		}
+		if m.TxDuration != nil {
+			svc.metrics.TxDuration = m.TxDuration
+		}
+		if m.PublishDuration != nil {
+			svc.metrics.PublishDuration = m.PublishDuration
+		}
+	}
+}
+
+// archiveError is returned when an event can not be archived.
+type archiveError struct{ error }
+
+func (e archiveError) Outcome() string { return command.OutcomeArchiveError }
+
+// publishError is returned when an event can not be published.
+type publishError struct{ error }
+
+func (e publishError) Outcome() string { return command.OutcomePublishError }
+
+// payloadError is returned when the request can not be turned into an MDM
+// Payload, ex: for an unsupported request type.
+type payloadError struct{ error }
+
+func (e payloadError) InvalidRequest() bool { return true }
+
+// Listener is called with every event after it is archived and published.
+// Listeners are called synchronously by NewCommand and must not block.
+type Listener func(*command.Event)
+
+// Subscribe registers a Listener for new events.
+func (svc *CommandService) Subscribe(l Listener) {
+	svc.mu.Lock()
+	svc.listeners = append(svc.listeners, l)
+	svc.mu.Unlock()
+}
+
+// NewService creates a CommandService. The decimal keys of events archived
+// by earlier versions are converted in the transaction which opens the
+// bucket.
+func NewService(db *bolt.DB, producer Publisher, opts ...Option) (*CommandService, error) {
+	var size int
 	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(CommandBucket))
+		bkt, err := tx.CreateBucketIfNotExists([]byte(CommandBucket))
 		if err != nil {
 			return fmt.Errorf("create bucket: %s", err)
 		}
+		// archives of earlier versions have decimal keys.
+		if hasLegacyKeys(bkt) {
+			if _, err := migrateKeys(bkt, nil, 0, false, &KeyMigrationResult{}); err != nil {
+				return fmt.Errorf("migrate keys: %s", err)
+			}
+		}
+		size = bkt.Stats().KeyN
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &CommandService{db, producer}, nil
+	svc := &CommandService{
+		db:        db,
+		publisher: producer,
+		size:      int64(size),
+		router:    newRouter(Routing{}),
+		logger:    log.NewNopLogger(),
+		tracer:    nopTracer{},
+		metrics: Metrics{
+			ArchiveSize:     discard.NewGauge(),
+			TxDuration:      discard.NewHistogram(),
+			PublishDuration: discard.NewHistogram(),
+		},
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	if err := svc.router.Validate(); err != nil {
+		return nil, err
+	}
+	if svc.batching != nil {
+		svc.batcher = newBatcher(*svc.batching, func(batch []*batchRequest) {
+			publishBatch(producer, batch)
+		})
+		svc.archiver = newBatcher(*svc.batching, svc.archiveBatch)
+	}
+	svc.metrics.ArchiveSize.Set(float64(size))
+	return svc, nil
 }
 
 // NewCommand creates an MDM Payload from an MDM request.
@@ -58,37 +222,226 @@ func (svc *CommandService) NewCommand(ctx context.Context, request *mdm.CommandR
 	}
 	payload, err := mdm.NewPayload(request)
 	if err != nil {
-		return nil, err
+		return nil, payloadError{err}
 	}
 	event := command.NewEvent(*payload)
+	event.UDID = request.UDID
+	event.Origin, _ = command.OriginFromContext(ctx)
+	event.CorrelationID, _ = command.CorrelationIDFromContext(ctx)
+	svc.tracer.InjectEvent(ctx, event)
+	if s, ok := command.SchedulingFromContext(ctx); ok {
+		event.Priority = s.Priority
+		event.DependsOn = s.DependsOn
+	}
+	if request.RequestType == "InstallProfile" {
+		if insp, err := profile.Inspect(request.Payload); err == nil {
+			event.ProfileIdentifier = insp.Identifier
+		}
+	}
+	topics, skipped := svc.router.topics(request.RequestType, request.UDID)
+	for _, topic := range skipped {
+		svc.logger.Log("msg", "skip route with invalid topic", "topic", topic, "event", event.ID)
+	}
 	msg, err := command.MarshalEvent(event)
 	if err != nil {
 		return nil, err
 	}
-	if err := svc.archive(event.Time.UnixNano(), msg); err != nil {
-		return nil, err
+	key, err := svc.archive(ctx, event.Time.UnixNano(), msg)
+	if err != nil {
+		return nil, archiveError{err}
 	}
-	if err := svc.Publish(CommandTopic, msg); err != nil {
-		return nil, err
+	event.ArchiveKey = key
+	if err := svc.publish(ctx, CommandTopic, msg); err != nil {
+		return nil, publishError{err}
+	}
+	for _, topic := range topics {
+		if err := svc.publish(ctx, topic, msg); err != nil {
+			svc.logger.Log("msg", "publish to route", "topic", topic, "event", event.ID, "err", err)
+		}
 	}
+	svc.mu.RLock()
+	for _, l := range svc.listeners {
+		l(event)
+	}
+	svc.mu.RUnlock()
 	return payload, nil
 }
 
-// archive events to BoltDB bucket using timestamp as key to preserve order.
-func (svc *CommandService) archive(nano int64, msg []byte) error {
+// publish an event to NSQ and observe the duration.
+func (svc *CommandService) publish(ctx context.Context, topic string, msg []byte) (err error) {
+	end := svc.tracer.TracePublish(ctx, topic)
+	defer func(begin time.Time) {
+		svc.metrics.PublishDuration.With("success", fmt.Sprint(err == nil)).Observe(time.Since(begin).Seconds())
+		end(err)
+	}(time.Now())
+	if svc.batcher != nil {
+		return svc.batcher.do(&batchRequest{topic: topic, body: msg})
+	}
+	return svc.publisher.Publish(topic, msg)
+}
+
+// observeTx observes the duration of a BoltDB transaction.
+func (svc *CommandService) observeTx(op string, begin time.Time) {
+	svc.metrics.TxDuration.With("op", op).Observe(time.Since(begin).Seconds())
+}
+
+// archive events to BoltDB bucket using timestamp and sequence as key to
+// preserve order, and return the key.
+func (svc *CommandService) archive(ctx context.Context, nano int64, msg []byte) (key []byte, err error) {
+	end := svc.tracer.TraceArchive(ctx, CommandBucket)
+	defer func() { end(err) }()
+	defer svc.observeTx("archive", time.Now())
+	if svc.archiver != nil {
+		return svc.archiveBatched(nano, msg)
+	}
 	tx, err := svc.db.Begin(true)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
 	bkt := tx.Bucket([]byte(CommandBucket))
 	if bkt == nil {
-		return fmt.Errorf("bucket %q not found!", CommandBucket)
+		return nil, fmt.Errorf("bucket %q not found!", CommandBucket)
+	}
+	if svc.sealer != nil {
+		if msg, err = svc.sealer.Seal(msg); err != nil {
+			return nil, err
+		}
+	}
+	seq, err := bkt.NextSequence()
+	if err != nil {
+		return nil, err
 	}
-	key := []byte(fmt.Sprintf("%d", nano))
+	key = eventKey(nano, seq)
 	if err := bkt.Put(key, msg); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	svc.metrics.ArchiveSize.Set(float64(atomic.AddInt64(&svc.size, 1)))
+	return key, nil
+}
+
+// archiveBatched archives the event in a transaction shared with
+// concurrent calls.
+func (svc *CommandService) archiveBatched(nano int64, msg []byte) (key []byte, err error) {
+	if svc.sealer != nil {
+		if msg, err = svc.sealer.Seal(msg); err != nil {
+			return nil, err
+		}
+	}
+	req := &batchRequest{body: msg, nano: nano}
+	if err := svc.archiver.do(req); err != nil {
+		return nil, err
+	}
+	return req.key, nil
+}
+
+// Events returns the archived events which match the filter, newest first.
+func (svc *CommandService) Events(ctx context.Context, filter audit.Filter) ([]command.Event, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = audit.DefaultLimit
+	}
+	defer svc.observeTx("events", time.Now())
+	var events []command.Event
+	err := svc.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(CommandBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", CommandBucket)
+		}
+		c := bkt.Cursor()
+		for k, v := c.Last(); k != nil && len(events) < limit; k, v = c.Prev() {
+			var event command.Event
+			if err := svc.unmarshal(k, v, &event); err != nil {
+				return err
+			}
+			if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+				break
+			}
+			if filter.Match(&event) {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// EventsAfterKey returns up to limit archived events which were archived
+// after the event with the ArchiveKey after, oldest first.
+func (svc *CommandService) EventsAfterKey(ctx context.Context, after []byte, limit int) ([]command.Event, error) {
+	return svc.eventsFrom(append(append([]byte(nil), after...), 0), limit)
+}
+
+// eventsFrom returns up to limit archived events with a key at or after
+// start, oldest first.
+func (svc *CommandService) eventsFrom(start []byte, limit int) ([]command.Event, error) {
+	defer svc.observeTx("events_after", time.Now())
+	var events []command.Event
+	err := svc.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(CommandBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", CommandBucket)
+		}
+		c := bkt.Cursor()
+		for k, v := c.Seek(start); k != nil && len(events) < limit; k, v = c.Next() {
+			var event command.Event
+			if err := svc.unmarshal(k, v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Prune deletes the archived events which are older than before, and
+// returns the number of deleted events.
+func (svc *CommandService) Prune(ctx context.Context, before time.Time) (int, error) {
+	defer svc.observeTx("prune", time.Now())
+	var n int
+	err := svc.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(CommandBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", CommandBucket)
+		}
+		// collect the keys first, deleting with the cursor skips keys.
+		var keys [][]byte
+		end := timeKey(before)
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	svc.metrics.ArchiveSize.Set(float64(atomic.AddInt64(&svc.size, -int64(n))))
+	return n, nil
+}
+
+// unmarshal decrypts and parses the event archived under the key.
+func (svc *CommandService) unmarshal(key, data []byte, e *command.Event) error {
+	if svc.sealer != nil {
+		var err error
+		if data, err = svc.sealer.Open(data); err != nil {
+			return err
+		}
+	}
+	if err := command.UnmarshalEvent(data, e); err != nil {
 		return err
 	}
-	return tx.Commit()
+	e.ArchiveKey = append([]byte(nil), key...)
+	return nil
 }
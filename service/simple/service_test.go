@@ -1,14 +1,22 @@
 package simple
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/metrics"
 	"github.com/micromdm/mdm"
 	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/audit"
+	"github.com/micromdm/command/envelope"
 )
 
 func TestService_NewCommand(t *testing.T) {
@@ -70,6 +78,308 @@ func TestService_NewCommand(t *testing.T) {
 	}
 }
 
+func TestService_ArchiveProfileIdentifier(t *testing.T) {
+	svc := setupDB(t)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	profile := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadIdentifier</key>
+	<string>com.example.profile</string>
+</dict>
+</plist>`)
+	_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "InstallProfile",
+		UDID:        "foobarbaz",
+		Payload:     profile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event command.Event
+	err = svc.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket([]byte(CommandBucket)).Cursor().Last()
+		return command.UnmarshalEvent(v, &event)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "com.example.profile", event.ProfileIdentifier; want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestService_Events(t *testing.T) {
+	svc := setupDB(t)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	requests := []struct {
+		caller      string
+		requestType string
+	}{
+		{"alice", "DeviceInformation"},
+		{"bob", "EraseDevice"},
+		{"alice", "EraseDevice"},
+	}
+	for _, r := range requests {
+		ctx := command.NewOriginContext(context.Background(), command.Origin{Caller: r.caller})
+		_, err := svc.NewCommand(ctx, &mdm.CommandRequest{
+			RequestType: r.requestType,
+			UDID:        "foobarbaz",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := svc.Events(context.Background(), audit.Filter{
+		Caller:       "alice",
+		RequestTypes: []string{"EraseDevice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(events); want != have {
+		t.Fatalf("want %d events, have %d", want, have)
+	}
+	if want, have := "foobarbaz", events[0].UDID; want != have {
+		t.Errorf("want udid %q, have %q", want, have)
+	}
+
+	events, err = svc.Events(context.Background(), audit.Filter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(events); want != have {
+		t.Fatalf("want %d events, have %d", want, have)
+	}
+	if events[0].Origin.Caller != "alice" || events[1].Origin.Caller != "bob" {
+		t.Errorf("events are not ordered newest first: %#v", events)
+	}
+}
+
+func TestService_EventsAfterKey(t *testing.T) {
+	svc := setupDB(t)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	var events []*command.Event
+	svc.Subscribe(func(e *command.Event) { events = append(events, e) })
+	for i := 0; i < 3; i++ {
+		_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+			RequestType: "DeviceInformation",
+			UDID:        "foobarbaz",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := 3, len(events); want != have {
+		t.Fatalf("want %d events passed to the listener, have %d", want, have)
+	}
+
+	after, err := svc.EventsAfterKey(context.Background(), events[0].ArchiveKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(after); want != have {
+		t.Fatalf("want %d events, have %d", want, have)
+	}
+	if after[0].ID != events[1].ID || after[1].ID != events[2].ID {
+		t.Errorf("events are not ordered oldest first: %#v", after)
+	}
+
+	after, err = svc.EventsAfterKey(context.Background(), events[0].ArchiveKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(after); want != have {
+		t.Fatalf("want %d events, have %d", want, have)
+	}
+}
+
+func TestService_Prune(t *testing.T) {
+	svc := setupDB(t)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	var events []*command.Event
+	svc.Subscribe(func(e *command.Event) { events = append(events, e) })
+	for i := 0; i < 3; i++ {
+		_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+			RequestType: "DeviceInformation",
+			UDID:        "foobarbaz",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := &gauge{}
+	WithMetrics(Metrics{ArchiveSize: size})(svc)
+
+	n, err := svc.Prune(context.Background(), events[2].Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, n; want != have {
+		t.Fatalf("want %d pruned events, have %d", want, have)
+	}
+	if want, have := 1.0, size.value; want != have {
+		t.Errorf("want archive size %v, have %v", want, have)
+	}
+	archived, err := svc.Events(context.Background(), audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archived) != 1 || archived[0].ID != events[2].ID {
+		t.Errorf("want only the newest event archived, have %#v", archived)
+	}
+}
+
+func TestService_encryptedArchive(t *testing.T) {
+	svc := setupDB(t)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	keyring, err := envelope.NewKeyring("k1", map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	WithKeyring(keyring)(svc)
+
+	_, err = svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = svc.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket([]byte(CommandBucket)).Cursor().Last()
+		if !envelope.IsSealed(v) {
+			t.Error("archived event is not encrypted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := svc.Events(context.Background(), audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(events); want != have {
+		t.Fatalf("want %d events, have %d", want, have)
+	}
+	if want, have := "foobarbaz", events[0].UDID; want != have {
+		t.Errorf("want udid %q, have %q", want, have)
+	}
+}
+
+func TestService_outcomes(t *testing.T) {
+	svc := setupDB(t)
+	size := &gauge{}
+	WithMetrics(Metrics{ArchiveSize: size})(svc)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return errors.New("nsqd unavailable") },
+	}
+	_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if want, have := command.OutcomePublishError, command.ErrorOutcome(err); want != have {
+		t.Errorf("want outcome %q, have %q", want, have)
+	}
+	// the event is archived before it is published.
+	if want, have := 1.0, size.value; want != have {
+		t.Errorf("want archive size %v, have %v", want, have)
+	}
+
+	_, err = svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DevicePropaganda",
+		UDID:        "foobarbaz",
+	})
+	if want, have := command.OutcomeValidationError, command.ErrorOutcome(err); want != have {
+		t.Errorf("want outcome %q, have %q", want, have)
+	}
+
+	svc.db.Close()
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	_, err = svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if want, have := command.OutcomeArchiveError, command.ErrorOutcome(err); want != have {
+		t.Errorf("want outcome %q, have %q", want, have)
+	}
+}
+
+func TestService_tracing(t *testing.T) {
+	svc := setupDB(t)
+	svc.publisher = &mockPublisher{
+		PublishFn: func(string, []byte) error { return nil },
+	}
+	tracer := &recordingTracer{}
+	WithTracer(tracer)(svc)
+
+	var event *command.Event
+	svc.Subscribe(func(e *command.Event) { event = e })
+	_, err := svc.NewCommand(context.Background(), &mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"archive " + CommandBucket, "end <nil>", "publish " + CommandTopic, "end <nil>"}
+	if have := tracer.calls; !reflect.DeepEqual(want, have) {
+		t.Errorf("want calls %v, have %v", want, have)
+	}
+	// the published event carries the trace context of NewCommand.
+	if want, have := "traceparent", event.TraceParent; want != have {
+		t.Errorf("want event trace parent %q, have %q", want, have)
+	}
+}
+
+// recordingTracer records the calls of a CommandService.
+type recordingTracer struct {
+	calls []string
+}
+
+func (t *recordingTracer) InjectEvent(ctx context.Context, e *command.Event) {
+	e.TraceParent = "traceparent"
+}
+
+func (t *recordingTracer) TraceArchive(ctx context.Context, bucket string) func(error) {
+	return t.start("archive " + bucket)
+}
+
+func (t *recordingTracer) TracePublish(ctx context.Context, topic string) func(error) {
+	return t.start("publish " + topic)
+}
+
+func (t *recordingTracer) start(call string) func(error) {
+	t.calls = append(t.calls, call)
+	return func(err error) { t.calls = append(t.calls, fmt.Sprintf("end %v", err)) }
+}
+
+type gauge struct{ value float64 }
+
+func (g *gauge) With(...string) metrics.Gauge { return g }
+func (g *gauge) Set(value float64)            { g.value = value }
+
 type mockPublisher struct {
 	PublishFn func(string, []byte) error
 }
@@ -78,7 +388,7 @@ func (m *mockPublisher) Publish(s string, b []byte) error {
 	return m.PublishFn(s, b)
 }
 
-func setupDB(t *testing.T) *CommandService {
+func setupDB(t testing.TB) *CommandService {
 	f, _ := ioutil.TempFile("", "bolt-")
 	f.Close()
 	os.Remove(f.Name())
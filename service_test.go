@@ -5,11 +5,16 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/groob/plist"
 
 	"github.com/micromdm/command/service/mock"
 	"github.com/micromdm/mdm"
@@ -26,6 +31,7 @@ func TestNewCommandHTTP(t *testing.T) {
 	var httpTests = []struct {
 		name         string
 		method       mock.NewCommandFunc
+		contentType  string
 		request      io.Reader
 		expectStatus int
 	}{
@@ -47,12 +53,64 @@ func TestNewCommandHTTP(t *testing.T) {
 			request:      neverEnding('a'),
 			expectStatus: http.StatusBadRequest,
 		},
+		{
+			name:         "invalid_request",
+			method:       failInvalidRequest,
+			request:      mustMarshalJSONRequest(t, &mdm.CommandRequest{RequestType: "SomeMDMCommand", UDID: "some-device"}),
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "unauthenticated",
+			method:       failUnauthenticated,
+			request:      mustMarshalJSONRequest(t, &mdm.CommandRequest{RequestType: "EraseDevice", UDID: "some-device"}),
+			expectStatus: http.StatusUnauthorized,
+		},
+		{
+			name:         "pending_approval",
+			method:       holdForApproval,
+			request:      mustMarshalJSONRequest(t, &mdm.CommandRequest{RequestType: "EraseDevice", UDID: "some-device"}),
+			expectStatus: http.StatusAccepted,
+		},
+		{
+			name:         "xml_plist",
+			method:       mock.ReturnMockPayload,
+			contentType:  "application/x-plist",
+			request:      mustMarshalPlistRequest(t, &mdm.CommandRequest{RequestType: "SomeMDMCommand", UDID: "some-device"}),
+			expectStatus: http.StatusCreated,
+		},
+		{
+			name:         "binary_plist",
+			method:       mock.ReturnMockPayload,
+			contentType:  "application/x-plist",
+			request:      mustLoadRequest(t, "DeviceInformation_request.bplist"),
+			expectStatus: http.StatusCreated,
+		},
+		{
+			name:         "bad_plist",
+			method:       mock.ReturnMockPayload,
+			contentType:  "application/xml",
+			request:      bytes.NewBufferString("<plist><dict><key>UDID</key>"),
+			expectStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "plist_limit_reader",
+			method:       mock.ReturnMockPayload,
+			contentType:  "application/x-plist",
+			request:      neverEnding('a'),
+			expectStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:         "json_limit_reader",
+			method:       mock.ReturnMockPayload,
+			request:      io.MultiReader(strings.NewReader(`{"udid":"`), neverEnding('a')),
+			expectStatus: http.StatusRequestEntityTooLarge,
+		},
 	}
 
 	for _, tt := range httpTests {
 		t.Run(tt.name, func(t *testing.T) {
 			client.svc.NewCommandFunc = tt.method
-			resp := client.Do(t, "POST", tt.request)
+			resp := client.Do(t, "POST", tt.contentType, tt.request)
 			if want, have := tt.expectStatus, resp.StatusCode; want != have {
 				t.Fatalf("want %d, have %d", want, have)
 			}
@@ -71,6 +129,208 @@ func TestNewCommandHTTP(t *testing.T) {
 	}
 }
 
+func TestBodyLimits(t *testing.T) {
+	client := setupWithLimits(t, BodyLimits{
+		MaxBodySize:  256,
+		Routes:       map[string]int64{RouteNewCommand: 512},
+		RequestTypes: map[string]int64{"InstallProfile": 8192},
+	})
+	defer client.Close()
+
+	var received *mdm.CommandRequest
+	client.svc.NewCommandFunc = func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+		received = req
+		return mock.MockPayload, nil
+	}
+	profile := bytes.Repeat([]byte("a"), 4096)
+
+	var tests = []struct {
+		name         string
+		contentType  string
+		request      io.Reader
+		expectStatus int
+	}{
+		{
+			name: "route_limit",
+			request: mustMarshalJSONRequest(t, &mdm.CommandRequest{
+				RequestType: "DeviceInformation",
+				UDID:        "some-device",
+				Queries:     []string{strings.Repeat("a", 300)},
+			}),
+			expectStatus: http.StatusCreated,
+		},
+		{
+			name: "route_limit_exceeded",
+			request: mustMarshalJSONRequest(t, &mdm.CommandRequest{
+				RequestType: "DeviceInformation",
+				UDID:        "some-device",
+				Queries:     []string{strings.Repeat("a", 1024)},
+			}),
+			expectStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "request_type_limit",
+			request: mustMarshalJSONRequest(t, &mdm.CommandRequest{
+				RequestType: "InstallProfile",
+				UDID:        "some-device",
+				Payload:     profile,
+			}),
+			expectStatus: http.StatusCreated,
+		},
+		{
+			name: "request_type_limit_exceeded",
+			request: mustMarshalJSONRequest(t, &mdm.CommandRequest{
+				RequestType: "InstallProfile",
+				UDID:        "some-device",
+				Payload:     bytes.Repeat([]byte("a"), 8192),
+			}),
+			expectStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := client.Do(t, "POST", tt.contentType, tt.request)
+			if want, have := tt.expectStatus, resp.StatusCode; want != have {
+				t.Fatalf("want %d, have %d", want, have)
+			}
+		})
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		req, err := mw.CreateFormField("request")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(req, mustMarshalJSONRequest(t, &mdm.CommandRequest{
+			RequestType: "InstallProfile",
+			UDID:        "some-device",
+		}))
+		file, err := mw.CreateFormFile("payload", "profile.mobileconfig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(profile)
+		mw.Close()
+
+		resp := client.Do(t, "POST", mw.FormDataContentType(), body)
+		if want, have := http.StatusCreated, resp.StatusCode; want != have {
+			t.Fatalf("want %d, have %d", want, have)
+		}
+		if !bytes.Equal(received.Payload, profile) {
+			t.Errorf("payload was not decoded from the multipart form")
+		}
+	})
+}
+
+func TestScheduling(t *testing.T) {
+	client := setup(t)
+	defer client.Close()
+
+	var received Scheduling
+	client.svc.NewCommandFunc = func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+		received, _ = SchedulingFromContext(ctx)
+		return mock.MockPayload, nil
+	}
+	want := Scheduling{Priority: PriorityHigh, DependsOn: []string{"a00258bc-b1d5-4c7e-addb-9c2215eb9c0f"}}
+
+	tests := []struct {
+		name         string
+		contentType  string
+		request      io.Reader
+		expectStatus int
+	}{
+		{
+			name:         "json",
+			request:      strings.NewReader(`{"request_type":"DeviceLock","udid":"some-device","priority":10,"depends_on":["a00258bc-b1d5-4c7e-addb-9c2215eb9c0f"]}`),
+			expectStatus: http.StatusCreated,
+		},
+		{
+			name:        "plist",
+			contentType: "application/x-plist",
+			request: mustMarshalPlistRequest(t, struct {
+				mdm.CommandRequest
+				Scheduling
+			}{mdm.CommandRequest{RequestType: "DeviceLock", UDID: "some-device"}, want}),
+			expectStatus: http.StatusCreated,
+		},
+		{
+			name:         "invalid_priority",
+			request:      strings.NewReader(`{"request_type":"DeviceLock","udid":"some-device","priority":5000}`),
+			expectStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = Scheduling{}
+			resp := client.Do(t, "POST", tt.contentType, tt.request)
+			if want, have := tt.expectStatus, resp.StatusCode; want != have {
+				t.Fatalf("want %d, have %d", want, have)
+			}
+			if resp.StatusCode != http.StatusCreated {
+				return
+			}
+			if !reflect.DeepEqual(want, received) {
+				t.Errorf("want scheduling %#v, have %#v", want, received)
+			}
+		})
+	}
+}
+
+func TestNewCommand_warnings(t *testing.T) {
+	client := setup(t)
+	defer client.Close()
+	client.svc.NewCommandFunc = func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+		AddWarning(ctx, Warning{Path: "Profile.PayloadContent", Message: "profile has no PayloadContent"})
+		return mock.MockPayload, nil
+	}
+	resp := client.Do(t, "POST", "", mustMarshalJSONRequest(t, &mdm.CommandRequest{
+		RequestType: "InstallProfile",
+		UDID:        "some-device",
+	}))
+	if want, have := http.StatusCreated, resp.StatusCode; want != have {
+		t.Fatalf("want %d, have %d", want, have)
+	}
+	var body struct {
+		Warnings []Warning `json:"warnings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := []Warning{{Path: "Profile.PayloadContent", Message: "profile has no PayloadContent"}}
+	if !reflect.DeepEqual(want, body.Warnings) {
+		t.Errorf("want warnings %v, have %v", want, body.Warnings)
+	}
+}
+
+type invalidRequestError string
+
+func (e invalidRequestError) Error() string        { return string(e) }
+func (e invalidRequestError) InvalidRequest() bool { return true }
+
+func failInvalidRequest(context.Context, *mdm.CommandRequest) (*mdm.Payload, error) {
+	return nil, invalidRequestError("invalid request")
+}
+
+type unauthenticatedError struct{}
+
+func (unauthenticatedError) Error() string         { return "unauthenticated" }
+func (unauthenticatedError) Unauthenticated() bool { return true }
+
+func failUnauthenticated(context.Context, *mdm.CommandRequest) (*mdm.Payload, error) {
+	return nil, unauthenticatedError{}
+}
+
+type pendingApprovalError string
+
+func (e pendingApprovalError) Error() string      { return "pending approval" }
+func (e pendingApprovalError) ApprovalID() string { return string(e) }
+
+func holdForApproval(context.Context, *mdm.CommandRequest) (*mdm.Payload, error) {
+	return nil, pendingApprovalError("1234")
+}
+
 // a never ending io.Reader for testing that the server terminates a request
 // with a too large body.
 type neverEnding byte
@@ -92,17 +352,36 @@ func mustMarshalJSONRequest(t *testing.T, req interface{}) *bytes.Buffer {
 
 }
 
+func mustMarshalPlistRequest(t *testing.T, req interface{}) *bytes.Buffer {
+	data, err := plist.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal plist request: %v", err)
+	}
+	return bytes.NewBuffer(data)
+}
+
+func mustLoadRequest(t *testing.T, name string) *bytes.Buffer {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("failed to open test file %q, err: %s", name, err)
+	}
+	return bytes.NewBuffer(data)
+}
+
 type client struct {
 	*httptest.Server
 	svc    *mock.CommandService
 	client *http.Client
 }
 
-func (s client) Do(t *testing.T, method string, body io.Reader) *http.Response {
+func (s client) Do(t *testing.T, method, contentType string, body io.Reader) *http.Response {
 	req, err := http.NewRequest(method, s.URL, body)
 	if err != nil {
 		t.Fatalf("failed to create http request, err = %v", err)
 	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 	resp, err := s.client.Do(req)
 	if err != nil {
 		t.Fatalf("http request failed: err = %v", err)
@@ -111,6 +390,10 @@ func (s client) Do(t *testing.T, method string, body io.Reader) *http.Response {
 }
 
 func setup(t *testing.T) client {
+	return setupWithLimits(t, BodyLimits{})
+}
+
+func setupWithLimits(t *testing.T, limits BodyLimits) client {
 	svc := &mock.CommandService{}
 	e := Endpoints{
 		NewCommandEndpoint: MakeNewCommandEndpoint(svc),
@@ -118,6 +401,7 @@ func setup(t *testing.T) client {
 	h := MakeHTTPHandlers(
 		context.Background(),
 		e,
+		limits,
 		httptransport.ServerErrorEncoder(EncodeError),
 	)
 	s := httptest.NewServer(h.NewCommandHandler)
@@ -0,0 +1,116 @@
+// Package shutdown stops the components of commandsvc in order.
+//
+// Components register a step with a Manager as they are started. On
+// shutdown the steps run one at a time in the reverse order, like deferred
+// calls, so that a component is stopped before the components it depends
+// on: the HTTP server stops accepting requests before the consumers are
+// drained, and the Bolt DB which was opened first is closed last.
+package shutdown
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+// DefaultTimeout is the time all steps may take together.
+const DefaultTimeout = 30 * time.Second
+
+// Manager runs the shutdown steps of the registered components.
+type Manager struct {
+	// Timeout is the time all steps may take together. Steps which run
+	// after the timeout get a context which is already done.
+	Timeout time.Duration
+
+	Logger log.Logger
+
+	mu    sync.Mutex
+	steps []step
+	once  sync.Once
+	err   error
+}
+
+type step struct {
+	name string
+	stop func(context.Context) error
+}
+
+// NewManager creates a Manager.
+func NewManager(timeout time.Duration, logger log.Logger) *Manager {
+	return &Manager{Timeout: timeout, Logger: logger}
+}
+
+// Add registers the stop function of a component. Components must be
+// added in the order they are started.
+func (m *Manager) Add(name string, stop func(context.Context) error) {
+	m.mu.Lock()
+	m.steps = append(m.steps, step{name: name, stop: stop})
+	m.mu.Unlock()
+}
+
+// Shutdown runs the steps in the reverse order they were added. A failed
+// step does not stop the shutdown; Shutdown returns the error of the first
+// failed step. Steps run only once, later calls return the same error.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.once.Do(func() { m.err = m.shutdown(ctx) })
+	return m.err
+}
+
+func (m *Manager) shutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	m.mu.Lock()
+	steps := make([]step, len(m.steps))
+	copy(steps, m.steps)
+	m.mu.Unlock()
+
+	var first error
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		begin := time.Now()
+		err := s.stop(ctx)
+		m.Logger.Log("msg", "shutdown", "component", s.name, "took", time.Since(begin), "err", err)
+		if err != nil && first == nil {
+			first = fmt.Errorf("shutdown %s: %s", s.name, err)
+		}
+	}
+	return first
+}
+
+// Func adapts a stop function which does not accept a context, for example
+// (*nsq.Producer).Stop. If ctx is done before stop returns, the step fails
+// with ctx.Err() and stop keeps running in the background.
+func Func(stop func()) func(context.Context) error {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			stop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ErrFunc is like Func, for stop functions which return an error, for
+// example (*bolt.DB).Close.
+func ErrFunc(stop func() error) func(context.Context) error {
+	return func(ctx context.Context) error {
+		errc := make(chan error, 1)
+		go func() { errc <- stop() }()
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
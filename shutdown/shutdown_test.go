@@ -0,0 +1,85 @@
+package shutdown
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/context"
+)
+
+func TestManager_order(t *testing.T) {
+	m := NewManager(time.Second, log.NewNopLogger())
+	var stopped []string
+	for _, name := range []string{"bolt", "nsqd", "http"} {
+		name := name
+		m.Add(name, func(context.Context) error {
+			stopped = append(stopped, name)
+			return nil
+		})
+	}
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"http", "nsqd", "bolt"}, stopped; !reflect.DeepEqual(want, have) {
+		t.Errorf("want steps %v, have %v", want, have)
+	}
+
+	// a second shutdown does not run the steps again.
+	m.Shutdown(context.Background())
+	if want, have := 3, len(stopped); want != have {
+		t.Errorf("want %d steps, have %d", want, have)
+	}
+}
+
+func TestManager_errors(t *testing.T) {
+	m := NewManager(time.Second, log.NewNopLogger())
+	var closed bool
+	m.Add("bolt", func(context.Context) error {
+		closed = true
+		return nil
+	})
+	m.Add("producer", func(context.Context) error { return errors.New("producer failed") })
+	m.Add("http", func(context.Context) error { return errors.New("http failed") })
+
+	err := m.Shutdown(context.Background())
+	if want, have := "shutdown http: http failed", err.Error(); want != have {
+		t.Errorf("want error %q, have %q", want, have)
+	}
+	if !closed {
+		t.Error("want steps after a failed step to run")
+	}
+}
+
+func TestManager_timeout(t *testing.T) {
+	m := NewManager(50*time.Millisecond, log.NewNopLogger())
+	block := make(chan struct{})
+	defer close(block)
+	var closed error
+	m.Add("bolt", func(ctx context.Context) error {
+		closed = ctx.Err()
+		return nil
+	})
+	m.Add("outbox", Func(func() { <-block }))
+
+	begin := time.Now()
+	err := m.Shutdown(context.Background())
+	if err == nil {
+		t.Fatal("want timeout error")
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("shutdown took %s", took)
+	}
+	if want, have := context.DeadlineExceeded, closed; want != have {
+		t.Errorf("want bolt step context error %v, have %v", want, have)
+	}
+}
+
+func TestErrFunc(t *testing.T) {
+	want := errors.New("close failed")
+	if have := ErrFunc(func() error { return want })(context.Background()); want != have {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,98 @@
+// Package stream pushes new command events to HTTP clients as
+// Server-Sent Events.
+package stream
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/audit"
+)
+
+// BufferSize is the number of events buffered for each subscriber.
+// Subscribers which fall further behind are disconnected, and resume
+// from the archive when they reconnect.
+const BufferSize = 64
+
+// Archive returns archived events for clients which resume a stream.
+// It is satisfied by *simple.CommandService.
+type Archive interface {
+	// EventsAfterKey returns up to limit archived events which were
+	// archived after the event with the ArchiveKey after, oldest first.
+	EventsAfterKey(ctx context.Context, after []byte, limit int) ([]command.Event, error)
+}
+
+// Broker fans out new events to the subscribed streams.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[*subscription]struct{}
+	closed bool
+}
+
+// NewBroker creates a Broker.
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*subscription]struct{})}
+}
+
+type subscription struct {
+	filter audit.Filter
+	events chan *command.Event
+}
+
+// Publish sends the event to every subscriber whose filter matches.
+// Publish never blocks, and can be used as a simple.Listener.
+func (b *Broker) Publish(e *command.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			// the subscriber is too slow, disconnect it.
+			delete(b.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Close ends every stream, so that an HTTP server can be shut down
+// without waiting for the streams to disconnect. Streams which subscribe
+// after Close end immediately.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+func (b *Broker) subscribe(filter audit.Filter) *subscription {
+	sub := &subscription{
+		filter: filter,
+		events: make(chan *command.Event, BufferSize),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.events)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *Broker) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/mdm"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/audit"
+)
+
+func TestHandler(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(NewHandler(broker, &archive{}))
+	defer server.Close()
+
+	s := connect(t, server.URL+"?udid=foo&request_type=DeviceInformation", "")
+	defer s.Close()
+
+	broker.Publish(newEvent("bar", "DeviceInformation", time.Now()))
+	broker.Publish(newEvent("foo", "EraseDevice", time.Now()))
+	want := newEvent("foo", "DeviceInformation", time.Now())
+	want.ArchiveKey = []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2}
+	broker.Publish(want)
+
+	id, have := s.next(t)
+	if want.ID != have.ID {
+		t.Fatalf("want event %s, have %s", want.ID, have.ID)
+	}
+	if want, have := "00000000000000010000000000000002", id; want != have {
+		t.Errorf("want id %s, have %s", want, have)
+	}
+}
+
+func TestHandler_resume(t *testing.T) {
+	// the archived events are created in the same nanosecond, and are
+	// only told apart by their archive keys.
+	now := time.Now().UTC()
+	archived := []command.Event{
+		*newEvent("foo", "DeviceInformation", now),
+		*newEvent("foo", "DeviceInformation", now),
+		*newEvent("foo", "DeviceInformation", now),
+	}
+	for i := range archived {
+		archived[i].ArchiveKey = []byte{byte(i), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	}
+	broker := NewBroker()
+	server := httptest.NewServer(NewHandler(broker, &archive{events: archived}))
+	defer server.Close()
+
+	s := connect(t, server.URL, hex.EncodeToString(archived[0].ArchiveKey))
+	defer s.Close()
+
+	// the last archived event is also published to the live stream,
+	// but must only be sent once.
+	broker.Publish(&archived[2])
+	live := newEvent("foo", "DeviceInformation", now.Add(3*time.Second))
+	live.ArchiveKey = []byte{3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	broker.Publish(live)
+
+	for _, want := range []string{archived[1].ID, archived[2].ID, live.ID} {
+		_, have := s.next(t)
+		if want != have.ID {
+			t.Fatalf("want event %s, have %s", want, have.ID)
+		}
+	}
+}
+
+func TestHandler_invalidLastEventID(t *testing.T) {
+	server := httptest.NewServer(NewHandler(NewBroker(), &archive{}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "not-an-event-id-at-all")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusBadRequest, resp.StatusCode; want != have {
+		t.Errorf("want status %d, have %d", want, have)
+	}
+}
+
+func TestBroker_slowSubscriber(t *testing.T) {
+	broker := NewBroker()
+	sub := broker.subscribe(audit.Filter{})
+	for i := 0; i <= BufferSize; i++ {
+		broker.Publish(newEvent("foo", "DeviceInformation", time.Now()))
+	}
+	n := 0
+	for range sub.events {
+		n++
+	}
+	if want, have := BufferSize, n; want != have {
+		t.Fatalf("want %d buffered events, have %d", want, have)
+	}
+	broker.unsubscribe(sub)
+}
+
+func TestBroker_Close(t *testing.T) {
+	broker := NewBroker()
+	server := httptest.NewServer(NewHandler(broker, &archive{}))
+	defer server.Close()
+
+	s := connect(t, server.URL, "")
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		for s.scanner.Scan() {
+		}
+		close(done)
+	}()
+	// wait for the stream to subscribe.
+	for i := 0; i < 100; i++ {
+		broker.mu.Lock()
+		n := len(broker.subs)
+		broker.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	broker.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not closed")
+	}
+
+	sub := broker.subscribe(audit.Filter{})
+	if _, ok := <-sub.events; ok {
+		t.Error("want subscriptions after Close to end")
+	}
+	broker.unsubscribe(sub)
+}
+
+type archive struct {
+	events []command.Event
+}
+
+func (a *archive) EventsAfterKey(ctx context.Context, after []byte, limit int) ([]command.Event, error) {
+	var events []command.Event
+	for _, e := range a.events {
+		if bytes.Compare(e.ArchiveKey, after) > 0 && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+type stream struct {
+	resp    *http.Response
+	scanner *bufio.Scanner
+}
+
+func connect(t *testing.T, url, lastEventID string) *stream {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "text/event-stream", resp.Header.Get("Content-Type"); want != have {
+		t.Fatalf("want Content-Type %s, have %s", want, have)
+	}
+	return &stream{resp: resp, scanner: bufio.NewScanner(resp.Body)}
+}
+
+func (s *stream) Close() { s.resp.Body.Close() }
+
+// next reads the next event from the stream.
+func (s *stream) next(t *testing.T) (string, command.Event) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			s.Close()
+		}
+	}()
+
+	var id string
+	var event command.Event
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatal(err)
+			}
+		case line == "" && id != "":
+			return id, event
+		}
+	}
+	t.Fatalf("stream ended: %v", s.scanner.Err())
+	return "", event
+}
+
+func newEvent(udid, requestType string, ts time.Time) *command.Event {
+	e := command.NewEvent(mdm.Payload{
+		CommandUUID: "foo",
+		Command:     &mdm.Command{RequestType: requestType},
+	})
+	e.UDID = udid
+	e.Time = ts
+	return e
+}
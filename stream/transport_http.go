@@ -0,0 +1,155 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/audit"
+)
+
+// replayLimit is the number of archived events read at a time when a
+// client resumes a stream.
+const replayLimit = 500
+
+// Handler streams new events as Server-Sent Events. The stream can be
+// filtered with the udid and request_type query parameters.
+//
+// The ID of each event in the stream is the hex encoded ArchiveKey of the
+// event. A client which reconnects with the Last-Event-ID header first
+// receives the archived events it missed.
+type Handler struct {
+	// KeepAlive is the interval of comment lines sent to keep idle
+	// connections open.
+	KeepAlive time.Duration
+
+	// Encode returns the data of the event in the stream.
+	// By default the event is encoded with encoding/json, with the
+	// secret fields masked by command.DefaultRedactor.
+	Encode func(*command.Event) ([]byte, error)
+
+	Logger log.Logger
+
+	broker  *Broker
+	archive Archive
+}
+
+// NewHandler creates a Handler which streams the events published to the
+// broker, and resumes streams from the archive.
+func NewHandler(broker *Broker, archive Archive) *Handler {
+	return &Handler{
+		KeepAlive: 15 * time.Second,
+		Encode:    command.DefaultRedactor.MarshalEvent,
+		Logger:    log.NewNopLogger(),
+		broker:    broker,
+		archive:   archive,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	filter := audit.Filter{
+		UDID:         q.Get("udid"),
+		RequestTypes: q["request_type"],
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = q.Get("last_event_id")
+	}
+	var last []byte
+	if lastEventID != "" {
+		var err error
+		if last, err = hex.DecodeString(lastEventID); err != nil || len(last) == 0 {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q", lastEventID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// subscribe before reading the archive, so that no event is missed
+	// between the replay and the live stream.
+	sub := h.broker.subscribe(filter)
+	defer h.broker.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// archive keys are strictly ordered, so live events which were
+	// archived up to the last replayed key have already been sent.
+	if last != nil {
+		for {
+			events, err := h.archive.EventsAfterKey(r.Context(), last, replayLimit)
+			if err != nil {
+				h.Logger.Log("msg", "replay events", "err", err)
+				return
+			}
+			for i := range events {
+				e := &events[i]
+				last = e.ArchiveKey
+				if !filter.Match(e) {
+					continue
+				}
+				if err := h.write(w, e); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+			if len(events) < replayLimit {
+				break
+			}
+		}
+	}
+
+	keepAlive := time.NewTicker(h.KeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if len(e.ArchiveKey) > 0 && bytes.Compare(e.ArchiveKey, last) <= 0 {
+				continue
+			}
+			if err := h.write(w, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *Handler) write(w http.ResponseWriter, e *command.Event) error {
+	data, err := h.Encode(e)
+	if err != nil {
+		h.Logger.Log("msg", "encode event", "event", e.ID, "err", err)
+		return nil
+	}
+	// events which were not archived can not be resumed from, and
+	// have no ID.
+	if len(e.ArchiveKey) > 0 {
+		if _, err := fmt.Fprintf(w, "id: %s\n", hex.EncodeToString(e.ArchiveKey)); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: command\ndata: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,210 @@
+// Package tlsreload serves TLS with a certificate, and optionally client
+// certificate authorities, which are reloaded when their files change.
+//
+// Certificates are rotated by replacing the files, there is no need to
+// restart the server. New connections use the new certificate, existing
+// connections keep the certificate they were established with.
+package tlsreload
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// DefaultInterval is the interval between checks of the files for changes.
+const DefaultInterval = 10 * time.Second
+
+// Config of a Reloader.
+type Config struct {
+	// CertFile and KeyFile are the paths of the PEM certificate chain and
+	// private key of the server.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is the path of the PEM certificates of the authorities
+	// which issue client certificates. Required unless ClientAuth is
+	// tls.NoClientCert.
+	ClientCAFile string
+	ClientAuth   tls.ClientAuthType
+
+	// Interval is the interval between checks of the files for changes.
+	// Defaults to DefaultInterval.
+	Interval time.Duration
+
+	Logger log.Logger
+}
+
+// Reloader reloads the certificates of its Config when their files change.
+type Reloader struct {
+	cfg Config
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	versions  map[string]version // of the loaded files
+
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// version identifies the contents of a file.
+type version struct {
+	modTime time.Time
+	size    int64
+}
+
+// New creates a Reloader and loads the certificates.
+func New(cfg Config) (*Reloader, error) {
+	if cfg.ClientAuth != tls.NoClientCert && cfg.ClientCAFile == "" {
+		return nil, errors.New("tlsreload: client authentication requires a client CA file")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+	r := &Reloader{cfg: cfg, stop: make(chan struct{})}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a server configuration which uses the current
+// certificates for every new connection.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   r.cfg.ClientAuth,
+				ClientCAs:    r.clientCAs,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// Reload loads the certificates again if any of their files changed since
+// they were loaded. If the new certificates can not be loaded, for example
+// because the certificate was replaced before the key, the old
+// certificates are kept and Reload returns the error.
+func (r *Reloader) Reload() error {
+	changed, err := r.changed()
+	if err != nil || !changed {
+		return err
+	}
+	return r.load()
+}
+
+// Start checks the files for changes every Interval in the background.
+func (r *Reloader) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					r.cfg.Logger.Log("msg", "reload TLS certificates", "err", err)
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops checking the files for changes.
+func (r *Reloader) Stop() {
+	r.once.Do(func() { close(r.stop) })
+	r.wg.Wait()
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+func (r *Reloader) changed() (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, name := range r.files() {
+		v, err := stat(name)
+		if err != nil {
+			return false, err
+		}
+		if v != r.versions[name] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Reloader) load() error {
+	// stat before reading, so that a change while reading is loaded by
+	// the next Reload.
+	versions := make(map[string]version)
+	for _, name := range r.files() {
+		v, err := stat(name)
+		if err != nil {
+			return err
+		}
+		versions[name] = v
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tlsreload: load certificate: %s", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("tlsreload: no certificates in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.versions = versions
+	r.mu.Unlock()
+	r.cfg.Logger.Log("msg", "loaded TLS certificates", "cert", r.cfg.CertFile, "client_ca", r.cfg.ClientCAFile)
+	return nil
+}
+
+func stat(name string) (version, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return version{}, err
+	}
+	return version{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
@@ -0,0 +1,222 @@
+package tlsreload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "Test CA")
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, "server-1", certFile, keyFile)
+
+	r, err := New(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = r.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	if want, have := "server-1", serverName(t, server, ca, nil); want != have {
+		t.Fatalf("want certificate %q, have %q", want, have)
+	}
+
+	// a certificate without its key is not loaded.
+	ca.issue(t, "server-2", certFile, filepath.Join(dir, "other.key"))
+	touch(t, certFile)
+	if err := r.Reload(); err == nil {
+		t.Fatal("want error for mismatched certificate and key")
+	}
+	if want, have := "server-1", serverName(t, server, ca, nil); want != have {
+		t.Fatalf("want old certificate %q, have %q", want, have)
+	}
+
+	ca.issue(t, "server-3", certFile, keyFile)
+	touch(t, certFile)
+	touch(t, keyFile)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "server-3", serverName(t, server, ca, nil); want != have {
+		t.Fatalf("want certificate %q, have %q", want, have)
+	}
+}
+
+func TestReloader_clientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "Test CA")
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, "server", certFile, keyFile)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+
+	r, err := New(Config{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var caller string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}))
+	server.TLS = r.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	alice := ca.issue(t, "alice", filepath.Join(dir, "alice.pem"), filepath.Join(dir, "alice.key"))
+	serverName(t, server, ca, &alice)
+	if want, have := "alice", caller; want != have {
+		t.Errorf("want caller %q, have %q", want, have)
+	}
+
+	if _, err := get(server, ca, nil); err == nil {
+		t.Error("want error without a client certificate")
+	}
+	other := newCA(t, "Other CA")
+	mallory := other.issue(t, "mallory", filepath.Join(dir, "mallory.pem"), filepath.Join(dir, "mallory.key"))
+	if _, err := get(server, ca, &mallory); err == nil {
+		t.Error("want error for a client certificate of another CA")
+	}
+}
+
+func TestNew_clientAuthRequiresCA(t *testing.T) {
+	if _, err := New(Config{ClientAuth: tls.RequireAndVerifyClientCert}); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate for the name, which can be used by servers
+// on 127.0.0.1 and by clients.
+func (ca *testCA) issue(t *testing.T, name, certFile, keyFile string) tls.Certificate {
+	key := newKey(t)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch changes the modification time of the file, so that a change is
+// detected on file systems with a coarse clock.
+func touch(t *testing.T, path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := fi.ModTime().Add(time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get makes a request to the server on a new connection, and returns the
+// common name of the server certificate.
+func get(server *httptest.Server, ca *testCA, cert *tls.Certificate) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func serverName(t *testing.T, server *httptest.Server, ca *testCA, cert *tls.Certificate) string {
+	name, err := get(server, ca, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
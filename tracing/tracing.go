@@ -0,0 +1,250 @@
+// Package tracing records the requests, commands and events of commandsvc
+// as OpenTelemetry spans.
+//
+// The command, simple and consumer packages do not depend on OpenTelemetry.
+// The middlewares of this package wrap their endpoints and services, and
+// ServiceTracer and ConsumerTracer are passed to simple.WithTracer and
+// consumer.Config.
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/micromdm/mdm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// TracerName is the name of the tracers of this module.
+const TracerName = "github.com/micromdm/command"
+
+// propagator is the W3C trace context format of the traceparent and
+// tracestate headers, used for HTTP requests and events.
+var propagator = propagation.TraceContext{}
+
+// Handler returns a handler which starts a server span for each HTTP
+// request. The trace context of the caller is continued if the request has
+// a traceparent header.
+func Handler(tracer trace.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush implements http.Flusher for streaming responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RequestFunc is a RequestFunc which continues the span started by Handler
+// in the context of a go-kit server. go-kit servers do not use the context
+// of the HTTP request.
+func RequestFunc(ctx context.Context, r *http.Request) context.Context {
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(r.Context()))
+}
+
+var _ httptransport.RequestFunc = RequestFunc
+
+// failer is implemented by responses which carry the error of a request.
+type failer interface {
+	Failed() error
+}
+
+// EndpointMiddleware returns an endpoint middleware that records each
+// invocation as a span named after the operation.
+func EndpointMiddleware(tracer trace.Tracer, operation string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			ctx, span := tracer.Start(ctx, operation)
+			defer func() {
+				if f, ok := response.(failer); ok && err == nil {
+					recordError(span, f.Failed())
+				}
+				recordError(span, err)
+				span.End()
+			}()
+			return next(ctx, request)
+		}
+	}
+}
+
+// ServiceMiddleware returns a service middleware that records each
+// NewCommand call as a span, with the UDID, request type and command UUID
+// as attributes.
+func ServiceMiddleware(tracer trace.Tracer) command.Middleware {
+	return func(next command.Service) command.Service {
+		return serviceMiddleware{
+			tracer: tracer,
+			next:   next,
+		}
+	}
+}
+
+type serviceMiddleware struct {
+	tracer trace.Tracer
+	next   command.Service
+}
+
+func (mw serviceMiddleware) NewCommand(ctx context.Context, req *mdm.CommandRequest) (p *mdm.Payload, err error) {
+	ctx, span := mw.tracer.Start(ctx, "NewCommand")
+	if req != nil {
+		span.SetAttributes(
+			attribute.String("mdm.udid", req.UDID),
+			attribute.String("mdm.request_type", req.RequestType),
+		)
+	}
+	defer func() {
+		if p != nil {
+			span.SetAttributes(attribute.String("mdm.command_uuid", p.CommandUUID))
+		}
+		outcome := command.ErrorOutcome(err)
+		span.SetAttributes(attribute.String("outcome", outcome))
+		if outcome != command.OutcomePending {
+			recordError(span, err)
+		}
+		span.End()
+	}()
+	return mw.next.NewCommand(ctx, req)
+}
+
+// ServiceTracer records the archive transactions and NSQ publishes of a
+// simple.CommandService as spans, and the trace context of NewCommand in
+// its events.
+type ServiceTracer struct {
+	tracer trace.Tracer
+}
+
+// NewServiceTracer creates a ServiceTracer.
+func NewServiceTracer(tracer trace.Tracer) *ServiceTracer {
+	return &ServiceTracer{tracer: tracer}
+}
+
+// InjectEvent records the trace context of ctx in the event.
+func (t *ServiceTracer) InjectEvent(ctx context.Context, e *command.Event) {
+	Inject(ctx, e)
+}
+
+// TraceArchive starts an archive span. The returned function ends it.
+func (t *ServiceTracer) TraceArchive(ctx context.Context, bucket string) func(error) {
+	_, span := t.tracer.Start(ctx, "archive", trace.WithAttributes(
+		attribute.String("db.system", "boltdb"),
+		attribute.String("db.bolt.bucket", bucket),
+	))
+	return endSpan(span)
+}
+
+// TracePublish starts a producer span for a publish to the NSQ topic. The
+// returned function ends it.
+func (t *ServiceTracer) TracePublish(ctx context.Context, topic string) func(error) {
+	_, span := t.tracer.Start(ctx, "Publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.destination", topic),
+		),
+	)
+	return endSpan(span)
+}
+
+// ConsumerTracer records the handling of each event by a consumer.Consumer
+// as a span, which continues the trace of the request that created the
+// command.
+type ConsumerTracer struct {
+	tracer trace.Tracer
+}
+
+// NewConsumerTracer creates a ConsumerTracer.
+func NewConsumerTracer(tracer trace.Tracer) *ConsumerTracer {
+	return &ConsumerTracer{tracer: tracer}
+}
+
+// TraceEvent starts a consumer span for the event. The returned function
+// ends it.
+func (t *ConsumerTracer) TraceEvent(ctx context.Context, e *command.Event, topic, channel string, attempts uint16) (context.Context, func(error)) {
+	ctx, span := t.tracer.Start(Extract(ctx, e), "consume "+topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.destination", topic),
+			attribute.String("messaging.nsq.channel", channel),
+			attribute.Int("messaging.nsq.attempts", int(attempts)),
+		),
+	)
+	return ctx, endSpan(span)
+}
+
+// endSpan returns a function which records its error in the span, if
+// any, and ends it.
+func endSpan(span trace.Span) func(error) {
+	return func(err error) {
+		recordError(span, err)
+		span.End()
+	}
+}
+
+// recordError marks the span as failed with err, if err is not nil.
+func recordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject records the trace context of ctx in the event, so that consumers
+// of the event can continue the trace.
+func Inject(ctx context.Context, e *command.Event) {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	e.TraceParent = carrier.Get("traceparent")
+	e.TraceState = carrier.Get("tracestate")
+}
+
+// Extract returns a copy of ctx with the trace context recorded in the
+// event, if any. Spans started from the returned context are part of the
+// trace of the request which created the command.
+func Extract(ctx context.Context, e *command.Event) context.Context {
+	if e.TraceParent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": e.TraceParent}
+	if e.TraceState != "" {
+		carrier.Set("tracestate", e.TraceState)
+	}
+	return propagator.Extract(ctx, carrier)
+}
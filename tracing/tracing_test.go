@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/micromdm/mdm"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+	"github.com/micromdm/command/service/mock"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer(TracerName)
+
+	var event command.Event
+	next := &mock.CommandService{
+		NewCommandFunc: func(ctx context.Context, req *mdm.CommandRequest) (*mdm.Payload, error) {
+			NewServiceTracer(tracer).InjectEvent(ctx, &event)
+			return mock.MockPayload, nil
+		},
+	}
+	svc := ServiceMiddleware(tracer)(next)
+	e := EndpointMiddleware(tracer, "endpoint.NewCommand")(command.MakeNewCommandEndpoint(svc))
+	handler := Handler(tracer, command.MakeHTTPHandlers(context.Background(), command.Endpoints{NewCommandEndpoint: e}, command.BodyLimits{},
+		httptransport.ServerBefore(RequestFunc),
+	).NewCommandHandler)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body, err := json.Marshal(&mdm.CommandRequest{
+		RequestType: "DeviceInformation",
+		UDID:        "foobarbaz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/v1/commands", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("want status %d, have %d: %s", http.StatusCreated, rec.Code, rec.Body)
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+		if have := s.SpanContext.TraceID().String(); have != traceID {
+			t.Errorf("%s: want trace ID %s, have %s", s.Name, traceID, have)
+		}
+	}
+	parents := map[string]string{
+		"NewCommand":          "endpoint.NewCommand",
+		"endpoint.NewCommand": "HTTP POST",
+	}
+	for child, parent := range parents {
+		c, ok := byName[child]
+		if !ok {
+			t.Fatalf("no %s span in %v", child, spans)
+		}
+		if want, have := byName[parent].SpanContext.SpanID(), c.Parent.SpanID(); want != have {
+			t.Errorf("want %s to be the parent of %s", parent, child)
+		}
+	}
+
+	// consumers continue the trace from the NewCommand span.
+	ctx := Extract(context.Background(), &event)
+	sc := trace.SpanContextFromContext(ctx)
+	if want, have := byName["NewCommand"].SpanContext.SpanID(), sc.SpanID(); want != have {
+		t.Errorf("want the event to carry span %s, have %s", want, have)
+	}
+	if !sc.IsRemote() {
+		t.Error("want a remote span context")
+	}
+}
+
+func TestServiceTracer(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer(TracerName)
+	st := NewServiceTracer(tracer)
+
+	ctx, parent := tracer.Start(context.Background(), "NewCommand")
+	var event command.Event
+	st.InjectEvent(ctx, &event)
+	st.TraceArchive(ctx, "mdm.Command.ARCHIVE")(nil)
+	st.TracePublish(ctx, "mdm.Command")(errors.New("nsqd unavailable"))
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if want, have := 3, len(spans); want != have {
+		t.Fatalf("want %d spans, have %d", want, have)
+	}
+	for _, s := range spans[:2] {
+		if want, have := parent.SpanContext().SpanID(), s.Parent.SpanID(); want != have {
+			t.Errorf("%s: want parent span %s, have %s", s.Name, want, have)
+		}
+	}
+	if spans[0].Name != "archive" || spans[1].Name != "Publish" {
+		t.Errorf("want archive and Publish spans, have %s and %s", spans[0].Name, spans[1].Name)
+	}
+	if want, have := trace.SpanKindProducer, spans[1].SpanKind; want != have {
+		t.Errorf("want Publish span kind %s, have %s", want, have)
+	}
+	if len(spans[1].Events) == 0 {
+		t.Error("want the publish error recorded")
+	}
+
+	// the consumer span continues the trace of the event.
+	_, end := NewConsumerTracer(tracer).TraceEvent(context.Background(), &event, "mdm.Command", "queue", 1)
+	end(nil)
+	spans = exporter.GetSpans()
+	consume := spans[len(spans)-1]
+	if want, have := parent.SpanContext().SpanID(), consume.Parent.SpanID(); want != have {
+		t.Errorf("want consumer parent span %s, have %s", want, have)
+	}
+}
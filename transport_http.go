@@ -3,10 +3,16 @@ package command
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
 
 	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/groob/plist"
+	"github.com/micromdm/mdm"
 	"golang.org/x/net/context"
 )
 
@@ -14,12 +20,14 @@ type HTTPHandlers struct {
 	NewCommandHandler http.Handler
 }
 
-func MakeHTTPHandlers(ctx context.Context, endpoints Endpoints, opts ...httptransport.ServerOption) HTTPHandlers {
+// MakeHTTPHandlers returns the HTTP handlers for the command service.
+// The size of each request body is restricted by limits.
+func MakeHTTPHandlers(ctx context.Context, endpoints Endpoints, limits BodyLimits, opts ...httptransport.ServerOption) HTTPHandlers {
 	h := HTTPHandlers{
 		NewCommandHandler: httptransport.NewServer(
 			ctx,
 			endpoints.NewCommandEndpoint,
-			decodeRequest,
+			decodeRequestWithLimits(limits),
 			encodeResponse,
 			opts...,
 		),
@@ -51,6 +59,10 @@ func EncodeError(ctx context.Context, err error, w http.ResponseWriter) {
 
 	switch domain {
 	case httptransport.DomainDecode:
+		if _, ok := err.(bodyTooLargeError); ok {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			break
+		}
 		w.WriteHeader(http.StatusBadRequest)
 	case httptransport.DomainDo:
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -62,7 +74,26 @@ func EncodeError(ctx context.Context, err error, w http.ResponseWriter) {
 	})
 }
 
+// invalidRequest is implemented by errors which are caused by an invalid
+// command request, such as those returned by a service middleware which
+// validates the request.
+type invalidRequest interface {
+	InvalidRequest() bool
+}
+
+// unauthenticated is implemented by errors which are caused by a request
+// without a caller identity.
+type unauthenticated interface {
+	Unauthenticated() bool
+}
+
 func codeFromErr(err error) int {
+	if e, ok := err.(invalidRequest); ok && e.InvalidRequest() {
+		return http.StatusBadRequest
+	}
+	if e, ok := err.(unauthenticated); ok && e.Unauthenticated() {
+		return http.StatusUnauthorized
+	}
 	switch err {
 	case errEmptyRequest:
 		return http.StatusBadRequest
@@ -83,12 +114,132 @@ type errorWrapper struct {
 	Error string `json:"error"`
 }
 
-func decodeRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+// decodeRequestWithLimits returns a decoder for command requests which
+// rejects request bodies larger than the configured limits.
+func decodeRequestWithLimits(limits BodyLimits) httptransport.DecodeRequestFunc {
+	return func(ctx context.Context, r *http.Request) (interface{}, error) {
+		body := &limitedReader{r: r.Body, limit: limits.max(RouteNewCommand)}
+		request, err := decodeRequest(ctx, r, body)
+		if err != nil {
+			return request, err
+		}
+		req := request.(newCommandRequest)
+		if req.CommandRequest == nil {
+			return req, nil
+		}
+		if limit := limits.requestType(RouteNewCommand, req.RequestType); body.read > limit {
+			return req, bodyTooLargeError{limit}
+		}
+		return req, nil
+	}
+}
+
+// decodeRequest decodes a command request from body.
+// The body is decoded as a plist when the Content-Type is one of the
+// plist content types, as a multipart form for multipart/form-data
+// and as JSON otherwise.
+func decodeRequest(ctx context.Context, r *http.Request, body io.Reader) (interface{}, error) {
 	var req newCommandRequest
-	err := json.NewDecoder(io.LimitReader(r.Body, 10000)).Decode(&req)
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "multipart/form-data":
+		return decodeMultipart(multipart.NewReader(body, params["boundary"]))
+	case isPlist(mediaType):
+		var cmd mdm.CommandRequest
+		if err := decodePlist(body, &cmd, &req.Scheduling); err != nil {
+			return req, err
+		}
+		req.CommandRequest = &cmd
+		return req, nil
+	}
+	err := json.NewDecoder(body).Decode(&req)
 	return req, err
 }
 
+// decodeMultipart decodes a multipart/form-data command request.
+// The "request" field holds the command request as JSON or plist,
+// depending on the Content-Type of the part. The optional "payload"
+// field is streamed into the Payload of the command, which allows
+// large InstallProfile payloads to be uploaded as a file.
+func decodeMultipart(mr *multipart.Reader) (newCommandRequest, error) {
+	var (
+		req     newCommandRequest
+		payload []byte
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(bodyTooLargeError); ok {
+				return req, err
+			}
+			return req, fmt.Errorf("decode multipart request: %s", err)
+		}
+		switch part.FormName() {
+		case "request":
+			req = newCommandRequest{CommandRequest: new(mdm.CommandRequest)}
+			mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			if isPlist(mediaType) {
+				err = decodePlist(part, req.CommandRequest, &req.Scheduling)
+			} else {
+				err = json.NewDecoder(part).Decode(&req)
+			}
+		case "payload":
+			payload, err = ioutil.ReadAll(part)
+		default:
+			err = fmt.Errorf("decode multipart request: unknown form field %q", part.FormName())
+		}
+		part.Close()
+		if err != nil {
+			return req, err
+		}
+	}
+	if req.CommandRequest == nil {
+		return req, errors.New("decode multipart request: missing request field")
+	}
+	if payload != nil {
+		req.Payload = payload
+	}
+	return req, nil
+}
+
+// isPlist reports whether mediaType is one of the XML or binary plist
+// content types.
+func isPlist(mediaType string) bool {
+	switch mediaType {
+	case "application/x-plist",
+		"application/x-apple-plist",
+		"application/x-bplist",
+		"application/xml",
+		"text/xml":
+		return true
+	default:
+		return false
+	}
+}
+
+// decodePlist decodes an XML or binary plist from r into each of v.
+func decodePlist(r io.Reader, v ...interface{}) error {
+	data, err := ioutil.ReadAll(r)
+	if _, ok := err.(bodyTooLargeError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("read plist request: %s", err)
+	}
+	if len(data) == 0 {
+		return errors.New("decode plist request: empty body")
+	}
+	for _, v := range v {
+		if err := plist.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("decode plist request: %s", err)
+		}
+	}
+	return nil
+}
+
 func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 
 	if e, ok := response.(errorer); ok && e.error() != nil {
@@ -0,0 +1,48 @@
+package command
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Warning is a problem found in an accepted command request. Warnings are
+// returned to the caller in the NewCommand response.
+type Warning struct {
+	// Path locates the problem in the request, ex: a key of the profile.
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// warnings collects the warnings of a request.
+type warnings struct {
+	mu   sync.Mutex
+	list []Warning
+}
+
+// NewWarningsContext returns a new Context which collects the warnings
+// added by service middlewares with AddWarning.
+func NewWarningsContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, warningsKey, &warnings{})
+}
+
+// AddWarning adds a warning to the request of ctx. AddWarning does nothing
+// if ctx does not collect warnings.
+func AddWarning(ctx context.Context, w Warning) {
+	if ws, ok := ctx.Value(warningsKey).(*warnings); ok {
+		ws.mu.Lock()
+		ws.list = append(ws.list, w)
+		ws.mu.Unlock()
+	}
+}
+
+// WarningsFromContext returns the warnings added to the request of ctx.
+func WarningsFromContext(ctx context.Context) []Warning {
+	ws, ok := ctx.Value(warningsKey).(*warnings)
+	if !ok {
+		return nil
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return append([]Warning(nil), ws.list...)
+}
@@ -0,0 +1,41 @@
+package webhook
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+	"golang.org/x/net/context"
+)
+
+// Service lists webhook deliveries.
+type Service interface {
+	Deliveries(context.Context, Filter) ([]Delivery, error)
+}
+
+type Endpoints struct {
+	ListDeliveriesEndpoint endpoint.Endpoint
+}
+
+// MakeListDeliveriesEndpoint creates an endpoint which lists webhook deliveries.
+func MakeListDeliveriesEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(listDeliveriesRequest)
+		deliveries, err := svc.Deliveries(ctx, req.Filter)
+		if deliveries == nil {
+			deliveries = []Delivery{}
+		}
+		return listDeliveriesResponse{Deliveries: deliveries, Err: err}, nil
+	}
+}
+
+type listDeliveriesRequest struct {
+	Filter
+}
+
+type listDeliveriesResponse struct {
+	Deliveries []Delivery `json:"deliveries"`
+	Err        error      `json:"error,omitempty"`
+}
+
+func (r listDeliveriesResponse) error() error { return r.Err }
+func (r listDeliveriesResponse) status() int  { return http.StatusOK }
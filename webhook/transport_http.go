@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+type HTTPHandlers struct {
+	ListDeliveriesHandler http.Handler
+}
+
+// MakeHTTPHandlers returns the HTTP handlers for webhook deliveries.
+func MakeHTTPHandlers(ctx context.Context, endpoints Endpoints, opts ...httptransport.ServerOption) HTTPHandlers {
+	h := HTTPHandlers{
+		ListDeliveriesHandler: httptransport.NewServer(
+			ctx,
+			endpoints.ListDeliveriesEndpoint,
+			decodeListDeliveriesRequest,
+			encodeResponse,
+			opts...,
+		),
+	}
+	return h
+}
+
+type errorer interface {
+	error() error
+}
+
+type statuser interface {
+	status() int
+}
+
+// decodeListDeliveriesRequest decodes the filter from the event_id,
+// status and limit query parameters.
+func decodeListDeliveriesRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	q := r.URL.Query()
+	req := listDeliveriesRequest{Filter{
+		EventID: q.Get("event_id"),
+		Status:  Status(q.Get("status")),
+		Limit:   100,
+	}}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return req, fmt.Errorf("invalid limit parameter %q", v)
+		}
+		req.Limit = limit
+	}
+	return req, nil
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(errorer); ok && e.error() != nil {
+		command.EncodeError(ctx, e.error(), w)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if s, ok := response.(statuser); ok {
+		w.WriteHeader(s.status())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(response)
+}
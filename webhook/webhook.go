@@ -0,0 +1,444 @@
+// Package webhook notifies HTTP endpoints about new command events.
+//
+// Each event is POSTed as JSON to the configured URLs. The body is signed
+// with HMAC-SHA256, and failed deliveries are retried with exponential
+// backoff. Every delivery attempt is recorded in a BoltDB bucket, until the
+// delivery is deleted by Prune.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+// DeliveryBucket is the *bolt.DB bucket where deliveries are recorded.
+// Deliveries are keyed by the time they were created in nanoseconds,
+// big-endian, followed by their ID, so that keys sort by time.
+const DeliveryBucket = "webhook.DELIVERIES"
+
+// QueueSize is the number of events Dispatch queues for recording. Events
+// are dropped when the queue is full.
+const QueueSize = 1024
+
+// HTTP headers set on each webhook request.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	DeliveryHeader  = "X-Webhook-Delivery"
+	EventHeader     = "X-Webhook-Event"
+)
+
+// Hook is an HTTP endpoint which is notified about events.
+type Hook struct {
+	URL string
+
+	// Secret is the HMAC key used to sign the request body.
+	Secret string
+
+	// RequestTypes limits the hook to events with these request types.
+	// All events are sent if RequestTypes is empty.
+	RequestTypes []string
+}
+
+func (h Hook) wants(e *command.Event) bool {
+	if len(h.RequestTypes) == 0 {
+		return true
+	}
+	for _, t := range h.RequestTypes {
+		if e.Payload.Command != nil && e.Payload.Command.RequestType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Status of a delivery.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Delivery is the notification of one hook about one event.
+type Delivery struct {
+	ID        string    `json:"id"`
+	EventID   string    `json:"event_id"`
+	URL       string    `json:"url"`
+	Status    Status    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	Attempts  []Attempt `json:"attempts"`
+
+	// Body is the signed JSON body of the request.
+	Body json.RawMessage `json:"body,omitempty"`
+
+	secret string
+}
+
+// Attempt is a single try to deliver a webhook.
+type Attempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Filter selects deliveries. Empty fields match every delivery.
+type Filter struct {
+	EventID string
+	Status  Status
+	Limit   int
+}
+
+// Dispatcher delivers events to webhooks.
+type Dispatcher struct {
+	// MaxAttempts is the number of delivery attempts before a delivery
+	// is marked as failed.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry. It doubles after each
+	// attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Client sends the webhook requests.
+	Client *http.Client
+
+	// Encode returns the JSON body sent for an event.
+	// By default the event is encoded with encoding/json, with the
+	// secret fields masked by command.DefaultRedactor.
+	Encode func(*command.Event) ([]byte, error)
+
+	Logger log.Logger
+
+	db     *bolt.DB
+	hooks  []Hook
+	events chan *command.Event
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewDispatcher creates a Dispatcher for the hooks.
+func NewDispatcher(db *bolt.DB, hooks []Hook) (*Dispatcher, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(DeliveryBucket))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d := &Dispatcher{
+		MaxAttempts: 8,
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Encode:      command.DefaultRedactor.MarshalEvent,
+		Logger:      log.NewNopLogger(),
+		db:          db,
+		hooks:       hooks,
+		events:      make(chan *command.Event, QueueSize),
+		stop:        make(chan struct{}),
+	}
+	d.wg.Add(1)
+	go d.run()
+	return d, nil
+}
+
+// Start resumes the pending deliveries recorded in the bucket, for example
+// after a restart. Pending deliveries which have used up MaxAttempts are
+// marked as failed.
+func (d *Dispatcher) Start() error {
+	deliveries, err := d.Deliveries(context.Background(), Filter{Status: StatusPending})
+	if err != nil {
+		return err
+	}
+	secrets := make(map[string]string)
+	for _, h := range d.hooks {
+		secrets[h.URL] = h.Secret
+	}
+	for i := range deliveries {
+		delivery := deliveries[i]
+		if len(delivery.Attempts) >= d.MaxAttempts {
+			delivery.Status = StatusFailed
+			if err := d.save(&delivery); err != nil {
+				return err
+			}
+			continue
+		}
+		secret, ok := secrets[delivery.URL]
+		if !ok {
+			continue
+		}
+		delivery.secret = secret
+		d.deliver(&delivery)
+	}
+	return nil
+}
+
+// Stop stops retrying deliveries and waits for requests in flight. The
+// deliveries of queued events are recorded without being attempted.
+// Pending deliveries are resumed by the next call to Start.
+func (d *Dispatcher) Stop() {
+	d.once.Do(func() { close(d.stop) })
+	d.wg.Wait()
+}
+
+// Dispatch queues the event, and returns without waiting for the
+// deliveries to be recorded. Dispatch can be used as a simple.Listener.
+// Events are dropped if the queue is full or the Dispatcher is stopped.
+func (d *Dispatcher) Dispatch(e *command.Event) {
+	select {
+	case <-d.stop:
+		d.Logger.Log("msg", "dispatcher stopped, webhook event dropped", "event", e.ID)
+		return
+	default:
+	}
+	select {
+	case d.events <- e:
+	default:
+		d.Logger.Log("msg", "webhook queue full, event dropped", "event", e.ID)
+	}
+}
+
+// HandleEvent records and delivers an event received by a
+// consumer.Consumer, for running the dispatcher in a separate process. The
+// message is requeued if the deliveries can not be recorded.
+func (d *Dispatcher) HandleEvent(ctx context.Context, e *command.Event) error {
+	return d.dispatch(e, true)
+}
+
+// run records the deliveries of queued events until the Dispatcher is
+// stopped.
+func (d *Dispatcher) run() {
+	defer d.wg.Done()
+	for {
+		select {
+		case e := <-d.events:
+			d.dispatch(e, true)
+		case <-d.stop:
+			for {
+				select {
+				case e := <-d.events:
+					d.dispatch(e, false)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// dispatch records a delivery of the event for every hook which wants it,
+// in one transaction, and delivers them in the background if deliver is
+// true.
+func (d *Dispatcher) dispatch(e *command.Event, deliver bool) error {
+	var (
+		body       []byte
+		deliveries []*Delivery
+	)
+	for _, hook := range d.hooks {
+		if !hook.wants(e) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = d.Encode(e); err != nil {
+				d.Logger.Log("msg", "encode webhook body", "event", e.ID, "err", err)
+				return err
+			}
+		}
+		deliveries = append(deliveries, &Delivery{
+			ID:        uuid.NewV4().String(),
+			EventID:   e.ID,
+			URL:       hook.URL,
+			Status:    StatusPending,
+			CreatedAt: time.Now().UTC(),
+			Body:      body,
+			secret:    hook.Secret,
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	if err := d.save(deliveries...); err != nil {
+		d.Logger.Log("msg", "save webhook deliveries", "event", e.ID, "err", err)
+		return err
+	}
+	if deliver {
+		for _, delivery := range deliveries {
+			d.deliver(delivery)
+		}
+	}
+	return nil
+}
+
+// Deliveries returns the recorded deliveries, newest first.
+func (d *Dispatcher) Deliveries(ctx context.Context, filter Filter) ([]Delivery, error) {
+	var deliveries []Delivery
+	err := d.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(DeliveryBucket)).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if filter.Limit > 0 && len(deliveries) == filter.Limit {
+				return nil
+			}
+			var delivery Delivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			if filter.EventID != "" && filter.EventID != delivery.EventID {
+				continue
+			}
+			if filter.Status != "" && filter.Status != delivery.Status {
+				continue
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return nil
+	})
+	return deliveries, err
+}
+
+// Prune deletes the deliveries created before the time, including
+// deliveries which are still pending, and returns the number of deleted
+// deliveries.
+func (d *Dispatcher) Prune(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(DeliveryBucket))
+		// collect the keys first, deleting with the cursor skips keys.
+		var keys [][]byte
+		end := timeKey(before)
+		c := bkt.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (d *Dispatcher) deliver(delivery *Delivery) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		backoff := d.Backoff
+		for len(delivery.Attempts) < d.MaxAttempts {
+			attempt := d.attempt(delivery)
+			delivery.Attempts = append(delivery.Attempts, attempt)
+			switch {
+			case attempt.Error == "":
+				delivery.Status = StatusDelivered
+			case len(delivery.Attempts) >= d.MaxAttempts:
+				delivery.Status = StatusFailed
+			}
+			if err := d.save(delivery); err != nil {
+				d.Logger.Log("msg", "save webhook delivery", "delivery", delivery.ID, "err", err)
+			}
+			if delivery.Status != StatusPending {
+				return
+			}
+			select {
+			case <-time.After(backoff):
+			case <-d.stop:
+				return
+			}
+			if backoff *= 2; backoff > d.MaxBackoff {
+				backoff = d.MaxBackoff
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) attempt(delivery *Delivery) Attempt {
+	attempt := Attempt{Time: time.Now().UTC()}
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set(SignatureHeader, "sha256="+Sign(delivery.Body, delivery.secret))
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(EventHeader, delivery.EventID)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return attempt
+}
+
+// save records the deliveries in one transaction.
+func (d *Dispatcher) save(deliveries ...*Delivery) error {
+	values := make([][]byte, len(deliveries))
+	for i, delivery := range deliveries {
+		v, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(DeliveryBucket))
+		for i, delivery := range deliveries {
+			if err := bkt.Put(deliveryKey(delivery), values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body. Receivers verify
+// the X-Webhook-Signature header by comparing it to "sha256=" followed
+// by the signature of the request body.
+func Sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliveryKey returns the key of the delivery in DeliveryBucket.
+func deliveryKey(delivery *Delivery) []byte {
+	return append(timeKey(delivery.CreatedAt), delivery.ID...)
+}
+
+// timeKey returns the prefix of the keys of deliveries created at t.
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
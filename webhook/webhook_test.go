@@ -0,0 +1,254 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/micromdm/mdm"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+
+	"github.com/micromdm/command"
+)
+
+func TestDispatch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		received = make(chan command.Event, 1)
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if want, have := "sha256="+Sign(body, "secret"), r.Header.Get(SignatureHeader); want != have {
+			t.Errorf("want signature %s, have %s", want, have)
+		}
+		mu.Lock()
+		requests++
+		first := requests == 1
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e command.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		received <- e
+	}))
+	defer receiver.Close()
+
+	d := setupDispatcher(t, Hook{URL: receiver.URL, Secret: "secret"})
+	defer d.Stop()
+
+	event := newEvent("DeviceInformation")
+	d.Dispatch(event)
+
+	select {
+	case e := <-received:
+		if want, have := event.ID, e.ID; want != have {
+			t.Errorf("want event %s, have %s", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	delivery := waitFor(t, d, StatusDelivered)
+	if want, have := 2, len(delivery.Attempts); want != have {
+		t.Fatalf("want %d attempts, have %d", want, have)
+	}
+	if want, have := http.StatusServiceUnavailable, delivery.Attempts[0].StatusCode; want != have {
+		t.Errorf("want first attempt status %d, have %d", want, have)
+	}
+	if delivery.Attempts[0].Error == "" {
+		t.Error("failed attempt has no error")
+	}
+	if want, have := event.ID, delivery.EventID; want != have {
+		t.Errorf("want event %s, have %s", want, have)
+	}
+}
+
+func TestDispatch_failed(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	d := setupDispatcher(t, Hook{URL: receiver.URL, Secret: "secret"})
+	defer d.Stop()
+	d.MaxAttempts = 3
+
+	d.Dispatch(newEvent("DeviceInformation"))
+
+	delivery := waitFor(t, d, StatusFailed)
+	if want, have := 3, len(delivery.Attempts); want != have {
+		t.Fatalf("want %d attempts, have %d", want, have)
+	}
+}
+
+func TestDispatch_requestTypes(t *testing.T) {
+	d := setupDispatcher(t, Hook{URL: "http://127.0.0.1:0", RequestTypes: []string{"InstallProfile"}})
+	d.Dispatch(newEvent("DeviceInformation"))
+	d.Stop()
+
+	deliveries, err := d.Deliveries(context.Background(), Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 0 {
+		t.Fatalf("want no deliveries, have %d", len(deliveries))
+	}
+}
+
+func TestDispatch_stop(t *testing.T) {
+	d := setupDispatcher(t, Hook{URL: "http://127.0.0.1:0", Secret: "secret"})
+	d.Backoff = time.Hour
+
+	// events queued at Stop are recorded as pending.
+	for i := 0; i < 3; i++ {
+		d.Dispatch(newEvent("DeviceInformation"))
+	}
+	d.Stop()
+	deliveries, err := d.Deliveries(context.Background(), Filter{Status: StatusPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(deliveries); want != have {
+		t.Fatalf("want %d pending deliveries, have %d", want, have)
+	}
+
+	// events dispatched after Stop are dropped without blocking.
+	d.Dispatch(newEvent("DeviceInformation"))
+}
+
+func TestDeliveries_limit(t *testing.T) {
+	d := setupDispatcher(t, Hook{URL: "http://127.0.0.1:0", Secret: "secret"})
+	defer d.Stop()
+	now := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		saveDelivery(t, d, now.Add(time.Duration(i)*time.Minute), StatusDelivered, 1)
+	}
+
+	deliveries, err := d.Deliveries(context.Background(), Filter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(deliveries); want != have {
+		t.Fatalf("want %d deliveries, have %d", want, have)
+	}
+	if !deliveries[0].CreatedAt.After(deliveries[1].CreatedAt) || !deliveries[0].CreatedAt.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("want the newest deliveries first, have %v and %v", deliveries[0].CreatedAt, deliveries[1].CreatedAt)
+	}
+}
+
+func TestDispatcher_Prune(t *testing.T) {
+	d := setupDispatcher(t, Hook{URL: "http://127.0.0.1:0", Secret: "secret"})
+	defer d.Stop()
+	now := time.Now().UTC()
+	saveDelivery(t, d, now.Add(-2*time.Hour), StatusDelivered, 1)
+	saveDelivery(t, d, now.Add(-time.Hour), StatusPending, 1)
+	saveDelivery(t, d, now, StatusFailed, 8)
+
+	n, err := d.Prune(context.Background(), now.Add(-30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, n; want != have {
+		t.Fatalf("want %d pruned deliveries, have %d", want, have)
+	}
+	deliveries, err := d.Deliveries(context.Background(), Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || !deliveries[0].CreatedAt.Equal(now) {
+		t.Errorf("want the newest delivery kept, have %v", deliveries)
+	}
+}
+
+func TestDispatcher_Start(t *testing.T) {
+	d := setupDispatcher(t, Hook{URL: "http://127.0.0.1:0", Secret: "secret"})
+	defer d.Stop()
+	d.MaxAttempts = 3
+	d.Backoff = time.Hour
+	exhausted := saveDelivery(t, d, time.Now().UTC(), StatusPending, 3)
+
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := d.Deliveries(context.Background(), Filter{EventID: exhausted.EventID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("want 1 delivery, have %d", len(deliveries))
+	}
+	if want, have := StatusFailed, deliveries[0].Status; want != have {
+		t.Errorf("want status %s, have %s", want, have)
+	}
+	if want, have := 3, len(deliveries[0].Attempts); want != have {
+		t.Errorf("want %d attempts, have %d", want, have)
+	}
+}
+
+func saveDelivery(t *testing.T, d *Dispatcher, createdAt time.Time, status Status, attempts int) *Delivery {
+	delivery := &Delivery{
+		ID:        uuid.NewV4().String(),
+		EventID:   uuid.NewV4().String(),
+		URL:       d.hooks[0].URL,
+		Status:    status,
+		CreatedAt: createdAt,
+		Attempts:  make([]Attempt, attempts),
+	}
+	if err := d.save(delivery); err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func waitFor(t *testing.T, d *Dispatcher, status Status) Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries, err := d.Deliveries(context.Background(), Filter{Status: status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) == 1 {
+			return deliveries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %s delivery", status)
+	return Delivery{}
+}
+
+func newEvent(requestType string) *command.Event {
+	return command.NewEvent(mdm.Payload{
+		CommandUUID: "foo",
+		Command:     &mdm.Command{RequestType: requestType},
+	})
+}
+
+func setupDispatcher(t *testing.T, hooks ...Hook) *Dispatcher {
+	f, _ := ioutil.TempFile("", "bolt-")
+	f.Close()
+	os.Remove(f.Name())
+
+	db, err := bolt.Open(f.Name(), 0777, nil)
+	if err != nil {
+		t.Fatalf("couldn't open bolt, err %s\n", err)
+	}
+	d, err := NewDispatcher(db, hooks)
+	if err != nil {
+		t.Fatalf("couldn't create dispatcher, err %s\n", err)
+	}
+	d.Backoff = time.Millisecond
+	d.MaxBackoff = 10 * time.Millisecond
+	return d
+}